@@ -0,0 +1,175 @@
+package config
+
+import (
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pkg/errors"
+)
+
+// Codec is an entry of the `codecs:` registry
+type Codec struct {
+	MimeType     string   `yaml:"mime-type"`     // e.g. video/H264, video/VP8, audio/opus
+	ClockRate    uint32   `yaml:"clock-rate"`    // default 90000 for video, 48000 for audio
+	Channels     uint16   `yaml:"channels"`      // audio only, 2 for opus
+	PayloadType  *uint8   `yaml:"payload-type"`  // required and unique in the registry, 0 is PCMU
+	Fmtp         string   `yaml:"fmtp"`          // e.g. profile-level-id=42e01f;packetization-mode=1
+	RtcpFeedback []string `yaml:"rtcp-feedback"` // "type" or "type parameter", e.g. nack, nack pli, ccm fir, transport-cc
+}
+
+// Codecs lists the codecs allowed per kind in priority order. The SFU and the clients, through
+// GET /codecs, build their MediaEngine from it. Only the feedback listed is negotiated: NACK needs
+// "nack", keyframe requests "nack pli" or "ccm fir" and the bandwidth estimate "transport-cc".
+type Codecs struct {
+	Video []Codec `yaml:"video"`
+	Audio []Codec `yaml:"audio"`
+}
+
+// defaultCodecs is the registry of a kind missing from `codecs:`: H.264 first, the UAVs encode it in hardware
+func defaultCodecs() Codecs {
+	videoFeedback := []string{"nack", "nack pli", "ccm fir", "transport-cc"}
+	return Codecs{
+		Video: []Codec{
+			{MimeType: webrtc.MimeTypeH264, PayloadType: payloadType(102), Fmtp: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f", RtcpFeedback: videoFeedback},
+			{MimeType: webrtc.MimeTypeH264, PayloadType: payloadType(106), Fmtp: "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42e01f", RtcpFeedback: videoFeedback},
+			{MimeType: webrtc.MimeTypeVP8, PayloadType: payloadType(96), RtcpFeedback: videoFeedback},
+		},
+		Audio: []Codec{
+			{MimeType: webrtc.MimeTypeOpus, Channels: 2, PayloadType: payloadType(111), Fmtp: "minptime=10;useinbandfec=1", RtcpFeedback: []string{"transport-cc"}},
+		},
+	}
+}
+
+func payloadType(pt uint8) *uint8 { return &pt }
+
+// applyDefaults fills each kind left out of `codecs:` with the default codecs of that kind.
+func (c *Codecs) applyDefaults() {
+	defaults := defaultCodecs()
+	if len(c.Video) == 0 {
+		c.Video = defaults.Video
+	}
+	if len(c.Audio) == 0 {
+		c.Audio = defaults.Audio
+	}
+}
+
+// Parameters returns the codecs of kind as pion codec parameters, in priority order.
+func (c Codecs) Parameters(kind webrtc.RTPCodecType) []webrtc.RTPCodecParameters {
+	codecs, clockRate := c.Video, uint32(90000)
+	if kind == webrtc.RTPCodecTypeAudio {
+		codecs, clockRate = c.Audio, 48000
+	}
+	params := make([]webrtc.RTPCodecParameters, 0, len(codecs))
+	for _, codec := range codecs {
+		p := webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    codec.MimeType,
+				ClockRate:   codec.ClockRate,
+				Channels:    codec.Channels,
+				SDPFmtpLine: codec.Fmtp,
+			},
+		}
+		if codec.PayloadType != nil {
+			p.PayloadType = webrtc.PayloadType(*codec.PayloadType)
+		}
+		if p.ClockRate == 0 {
+			p.ClockRate = clockRate
+		}
+		for _, feedback := range codec.RtcpFeedback {
+			typ, parameter, _ := strings.Cut(strings.TrimSpace(feedback), " ")
+			p.RTCPFeedback = append(p.RTCPFeedback, webrtc.RTCPFeedback{Type: typ, Parameter: strings.TrimSpace(parameter)})
+		}
+		params = append(params, p)
+	}
+	return params
+}
+
+// register adds the codecs to media in priority order, a mime type of the wrong kind or a payload
+// type missing or used twice is an error.
+func (c Codecs) register(media *webrtc.MediaEngine) error {
+	for _, codec := range append(append([]Codec(nil), c.Video...), c.Audio...) {
+		if codec.PayloadType == nil {
+			return errors.Errorf("codecs: payload-type is required for %s", codec.MimeType)
+		}
+	}
+	payloadTypes := make(map[webrtc.PayloadType]string)
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		for _, codec := range c.Parameters(kind) {
+			if !strings.HasPrefix(strings.ToLower(codec.MimeType), kind.String()+"/") {
+				return errors.Errorf("codecs: %q is not a %s codec", codec.MimeType, kind)
+			}
+			if codec.PayloadType > 127 {
+				return errors.Errorf("codecs: %s needs a payload type between 0 and 127", codec.MimeType)
+			}
+			if other, used := payloadTypes[codec.PayloadType]; used {
+				return errors.Errorf("codecs: payload type %d of %s is already used by %s", codec.PayloadType, codec.MimeType, other)
+			}
+			payloadTypes[codec.PayloadType] = codec.MimeType
+			if err := media.RegisterCodec(codec, kind); err != nil {
+				return errors.Wrapf(err, "codecs: %s", codec.MimeType)
+			}
+		}
+	}
+	return nil
+}
+
+// CompleteOffer gives the H.264 payloads of an offer that have no fmtp line the fmtp of the first
+// H.264 codec of the registry. The UAVs send H.264 without one, pion only matches H.264 exactly on
+// packetization-mode and profile-level-id and would prefer any other exactly matched codec.
+func (c Codecs) CompleteOffer(offer string) string {
+	fmtp := ""
+	for _, codec := range c.Video {
+		if strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264) && codec.Fmtp != "" {
+			fmtp = codec.Fmtp
+			break
+		}
+	}
+	if fmtp == "" || !strings.Contains(strings.ToUpper(offer), "H264/") {
+		return offer
+	}
+
+	lines := strings.SplitAfter(offer, "\n")
+	// payload types with an fmtp line, per media section
+	described := make(map[int]map[string]bool)
+	section := 0
+	for _, line := range lines {
+		if strings.HasPrefix(line, "m=") {
+			section++
+		}
+		if rest, ok := strings.CutPrefix(line, "a=fmtp:"); ok {
+			pt, _, _ := strings.Cut(rest, " ")
+			if described[section] == nil {
+				described[section] = make(map[string]bool)
+			}
+			described[section][pt] = true
+		}
+	}
+
+	var completed strings.Builder
+	section = 0
+	for _, line := range lines {
+		completed.WriteString(line)
+		if strings.HasPrefix(line, "m=") {
+			section++
+		}
+		rest, ok := strings.CutPrefix(line, "a=rtpmap:")
+		if !ok {
+			continue
+		}
+		pt, encoding, _ := strings.Cut(rest, " ")
+		if !strings.HasPrefix(strings.ToUpper(encoding), "H264/") || described[section][pt] {
+			continue
+		}
+		eol := "\r\n"
+		switch {
+		case strings.HasSuffix(line, "\r\n"):
+		case strings.HasSuffix(line, "\n"):
+			eol = "\n"
+		default: // last line without a line break
+			completed.WriteString(eol)
+			eol = ""
+		}
+		completed.WriteString("a=fmtp:" + pt + " " + fmtp + eol)
+	}
+	return completed.String()
+}
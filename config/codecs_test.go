@@ -0,0 +1,48 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestCodecsApplyDefaultsPerKind(t *testing.T) {
+	codecs := Codecs{Video: []Codec{{MimeType: webrtc.MimeTypeVP8, PayloadType: payloadType(96)}}}
+	codecs.applyDefaults()
+	if len(codecs.Video) != 1 || codecs.Video[0].MimeType != webrtc.MimeTypeVP8 {
+		t.Errorf("configured video codecs replaced: %+v", codecs.Video)
+	}
+	if len(codecs.Audio) == 0 || codecs.Audio[0].MimeType != webrtc.MimeTypeOpus {
+		t.Errorf("audio codecs %+v, want the default opus", codecs.Audio)
+	}
+}
+
+func TestCodecsRegister(t *testing.T) {
+	tests := []struct {
+		name   string
+		codecs Codecs
+		err    string
+	}{
+		{"defaults", defaultCodecs(), ""},
+		{"pcmu payload type 0", Codecs{Audio: []Codec{{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000, PayloadType: payloadType(0)}}}, ""},
+		{"missing payload type", Codecs{Audio: []Codec{{MimeType: webrtc.MimeTypeOpus}}}, "payload-type is required"},
+		{"payload type out of range", Codecs{Video: []Codec{{MimeType: webrtc.MimeTypeVP8, PayloadType: payloadType(128)}}}, "between 0 and 127"},
+		{"payload type used twice", Codecs{
+			Video: []Codec{{MimeType: webrtc.MimeTypeVP8, PayloadType: payloadType(96)}},
+			Audio: []Codec{{MimeType: webrtc.MimeTypeOpus, PayloadType: payloadType(96)}},
+		}, "already used"},
+		{"wrong kind", Codecs{Video: []Codec{{MimeType: webrtc.MimeTypeOpus, PayloadType: payloadType(111)}}}, "not a video codec"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.codecs.register(&webrtc.MediaEngine{})
+			if tt.err == "" && err != nil {
+				t.Fatalf("register: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("register error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
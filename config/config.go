@@ -6,11 +6,13 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/pion/interceptor/pkg/cc"
 	"github.com/pion/webrtc/v4"
+	"go-rest-api/dto"
 	"gopkg.in/yaml.v3"
 )
 
@@ -18,8 +20,10 @@ func CorsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, If-Match")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, PATCH, DELETE")
+		// WHIP clients in browsers read the resource URL and ICE servers from these
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "Location, Link, ETag")
 
 		if c.Request.Method == http.MethodOptions {
 			c.Writer.WriteHeader(http.StatusNoContent) // Use `WriteHeader` instead of `AbortWithStatus`
@@ -37,13 +41,13 @@ func GetWebSocket() websocket.Upgrader {
 			// Allow all connections by default (for development purposes)
 			return true
 		},
+		// browsers send the join token as subprotocols ["bearer", token], the server must select "bearer"
+		Subprotocols: []string{"bearer"},
 	}
 }
 
-// WebSocketConf Quản lý kết nối WebSocket của user
+// WebSocketConf Quản lý kết nối WebSocket của user, room membership is kept by the signaling hub in service
 type WebSocketConf struct {
-	Mutex   *sync.Mutex
-	RoomLst map[string]map[string]*websocket.Conn
 	Upgrade websocket.Upgrader
 }
 
@@ -56,17 +60,114 @@ type Database struct {
 }
 
 type App struct {
-	Port string `yaml:"port"`
+	Port          string        `yaml:"port"`
+	SendQueueSize int           `yaml:"send-queue-size"` // outbound messages buffered per websocket before it is evicted as a slow consumer
+	ResumeGrace   time.Duration `yaml:"resume-grace"`    // how long a dropped session waits for a resume token, 0 disables resume
+	// websocket heartbeat: the server pings every PingInterval, a socket silent for PongWait is evicted
+	PingInterval   time.Duration `yaml:"ping-interval"`
+	PongWait       time.Duration `yaml:"pong-wait"`
+	MaxMessageSize int64         `yaml:"max-message-size"` // bytes, larger inbound messages close the socket (1009)
+	// ShutdownTimeout bounds the drain on SIGTERM: notify members, flush and close sockets and peer connections
+	ShutdownTimeout time.Duration `yaml:"shutdown-timeout"`
+}
+
+// Auth configures bearer token verification for room joins and the per-room access lists
+type Auth struct {
+	Enabled       bool                   `yaml:"enabled"`
+	HMACSecret    string                 `yaml:"hmac-secret"`     // HS256/384/512 shared secret
+	PublicKeyFile string                 `yaml:"public-key-file"` // PEM RSA or ECDSA public key for RS*/ES* tokens
+	Issuer        string                 `yaml:"issuer"`          // optional `iss` to enforce
+	Audience      string                 `yaml:"audience"`        // optional `aud` to enforce
+	UserClaim     string                 `yaml:"user-claim"`      // claim holding the user ID, default "sub"
+	Rooms         map[string][]RoomGrant `yaml:"rooms"`           // roomId -> access list, "*" applies to rooms not listed
+	AdminToken    string                 `yaml:"admin-token"`     // bearer credential of the room management API, empty disables it
+}
+
+// RoomGrant allows an identity to join a room in a role (operator, viewer, device)
+type RoomGrant struct {
+	Identity string `yaml:"identity"` // user ID from the token, "*" matches anyone
+	Role     string `yaml:"role"`
+}
+
+// Rooms configures the room policies, Policies overrides Default per roomId
+type Rooms struct {
+	Default  dto.RoomPolicy            `yaml:"default"`
+	Policies map[string]dto.RoomPolicy `yaml:"policies"`
+}
+
+// Broker selects how room traffic is shared between signaling instances
+type Broker struct {
+	Type      string        `yaml:"type"`      // memory (single instance, default) | postgres (LISTEN/NOTIFY on `database:`)
+	Channel   string        `yaml:"channel"`   // NOTIFY channel, default "signaling"
+	NodeID    string        `yaml:"node-id"`   // unique per instance, default hostname-pid-random
+	Heartbeat time.Duration `yaml:"heartbeat"` // how often this instance tells the others it is alive, default 10s
+	NodeTTL   time.Duration `yaml:"node-ttl"`  // the members of an instance silent that long are dropped, default 3 heartbeats
+}
+
+// Ice lists the ICE servers handed to clients by /ice-servers and used by the SFU peer connections.
+// With TurnSecret set (coturn `use-auth-secret` + `static-auth-secret`) TURN credentials are issued
+// per user in the TURN REST format: username "<expiry unix>:<user>", password base64(HMAC-SHA1(secret, username)).
+type Ice struct {
+	StunURLs      []string      `yaml:"stun-urls"`
+	TurnURLs      []string      `yaml:"turn-urls"`
+	TurnSecret    string        `yaml:"turn-secret"`
+	CredentialTTL time.Duration `yaml:"credential-ttl"` // lifetime of issued TURN credentials, default 24h
+}
+
+// Turn runs a TURN relay inside the server process. It accepts the credentials issued by /ice-servers,
+// so a client allowed to join a room can relay through it without a separate coturn deployment.
+type Turn struct {
+	Enabled         bool     `yaml:"enabled"`
+	ListenAddress   string   `yaml:"listen-address"` // UDP and TCP, default 0.0.0.0:3478
+	Realm           string   `yaml:"realm"`          // default "uav-signal"
+	RelayIP         string   `yaml:"relay-ip"`       // public IP announced in relayed candidates
+	MinPort         uint16   `yaml:"min-port"`       // relay port range, default 50000-50999
+	MaxPort         uint16   `yaml:"max-port"`
+	DeniedNetworks  []string `yaml:"denied-networks"`  // peers the relay refuses, default private, loopback, link-local (cloud metadata), CGNAT and multicast
+	AllowedNetworks []string `yaml:"allowed-networks"` // peers exempt from the denied networks, e.g. the LAN of a ground station
+}
+
+// Recording writes the published tracks to disk: H.264 as Annex-B or MP4, VP8 as IVF, Opus as Ogg.
+// Rooms whose policy sets auto-record record every publisher from its first track on.
+type Recording struct {
+	Dir        string `yaml:"dir"`         // one directory per room, default "recordings"
+	H264Format string `yaml:"h264-format"` // annexb (default) | mp4, a recording started by the API may override it
+}
+
+// Hls packages an H.264 publisher, with its Opus audio, as fMP4 HLS for players that cannot do WebRTC.
+// A stream starts with the first request of its playlist and stops once nobody requested it for IdleTimeout.
+type Hls struct {
+	SegmentDuration time.Duration `yaml:"segment-duration"` // segments are cut at the first keyframe after it, default 2s
+	PartDuration    time.Duration `yaml:"part-duration"`    // low-latency HLS partial segments, 0 disables them
+	PlaylistSize    int           `yaml:"playlist-size"`    // segments listed in the playlist, default 6
+	IdleTimeout     time.Duration `yaml:"idle-timeout"`     // default 30s
+}
+
+// Forwarding re-sends published tracks as plain RTP over UDP, e.g. to ground control station software.
+type Forwarding struct {
+	AllowedNetworks  []string      `yaml:"allowed-networks"`  // CIDRs the targets must be in, forwards are refused when empty
+	SdpDir           string        `yaml:"sdp-dir"`           // the SDP of every target is also written there, empty keeps them in the API only
+	KeyframeInterval time.Duration `yaml:"keyframe-interval"` // keyframes asked from the publisher so receivers can start late, 0 disables
 }
 
 type Config struct {
-	Database          Database `yaml:"database"`
-	App               App      `yaml:"app"`
-	stun              []string `yaml:"stun-urls"`
-	PeerConnectionMap map[string]chan *webrtc.TrackLocalStaticRTP
-	Api               *webrtc.API
-	IceConfig         *webrtc.Configuration
-	WebSock           *WebSocketConf
+	Database   Database   `yaml:"database"`
+	App        App        `yaml:"app"`
+	Auth       Auth       `yaml:"auth"`
+	Rooms      Rooms      `yaml:"rooms"`
+	Broker     Broker     `yaml:"broker"`
+	Ice        Ice        `yaml:"ice"`
+	Turn       Turn       `yaml:"turn"`
+	Sfu        Sfu        `yaml:"sfu"`
+	Recording  Recording  `yaml:"recording"`
+	Hls        Hls        `yaml:"hls"`
+	Forwarding Forwarding `yaml:"forwarding"`
+	Codecs     Codecs     `yaml:"codecs"`
+	Api        *webrtc.API
+	IceConfig  *webrtc.Configuration
+	WebSock    *WebSocketConf
+
+	media *webrtc.MediaEngine // shared by the SFU peer connections, each copies it
 }
 
 type Sdp struct {
@@ -97,54 +198,61 @@ func LoadConfig(resourceDir string) {
 		log.Fatal(err)
 	}
 
+	// the codecs allowed in the SFU, in priority order
+	AppConfig.Codecs.applyDefaults()
 	media := webrtc.MediaEngine{}
+	if err := AppConfig.Codecs.register(&media); err != nil {
+		log.Fatal(err)
+	}
 
-	// Set up the codecs you want to use.
-	// Only support VP8(video compression), this makes our proxying code simpler
-	// Create a new MediaEngine
-	// Register the VP8 codec
-	if err := media.RegisterCodec(webrtc.RTPCodecParameters{
-		RTPCodecCapability: webrtc.RTPCodecCapability{
-			MimeType:    "video/VP8",
-			ClockRate:   90000,
-			Channels:    0, // Video codecs have 0 channels
-			SDPFmtpLine: "",
-		},
-		PayloadType: 96, // Default payload type for VP8
-	}, webrtc.RTPCodecTypeVideo); err != nil {
-		log.Println("Error registering video:", err)
-		// Alternatively, register default codecs (including VP8)
-		if err := media.RegisterDefaultCodecs(); err != nil {
-			log.Fatal(err)
-		}
+	// rid/mid header extensions, so the SFU accepts simulcast offers
+	if err := webrtc.ConfigureSimulcastExtensionHeaders(&media); err != nil {
+		log.Fatal(err)
 	}
 
-	// Alternatively, register default codecs (including VP8)
-	if err := media.RegisterDefaultCodecs(); err != nil {
+	// NACK, RTCP reports, TWCC and the bandwidth estimators of the SFU, see NewPeerConnection
+	if err := registerTWCC(&media); err != nil {
+		log.Fatal(err)
+	}
+	AppConfig.applySfuDefaults()
+	registry, err := AppConfig.interceptors(func(cc.BandwidthEstimator) {})
+	if err != nil {
 		log.Fatal(err)
 	}
 
 	// Create a new Api with the MediaEngine
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(&media))
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(&media), webrtc.WithInterceptorRegistry(registry))
 
+	if AppConfig.Ice.CredentialTTL <= 0 {
+		AppConfig.Ice.CredentialTTL = 24 * time.Hour
+	}
+	if AppConfig.Recording.Dir == "" {
+		AppConfig.Recording.Dir = "recordings"
+	}
+	if AppConfig.Recording.H264Format == "" {
+		AppConfig.Recording.H264Format = "annexb"
+	}
+	if AppConfig.Hls.SegmentDuration <= 0 {
+		AppConfig.Hls.SegmentDuration = 2 * time.Second
+	}
+	if AppConfig.Hls.PlaylistSize <= 0 {
+		AppConfig.Hls.PlaylistSize = 6
+	}
+	if AppConfig.Hls.IdleTimeout <= 0 {
+		AppConfig.Hls.IdleTimeout = 30 * time.Second
+	}
+	if AppConfig.Turn.Enabled {
+		AppConfig.applyTurn()
+	}
 	peerConnectionConfig := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: AppConfig.stun,
-			},
-		},
+		ICEServers: AppConfig.Ice.Servers(sfuTurnUser, time.Now()),
 	}
 	AppConfig.IceConfig = &peerConnectionConfig
 	AppConfig.Api = api
-	AppConfig.PeerConnectionMap = make(map[string]chan *webrtc.TrackLocalStaticRTP) // sender to channel of track
+	AppConfig.media = &media
 
 	// config websocket
-	// Quản lý nhiều phòng chat
-	var roomClients = make(map[string]map[string]*websocket.Conn) // roomId -> (username -> WebSocket)
-	var mutex = &sync.Mutex{}                                     // Tránh race condition
 	AppConfig.WebSock = &WebSocketConf{
-		Mutex:   mutex,
-		RoomLst: roomClients,
 		Upgrade: GetWebSocket(),
 	}
 }
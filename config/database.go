@@ -9,18 +9,21 @@ import (
 
 var DB *gorm.DB
 
-func ConnectDatabase() {
-	var err error
-
-	dsn := fmt.Sprintf("host=%s port=%s user=%s dbname=%s password=%s sslmode=disable",
+// DatabaseDSN is the libpq connection string of the `database:` config
+func DatabaseDSN() string {
+	return fmt.Sprintf("host=%s port=%s user=%s dbname=%s password=%s sslmode=disable",
 		AppConfig.Database.Host,
 		AppConfig.Database.Port,
 		AppConfig.Database.Username,
 		AppConfig.Database.Name,
 		AppConfig.Database.Password,
 	)
+}
+
+func ConnectDatabase() {
+	var err error
 
-	DB, err = gorm.Open("postgres", dsn)
+	DB, err = gorm.Open("postgres", DatabaseDSN())
 	if err != nil {
 		panic("Failed to connect to database!")
 	}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// sfuTurnUser is the TURN user of the server's own peer connections
+const sfuTurnUser = "sfu"
+
+// TurnCredential returns the TURN REST username and password of user, valid until now + CredentialTTL.
+func (c Ice) TurnCredential(user string, now time.Time) (string, string) {
+	username := fmt.Sprintf("%d:%s", now.Add(c.CredentialTTL).Unix(), user)
+	mac := hmac.New(sha1.New, []byte(c.TurnSecret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Servers returns the configured ICE servers, TURN entries carry credentials for user when a secret is set.
+func (c Ice) Servers(user string, now time.Time) []webrtc.ICEServer {
+	var servers []webrtc.ICEServer
+	if len(c.StunURLs) > 0 {
+		servers = append(servers, webrtc.ICEServer{URLs: c.StunURLs})
+	}
+	if len(c.TurnURLs) > 0 {
+		turn := webrtc.ICEServer{URLs: c.TurnURLs}
+		if c.TurnSecret != "" {
+			username, password := c.TurnCredential(user, now)
+			turn.Username = username
+			turn.Credential = password
+		}
+		servers = append(servers, turn)
+	}
+	return servers
+}
+
+// PeerConfig returns IceConfig with fresh TURN credentials, issued ones expire after CredentialTTL.
+func (c *Config) PeerConfig() webrtc.Configuration {
+	conf := *c.IceConfig
+	conf.ICEServers = c.Ice.Servers(sfuTurnUser, time.Now())
+	return conf
+}
+
+// applyTurn fills the defaults of the embedded TURN relay and advertises it in the ICE server list.
+func (c *Config) applyTurn() {
+	if c.Turn.ListenAddress == "" {
+		c.Turn.ListenAddress = "0.0.0.0:3478"
+	}
+	if c.Turn.Realm == "" {
+		c.Turn.Realm = "uav-signal"
+	}
+	if c.Turn.MinPort == 0 || c.Turn.MaxPort == 0 {
+		c.Turn.MinPort, c.Turn.MaxPort = 50000, 50999
+	}
+	if net.ParseIP(c.Turn.RelayIP) == nil {
+		log.Fatalf("turn.relay-ip %q must be the public IP of this host", c.Turn.RelayIP)
+	}
+	if c.Ice.TurnSecret == "" {
+		// credentials only work on this instance, set ice.turn-secret when running several
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatal(err)
+		}
+		c.Ice.TurnSecret = hex.EncodeToString(secret)
+		log.Println("ice.turn-secret is not set, using a random secret for the embedded TURN relay")
+	}
+	if len(c.Ice.TurnURLs) == 0 {
+		_, port, err := net.SplitHostPort(c.Turn.ListenAddress)
+		if err != nil {
+			log.Fatalf("turn.listen-address %q: %v", c.Turn.ListenAddress, err)
+		}
+		host := net.JoinHostPort(c.Turn.RelayIP, port)
+		c.Ice.TurnURLs = []string{"turn:" + host + "?transport=udp", "turn:" + host + "?transport=tcp"}
+	}
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pion/turn/v4"
+)
+
+func TestTurnCredential(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name         string
+		ice          Ice
+		user         string
+		wantUsername string
+		wantPassword string // base64(HMAC-SHA1(secret, username))
+	}{
+		{"one hour", Ice{TurnSecret: "secret", CredentialTTL: time.Hour}, "pilot", "1700003600:pilot", "9+IWMXkkjylTFnbRGbecRCj37EQ="},
+		{"one day", Ice{TurnSecret: "secret", CredentialTTL: 24 * time.Hour}, "drone1", "1700086400:drone1", "bqR0kgsN56eAGgoeWVCygtwSf5c="},
+		{"user with a colon", Ice{TurnSecret: "other", CredentialTTL: time.Minute}, "a:b", "1700000060:a:b", "H5M4qqC72ibctcmxQo+SIymTlhg="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			username, password := tt.ice.TurnCredential(tt.user, now)
+			if username != tt.wantUsername || password != tt.wantPassword {
+				t.Errorf("TurnCredential() = %q, %q, want %q, %q", username, password, tt.wantUsername, tt.wantPassword)
+			}
+		})
+	}
+}
+
+func TestTurnCredentialIsAcceptedByTheRelay(t *testing.T) {
+	ice := Ice{TurnSecret: "secret", CredentialTTL: time.Hour}
+	auth := turn.LongTermTURNRESTAuthHandler(ice.TurnSecret, nil)
+	tests := []struct {
+		name   string
+		issued time.Time
+		secret string
+		want   bool
+	}{
+		{"fresh", time.Now(), "secret", true},
+		{"expired", time.Now().Add(-2 * time.Hour), "secret", false},
+		{"other secret", time.Now(), "other", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer := ice
+			issuer.TurnSecret = tt.secret
+			username, password := issuer.TurnCredential("pilot", tt.issued)
+			key, ok := auth(username, "uav-signal", nil)
+			accepted := ok && bytes.Equal(key, turn.GenerateAuthKey(username, "uav-signal", password))
+			if accepted != tt.want {
+				t.Errorf("relay accepted %q = %v, want %v", username, accepted, tt.want)
+			}
+		})
+	}
+}
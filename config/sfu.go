@@ -0,0 +1,107 @@
+package config
+
+import (
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/interceptor/pkg/twcc"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// Sfu tunes the bandwidth estimation of the SFU subscribers, bitrates are in bits per second
+type Sfu struct {
+	InitialBitrate int `yaml:"initial-bitrate"` // estimate before the first feedback, default 1 Mbps
+	MinBitrate     int `yaml:"min-bitrate"`     // default 100 kbps
+	MaxBitrate     int `yaml:"max-bitrate"`     // default 20 Mbps
+}
+
+// registerTWCC adds the transport-wide sequence number header extension the estimators measure with.
+func registerTWCC(media *webrtc.MediaEngine) error {
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if err := media.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.TransportCCURI}, kind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// interceptors builds the NACK, RTCP reports, TWCC and GCC bandwidth estimator interceptors of one peer
+// connection, the estimator is handed to onEstimator. It only measures: it paces nothing, the SFU fits
+// the subscribers into their estimate by picking layers and dropping frames. The RTCP feedback is not
+// registered here, it comes with the codecs so a codec without "nack" or "transport-cc" in the registry
+// does not negotiate it.
+func (c *Config) interceptors(onEstimator func(cc.BandwidthEstimator)) (*interceptor.Registry, error) {
+	registry := &interceptor.Registry{}
+	responder, err := nack.NewResponderInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	generator, err := nack.NewGeneratorInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	registry.Add(responder)
+	registry.Add(generator)
+	if err := webrtc.ConfigureRTCPReports(registry); err != nil {
+		return nil, err
+	}
+	// feedback for the publishers
+	feedback, err := twcc.NewSenderInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	registry.Add(feedback)
+	congestion, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(c.Sfu.InitialBitrate),
+			gcc.SendSideBWEMinBitrate(c.Sfu.MinBitrate),
+			gcc.SendSideBWEMaxBitrate(c.Sfu.MaxBitrate),
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+	congestion.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+		onEstimator(estimator)
+	})
+	registry.Add(congestion)
+	// added last so the sequence numbers are stamped before the estimator records the packets
+	header, err := twcc.NewHeaderExtensionInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	registry.Add(header)
+	return registry, nil
+}
+
+// applySfuDefaults sets the bitrates left out of `sfu:`.
+func (c *Config) applySfuDefaults() {
+	if c.Sfu.InitialBitrate <= 0 {
+		c.Sfu.InitialBitrate = 1_000_000
+	}
+	if c.Sfu.MinBitrate <= 0 {
+		c.Sfu.MinBitrate = 100_000
+	}
+	if c.Sfu.MaxBitrate <= 0 {
+		c.Sfu.MaxBitrate = 20_000_000
+	}
+}
+
+// NewPeerConnection creates an SFU peer connection with the bandwidth estimator of what it sends.
+// Each peer connection is built from its own interceptor registry, so the estimator is its own.
+func (c *Config) NewPeerConnection() (*webrtc.PeerConnection, cc.BandwidthEstimator, error) {
+	var estimator cc.BandwidthEstimator
+	registry, err := c.interceptors(func(e cc.BandwidthEstimator) { estimator = e })
+	if err != nil {
+		return nil, nil, err
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(c.media), webrtc.WithInterceptorRegistry(registry))
+	pc, err := api.NewPeerConnection(c.PeerConfig())
+	if err != nil {
+		return nil, nil, err
+	}
+	return pc, estimator, nil
+}
@@ -0,0 +1,48 @@
+package controllers
+
+import (
+	"go-rest-api/config"
+	"go-rest-api/dto"
+	"go-rest-api/utils"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pion/webrtc/v4"
+)
+
+// CodecController publishes the codec registry so clients build the same MediaEngine as the SFU
+type CodecController struct {
+	Controller
+	codecs dto.CodecsResponse
+}
+
+func NewCodecController(codecs config.Codecs) *CodecController {
+	return &CodecController{codecs: dto.CodecsResponse{
+		Video: codecsOf(codecs, webrtc.RTPCodecTypeVideo),
+		Audio: codecsOf(codecs, webrtc.RTPCodecTypeAudio),
+	}}
+}
+
+func (c *CodecController) CodecsHandler(ctx *gin.Context) {
+	utils.RespondJSON(ctx, http.StatusOK, c.codecs)
+}
+
+func codecsOf(codecs config.Codecs, kind webrtc.RTPCodecType) []dto.Codec {
+	params := codecs.Parameters(kind)
+	list := make([]dto.Codec, 0, len(params))
+	for _, p := range params {
+		codec := dto.Codec{
+			MimeType:     p.MimeType,
+			ClockRate:    p.ClockRate,
+			Channels:     p.Channels,
+			PayloadType:  uint8(p.PayloadType),
+			SdpFmtpLine:  p.SDPFmtpLine,
+			RtcpFeedback: make([]dto.RtcpFeedback, 0, len(p.RTCPFeedback)),
+		}
+		for _, feedback := range p.RTCPFeedback {
+			codec.RtcpFeedback = append(codec.RtcpFeedback, dto.RtcpFeedback{Type: feedback.Type, Parameter: feedback.Parameter})
+		}
+		list = append(list, codec)
+	}
+	return list
+}
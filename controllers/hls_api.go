@@ -0,0 +1,54 @@
+package controllers
+
+import (
+	"go-rest-api/service"
+	"go-rest-api/utils"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// HlsController serves the HLS output of the SFU at /hls/:roomId/c/:userId/:file, `?publisher=` picks
+// the publisher like WHEP. Players that cannot send an Authorization header pass `?access_token=`,
+// the playlist carries its query to every URI.
+type HlsController struct {
+	Controller
+	videoCallService service.VideoCallService
+	authService      service.AuthService
+}
+
+func NewHlsController(svc service.VideoCallService, auth service.AuthService) *HlsController {
+	return &HlsController{videoCallService: svc, authService: auth}
+}
+
+func (c *HlsController) FileHandler(ctx *gin.Context) {
+	req, ok := authorizeJoin(ctx, c.authService)
+	if !ok {
+		return
+	}
+	contentType, body, err := c.videoCallService.HlsFile(ctx.Request.Context(), req.RoomID, ctx.Query("publisher"), ctx.Param("file"), ctx.Request.URL.Query())
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrHlsFileNotFound):
+			utils.RespondJSON(ctx, http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, service.ErrHlsUnsupported):
+			utils.RespondJSON(ctx, http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+		case errors.Is(err, service.ErrHlsBadRequest):
+			utils.RespondJSON(ctx, http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, service.ErrHlsNotReady):
+			ctx.Header("Retry-After", "1")
+			utils.RespondJSON(ctx, http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		default:
+			respondSessionError(ctx, err)
+		}
+		return
+	}
+	// the playlist changes with every part, the segments never do
+	if contentType == "application/vnd.apple.mpegurl" {
+		ctx.Header("Cache-Control", "no-cache")
+	} else {
+		ctx.Header("Cache-Control", "max-age=60")
+	}
+	ctx.Data(http.StatusOK, contentType, body)
+}
@@ -0,0 +1,35 @@
+package controllers
+
+import (
+	"go-rest-api/service"
+	"go-rest-api/utils"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// IceController hands out the ICE server list, TURN credentials are bound to the caller's identity
+type IceController struct {
+	Controller
+	iceService  service.IceService
+	authService service.AuthService
+}
+
+func NewIceController(svc service.IceService, auth service.AuthService) *IceController {
+	return &IceController{iceService: svc, authService: auth}
+}
+
+func (c *IceController) IceServersHandler(ctx *gin.Context) {
+	userID, err := c.authService.Authenticate(ctx)
+	if err != nil {
+		status := http.StatusForbidden
+		if errors.Is(err, service.ErrUnauthenticated) {
+			status = http.StatusUnauthorized
+		}
+		utils.RespondJSON(ctx, status, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.Header("Cache-Control", "no-store")
+	utils.RespondJSON(ctx, http.StatusOK, c.iceService.IceServers(userID))
+}
@@ -0,0 +1,159 @@
+package controllers
+
+import (
+	"go-rest-api/dto"
+	"go-rest-api/service"
+	"go-rest-api/utils"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// RoomController exposes the signaling rooms to operators and ops tooling
+type RoomController struct {
+	Controller
+	videoCallService service.VideoCallService
+}
+
+func NewRoomController(svc service.VideoCallService) *RoomController {
+	return &RoomController{videoCallService: svc}
+}
+
+func (c *RoomController) CreateRoomHandler(ctx *gin.Context) {
+	var input dto.CreateRoomRequest
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		utils.RespondJSON(ctx, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.videoCallService.CreateRoom(input)
+	utils.RespondJSON(ctx, http.StatusCreated, input)
+}
+
+func (c *RoomController) ListRoomsHandler(ctx *gin.Context) {
+	utils.RespondJSON(ctx, http.StatusOK, c.videoCallService.ListRooms())
+}
+
+func (c *RoomController) ListPeersHandler(ctx *gin.Context) {
+	peers, err := c.videoCallService.ListPeers(ctx.Param("roomId"))
+	if err != nil {
+		utils.RespondJSON(ctx, http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	utils.RespondJSON(ctx, http.StatusOK, peers)
+}
+
+func (c *RoomController) ListBandwidthHandler(ctx *gin.Context) {
+	estimates, err := c.videoCallService.ListBandwidth(ctx.Param("roomId"))
+	if err != nil {
+		utils.RespondJSON(ctx, http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	utils.RespondJSON(ctx, http.StatusOK, estimates)
+}
+
+func (c *RoomController) StartRecordingHandler(ctx *gin.Context) {
+	var input dto.StartRecordingRequest
+	if err := ctx.ShouldBindJSON(&input); err != nil && !errors.Is(err, io.EOF) {
+		utils.RespondJSON(ctx, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	recording, err := c.videoCallService.StartRecording(ctx.Param("roomId"), input)
+	switch {
+	case errors.Is(err, service.ErrInvalidFormat):
+		utils.RespondJSON(ctx, http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrPublisherNotFound):
+		utils.RespondJSON(ctx, http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrPublisherNotStreaming), errors.Is(err, service.ErrAlreadyRecording):
+		utils.RespondJSON(ctx, http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		utils.RespondJSON(ctx, http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		utils.RespondJSON(ctx, http.StatusCreated, recording)
+	}
+}
+
+// ListRecordingsHandler lists the active recordings of the room and the ones stopped within the last hour,
+// the files of older ones stay on disk.
+func (c *RoomController) ListRecordingsHandler(ctx *gin.Context) {
+	utils.RespondJSON(ctx, http.StatusOK, c.videoCallService.ListRecordings(ctx.Param("roomId")))
+}
+
+func (c *RoomController) StopRecordingHandler(ctx *gin.Context) {
+	recording, err := c.videoCallService.StopRecording(ctx.Param("roomId"), ctx.Param("recordingId"))
+	if err != nil {
+		utils.RespondJSON(ctx, http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	utils.RespondJSON(ctx, http.StatusOK, recording)
+}
+
+func (c *RoomController) StartForwardHandler(ctx *gin.Context) {
+	var input dto.StartForwardRequest
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		utils.RespondJSON(ctx, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	forward, err := c.videoCallService.StartForward(ctx.Param("roomId"), input)
+	switch {
+	case errors.Is(err, service.ErrInvalidForward):
+		utils.RespondJSON(ctx, http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrTargetNotAllowed):
+		utils.RespondJSON(ctx, http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrPublisherNotFound):
+		utils.RespondJSON(ctx, http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrPublisherNotStreaming), errors.Is(err, service.ErrNoTrackOfKind):
+		utils.RespondJSON(ctx, http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		utils.RespondJSON(ctx, http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		utils.RespondJSON(ctx, http.StatusCreated, forward)
+	}
+}
+
+// ListForwardsHandler lists the active forwards of the room and the ones stopped within the last hour.
+func (c *RoomController) ListForwardsHandler(ctx *gin.Context) {
+	utils.RespondJSON(ctx, http.StatusOK, c.videoCallService.ListForwards(ctx.Param("roomId")))
+}
+
+// ForwardSdpHandler returns the SDP of a forward target, `?target=host:port` picks it, default the first one.
+func (c *RoomController) ForwardSdpHandler(ctx *gin.Context) {
+	forward, err := c.videoCallService.GetForward(ctx.Param("roomId"), ctx.Param("forwardId"))
+	if err != nil {
+		utils.RespondJSON(ctx, http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	for _, target := range forward.Targets {
+		if address := ctx.Query("target"); address == "" || address == target.Address {
+			ctx.Data(http.StatusOK, "application/sdp", []byte(target.Sdp))
+			return
+		}
+	}
+	utils.RespondJSON(ctx, http.StatusNotFound, gin.H{"error": "target not found"})
+}
+
+func (c *RoomController) StopForwardHandler(ctx *gin.Context) {
+	forward, err := c.videoCallService.StopForward(ctx.Param("roomId"), ctx.Param("forwardId"))
+	if err != nil {
+		utils.RespondJSON(ctx, http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	utils.RespondJSON(ctx, http.StatusOK, forward)
+}
+
+func (c *RoomController) KickPeerHandler(ctx *gin.Context) {
+	if err := c.videoCallService.KickPeer(ctx.Param("roomId"), ctx.Param("userId")); err != nil {
+		utils.RespondJSON(ctx, http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	utils.RespondJSON(ctx, http.StatusNoContent, nil)
+}
+
+func (c *RoomController) CloseRoomHandler(ctx *gin.Context) {
+	if err := c.videoCallService.CloseRoom(ctx.Param("roomId")); err != nil {
+		utils.RespondJSON(ctx, http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	utils.RespondJSON(ctx, http.StatusNoContent, nil)
+}
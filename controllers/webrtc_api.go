@@ -2,8 +2,10 @@ package controllers
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
 	"go-rest-api/dto"
 	"go-rest-api/service"
+	"go-rest-api/utils"
 	"log"
 	"net/http"
 	"strconv"
@@ -12,10 +14,11 @@ import (
 type WebRtcController struct {
 	Controller
 	videoCallService service.VideoCallService
+	authService      service.AuthService
 }
 
-func NewWebRtcController(svc service.VideoCallService) *WebRtcController {
-	return &WebRtcController{videoCallService: svc}
+func NewWebRtcController(svc service.VideoCallService, auth service.AuthService) *WebRtcController {
+	return &WebRtcController{videoCallService: svc, authService: auth}
 }
 
 func (c *WebRtcController) WebSocketConnectHandler(ctx *gin.Context) {
@@ -25,11 +28,17 @@ func (c *WebRtcController) WebSocketConnectHandler(ctx *gin.Context) {
 		log.Println("Client disconnected before processing started:", err)
 		return
 	}
-	roomInfo := dto.JoinRequest{
-		RoomID: ctx.Param("roomId"),
-		UserID: ctx.Param("userId"),
+	roomInfo, err := c.authService.AuthorizeJoin(ctx, ctx.Param("roomId"))
+	if err != nil {
+		status := http.StatusForbidden
+		if errors.Is(err, service.ErrUnauthenticated) {
+			status = http.StatusUnauthorized
+		}
+		utils.RespondJSON(ctx, status, gin.H{"error": err.Error()})
+		return
 	}
-	err := c.videoCallService.JoinRoom(ctx, roomInfo)
+	roomInfo.ResumeToken = ctx.Query("resume")
+	err = c.videoCallService.JoinRoom(ctx, roomInfo)
 	if err != nil {
 		log.Println("Error joining room:", err)
 		return
@@ -46,7 +55,7 @@ func (c *WebRtcController) MakeVideoCallHandler(ctx *gin.Context) {
 	}
 	isSender, _ := strconv.ParseBool(ctx.Param("isSender"))
 	info := dto.PeerInfo{
-		MeetingID: "",
+		MeetingID: ctx.Param("meetingId"),
 		UserId:    ctx.Param("userID"),
 		PeerId:    ctx.Param("peerID"),
 		IsSender:  isSender,
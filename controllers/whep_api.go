@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"go-rest-api/service"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// WhepController implements WHEP (WebRTC-HTTP egress) so any WHEP player can watch a room.
+// The endpoint is /whep/:roomId/c/:userId, `?publisher=` picks a publisher, default the room's device.
+type WhepController struct {
+	Controller
+	videoCallService service.VideoCallService
+	authService      service.AuthService
+	iceService       service.IceService
+}
+
+func NewWhepController(svc service.VideoCallService, auth service.AuthService, ice service.IceService) *WhepController {
+	return &WhepController{videoCallService: svc, authService: auth, iceService: ice}
+}
+
+func (c *WhepController) SubscribeHandler(ctx *gin.Context) {
+	req, ok := authorizeJoin(ctx, c.authService)
+	if !ok {
+		return
+	}
+	offer, ok := readBody(ctx, "application/sdp")
+	if !ok {
+		return
+	}
+	resourceID, answer, err := c.videoCallService.Subscribe(req, ctx.Query("publisher"), offer)
+	if err != nil {
+		log.Printf("[%s] %s WHEP subscribe failed: %v\n", req.RoomID, req.UserID, err)
+		respondSessionError(ctx, err)
+		return
+	}
+	respondAnswer(ctx, c.iceService, req.UserID, resourceID, answer)
+}
+
+func (c *WhepController) TrickleHandler(ctx *gin.Context) {
+	req, ok := authorizeJoin(ctx, c.authService)
+	if !ok {
+		return
+	}
+	fragment, ok := readBody(ctx, "application/trickle-ice-sdpfrag")
+	if !ok {
+		return
+	}
+	if err := c.videoCallService.TrickleSubscriber(req, ctx.Param("resourceId"), fragment); err != nil {
+		respondSessionError(ctx, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+func (c *WhepController) UnsubscribeHandler(ctx *gin.Context) {
+	req, ok := authorizeJoin(ctx, c.authService)
+	if !ok {
+		return
+	}
+	if err := c.videoCallService.Unsubscribe(req, ctx.Param("resourceId")); err != nil {
+		respondSessionError(ctx, err)
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
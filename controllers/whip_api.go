@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	"fmt"
+	"go-rest-api/dto"
+	"go-rest-api/service"
+	"go-rest-api/utils"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// maxSdpSize limits WHIP bodies, an offer with a few media sections and candidates is a few KB
+const maxSdpSize = 64 << 10
+
+// WhipController implements WHIP (WebRTC-HTTP ingestion) for OBS, GStreamer whipsink and the UAVs.
+// The endpoint is /whip/:roomId/c/:userId, the publisher is authorized like a room join and needs
+// the device or operator role (`?role=device` on rooms without an access list).
+type WhipController struct {
+	Controller
+	videoCallService service.VideoCallService
+	authService      service.AuthService
+	iceService       service.IceService
+}
+
+func NewWhipController(svc service.VideoCallService, auth service.AuthService, ice service.IceService) *WhipController {
+	return &WhipController{videoCallService: svc, authService: auth, iceService: ice}
+}
+
+func (c *WhipController) PublishHandler(ctx *gin.Context) {
+	req, ok := authorizeJoin(ctx, c.authService)
+	if !ok {
+		return
+	}
+	offer, ok := readBody(ctx, "application/sdp")
+	if !ok {
+		return
+	}
+	resourceID, answer, err := c.videoCallService.Publish(req, offer)
+	if err != nil {
+		log.Printf("[%s] %s WHIP publish failed: %v\n", req.RoomID, req.UserID, err)
+		respondSessionError(ctx, err)
+		return
+	}
+	respondAnswer(ctx, c.iceService, req.UserID, resourceID, answer)
+}
+
+func (c *WhipController) TrickleHandler(ctx *gin.Context) {
+	req, ok := authorizeJoin(ctx, c.authService)
+	if !ok {
+		return
+	}
+	fragment, ok := readBody(ctx, "application/trickle-ice-sdpfrag")
+	if !ok {
+		return
+	}
+	if err := c.videoCallService.Trickle(req, ctx.Param("resourceId"), fragment); err != nil {
+		respondSessionError(ctx, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+func (c *WhipController) UnpublishHandler(ctx *gin.Context) {
+	req, ok := authorizeJoin(ctx, c.authService)
+	if !ok {
+		return
+	}
+	if err := c.videoCallService.Unpublish(req, ctx.Param("resourceId")); err != nil {
+		respondSessionError(ctx, err)
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+// authorizeJoin resolves the WHIP/WHEP client from the bearer token (their auth scheme) and the room access list.
+func authorizeJoin(ctx *gin.Context, authService service.AuthService) (dto.JoinRequest, bool) {
+	req, err := authService.AuthorizeJoin(ctx, ctx.Param("roomId"))
+	if err != nil {
+		status := http.StatusForbidden
+		if errors.Is(err, service.ErrUnauthenticated) {
+			status = http.StatusUnauthorized
+		}
+		utils.RespondJSON(ctx, status, gin.H{"error": err.Error()})
+		return req, false
+	}
+	return req, true
+}
+
+// respondAnswer sends the 201 with the answer, the resource Location and the ICE servers as Link headers.
+func respondAnswer(ctx *gin.Context, iceService service.IceService, userID, resourceID, answer string) {
+	for _, server := range iceService.IceServers(userID).IceServers {
+		for _, url := range server.URLs {
+			link := fmt.Sprintf(`<%s>; rel="ice-server"`, url)
+			if server.Username != "" {
+				link += fmt.Sprintf(`; username="%s"; credential="%s"; credential-type="password"`, server.Username, server.Credential)
+			}
+			ctx.Writer.Header().Add("Link", link)
+		}
+	}
+	ctx.Header("Location", strings.TrimSuffix(ctx.Request.URL.Path, "/")+"/"+resourceID)
+	ctx.Data(http.StatusCreated, "application/sdp", []byte(answer))
+}
+
+// readBody returns the request body if it has the expected content type.
+func readBody(ctx *gin.Context, contentType string) (string, bool) {
+	if mediaType, _, _ := mime.ParseMediaType(ctx.ContentType()); mediaType != contentType {
+		utils.RespondJSON(ctx, http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be " + contentType})
+		return "", false
+	}
+	body, err := io.ReadAll(io.LimitReader(ctx.Request.Body, maxSdpSize))
+	if err != nil || len(body) == 0 {
+		utils.RespondJSON(ctx, http.StatusBadRequest, gin.H{"error": "missing " + contentType + " body"})
+		return "", false
+	}
+	return string(body), true
+}
+
+func respondSessionError(ctx *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, service.ErrResourceNotFound), errors.Is(err, service.ErrPublisherNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, service.ErrPublisherNotStreaming), errors.Is(err, service.ErrRoomFull), errors.Is(err, service.ErrRoleFull):
+		status = http.StatusConflict
+	case errors.Is(err, service.ErrNotPublisher):
+		status = http.StatusForbidden
+	case errors.Is(err, service.ErrIceRestart):
+		status = http.StatusUnprocessableEntity
+	case errors.Is(err, service.ErrInvalidSdpFrag), errors.Is(err, service.ErrInvalidOffer):
+		status = http.StatusBadRequest
+	case errors.Is(err, service.ErrShuttingDown):
+		status = http.StatusServiceUnavailable
+	}
+	utils.RespondJSON(ctx, status, gin.H{"error": err.Error()})
+}
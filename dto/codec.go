@@ -0,0 +1,22 @@
+package dto
+
+// Codec is an entry of GET /codecs, the fields follow RTCRtpCodecParameters
+type Codec struct {
+	MimeType     string         `json:"mimeType"`
+	ClockRate    uint32         `json:"clockRate"`
+	Channels     uint16         `json:"channels,omitempty"`
+	PayloadType  uint8          `json:"payloadType"`
+	SdpFmtpLine  string         `json:"sdpFmtpLine,omitempty"`
+	RtcpFeedback []RtcpFeedback `json:"rtcpFeedback"`
+}
+
+type RtcpFeedback struct {
+	Type      string `json:"type"`
+	Parameter string `json:"parameter,omitempty"`
+}
+
+// CodecsResponse is the body of GET /codecs: the codecs the SFU accepts per kind, in priority order
+type CodecsResponse struct {
+	Video []Codec `json:"video"`
+	Audio []Codec `json:"audio"`
+}
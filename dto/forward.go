@@ -0,0 +1,38 @@
+package dto
+
+import "time"
+
+// StartForwardRequest re-sends a track of a publisher as RTP to UDP targets
+type StartForwardRequest struct {
+	Publisher   string   `json:"publisher"`   // default the first publisher of the room with a track of Kind
+	Kind        string   `json:"kind"`        // video (default) | audio
+	Targets     []string `json:"targets"`     // host:port
+	SSRC        uint32   `json:"ssrc"`        // written in the packets, random when 0
+	PayloadType uint8    `json:"payloadType"` // written in the packets, default 96 for video and 111 for audio
+}
+
+// Forward sends a track to its targets until it is stopped or the publisher is gone
+type Forward struct {
+	ID          string          `json:"id"`
+	RoomID      string          `json:"roomId"`
+	Publisher   string          `json:"publisher"`
+	TrackID     string          `json:"trackId"`
+	Kind        string          `json:"kind"`
+	MimeType    string          `json:"mimeType"`
+	SSRC        uint32          `json:"ssrc"`
+	PayloadType uint8           `json:"payloadType"`
+	Dropped     uint64          `json:"dropped,omitempty"` // packets lost because the targets did not keep up
+	Active      bool            `json:"active"`
+	StartedAt   time.Time       `json:"startedAt"`
+	StoppedAt   *time.Time      `json:"stoppedAt,omitempty"`
+	Targets     []ForwardTarget `json:"targets"`
+}
+
+// ForwardTarget is one receiver of a forward, Sdp describes the stream it receives
+type ForwardTarget struct {
+	Address string `json:"address"`
+	Sdp     string `json:"sdp"`
+	SdpPath string `json:"sdpPath,omitempty"`
+	Packets uint64 `json:"packets"`
+	Errors  uint64 `json:"errors,omitempty"`
+}
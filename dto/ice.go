@@ -0,0 +1,18 @@
+package dto
+
+// IceServer is one entry of RTCConfiguration.iceServers
+type IceServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// IceServersResponse is the body of GET /ice-servers. The top level fields follow the TURN REST API
+// (coturn) response, IceServers can be passed to RTCPeerConnection as-is.
+type IceServersResponse struct {
+	Username   string      `json:"username,omitempty"`
+	Password   string      `json:"password,omitempty"`
+	TTL        int64       `json:"ttl,omitempty"` // seconds the credential stays valid
+	URIs       []string    `json:"uris"`
+	IceServers []IceServer `json:"iceServers"`
+}
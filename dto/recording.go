@@ -0,0 +1,33 @@
+package dto
+
+import "time"
+
+// StartRecordingRequest records the tracks of a publisher, of every publisher of the room when empty
+type StartRecordingRequest struct {
+	Publisher  string `json:"publisher"`
+	H264Format string `json:"h264Format"` // annexb | mp4, default from the config
+}
+
+// Recording writes the tracks of a room to disk until it is stopped, automatic recordings also
+// stop when their publisher is gone
+type Recording struct {
+	ID        string          `json:"id"`
+	RoomID    string          `json:"roomId"`
+	Publisher string          `json:"publisher,omitempty"`
+	Auto      bool            `json:"auto"`
+	Active    bool            `json:"active"`
+	StartedAt time.Time       `json:"startedAt"`
+	StoppedAt *time.Time      `json:"stoppedAt,omitempty"`
+	Files     []RecordingFile `json:"files"`
+}
+
+// RecordingFile is one recorded track
+type RecordingFile struct {
+	TrackID   string `json:"trackId"`
+	Publisher string `json:"publisher"`
+	Kind      string `json:"kind"`
+	MimeType  string `json:"mimeType"`
+	Path      string `json:"path"`
+	Closed    bool   `json:"closed"`
+	Dropped   uint64 `json:"dropped,omitempty"` // packets lost because the disk did not keep up
+}
@@ -2,6 +2,15 @@ package dto
 
 // JoinRequest make a websocket request to join into a RoomID
 type JoinRequest struct {
-	RoomID string `json:"roomId"`
-	UserID string `json:"userId"`
+	RoomID      string `json:"roomId"`
+	UserID      string `json:"userId"`
+	ResumeToken string `json:"resumeToken,omitempty"` // token from a previous onConnected, resumes the session within the grace period
+	Role        string `json:"role,omitempty"`        // granted by the room access list, see RoleOperator...
 }
+
+// Roles a user can hold in a room
+const (
+	RoleOperator = "operator" // controls the UAV
+	RoleViewer   = "viewer"   // watches only
+	RoleDevice   = "device"   // the UAV itself, publisher of the room
+)
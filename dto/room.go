@@ -0,0 +1,54 @@
+package dto
+
+import "time"
+
+// RoomSummary is an active signaling room
+type RoomSummary struct {
+	RoomID  string     `json:"roomId"`
+	Members int        `json:"members"`
+	Policy  RoomPolicy `json:"policy"`
+}
+
+// RoomPolicy limits who can join a room, zero means unlimited
+type RoomPolicy struct {
+	MaxMembers int            `json:"maxMembers" yaml:"max-members"`
+	MaxPerRole map[string]int `json:"maxPerRole" yaml:"max-per-role"` // role -> max members, e.g. {"device": 1}
+	AutoRecord bool           `json:"autoRecord" yaml:"auto-record"`  // record every publisher of the room
+}
+
+// CreateRoomRequest registers a room with its own policy before anyone joins it
+type CreateRoomRequest struct {
+	RoomID string     `json:"roomId" binding:"required"`
+	Policy RoomPolicy `json:"policy"`
+}
+
+// PeerSummary is a user session in a room, Connected is false while it waits for a resume
+type PeerSummary struct {
+	UserID    string    `json:"userId"`
+	Role      string    `json:"role,omitempty"`
+	JoinedAt  time.Time `json:"joinedAt"`
+	RemoteIP  string    `json:"remoteIp"`
+	Connected bool      `json:"connected"`
+	Node      string    `json:"node,omitempty"` // the instance a member of another instance is connected to
+}
+
+// SubscriberBandwidth is the bandwidth estimate of an SFU subscriber, in bits per second, and how
+// the forwarded tracks fit into it
+type SubscriberBandwidth struct {
+	UserID   string                 `json:"userId"`
+	Estimate int                    `json:"estimate"`
+	Stats    map[string]interface{} `json:"stats,omitempty"` // loss and delay figures of the estimator
+	Tracks   []DownTrackBandwidth   `json:"tracks"`
+}
+
+// DownTrackBandwidth is a track forwarded to a subscriber, bitrates in bits per second
+type DownTrackBandwidth struct {
+	TrackID      string `json:"trackId"`
+	Publisher    string `json:"publisher"`
+	Kind         string `json:"kind"`
+	Layer        string `json:"layer"`  // simulcast rid forwarded, "" without simulcast
+	Target       string `json:"target"` // rid switched to on its next keyframe
+	Bitrate      uint64 `json:"bitrate"`
+	Budget       uint64 `json:"budget,omitempty"` // share of the estimate, video only
+	TemporalDrop bool   `json:"temporalDrop"`     // temporal layers above the base are dropped
+}
@@ -9,16 +9,77 @@ type PeerInfo struct {
 
 // Message Định dạng tin nhắn JSON cho websocket
 type Message struct {
-	From    *string `json:"from,omitempty"` // Server sẽ thêm "from" khi gửi đi
+	From    *string `json:"from,omitempty"` // Server sẽ thêm "from" khi gửi đi, always overwritten with the socket's identity
 	To      *string `json:"to,omitempty"`
 	Msg     string  `json:"msg"`
 	RoomID  string  `json:"roomId"`
 	Channel *string `json:"channel,omitempty"`
+	ID      *string `json:"id,omitempty"` // optional, chosen by the sender and echoed in the WsResponse acknowledging it
 }
 
 type WsResponse struct {
-	Status  int       `json:"status"`
-	Message string    `json:"msg"`
-	Time    int64     `json:"time"`
-	Peers   *[]string `json:"peers,omitempty"` // Server sẽ thêm "from" khi gửi đi
+	Status      int       `json:"status"`
+	Message     string    `json:"msg"`
+	Time        int64     `json:"time"`
+	Peers       *[]string `json:"peers,omitempty"`       // Server sẽ thêm "from" khi gửi đi
+	Members     *[]Peer   `json:"members,omitempty"`     // same members as Peers, with their role
+	From        *string   `json:"from,omitempty"`        // subject user of a presence event
+	ResumeToken *string   `json:"resumeToken,omitempty"` // pass as `?resume=` when reconnecting to keep the session
+	ID          *string   `json:"id,omitempty"`          // Message.ID this response acknowledges
+	Ack         string    `json:"ack,omitempty"`         // delivery outcome of the acknowledged message, see AckDelivered...
 }
+
+// Delivery outcomes reported in WsResponse.Ack
+const (
+	AckDelivered = "delivered"   // handed to the recipient's socket (every recipient for a broadcast)
+	AckQueued    = "queued"      // recipient is reconnecting, delivered once it resumes
+	AckForwarded = "forwarded"   // recipient is connected to another signaling instance, handed to it
+	AckNotInRoom = "not-in-room" // no such recipient in the room
+	AckRejected  = "rejected"    // refused by server policy, e.g. spoofed sender or wrong room
+	AckFailed    = "failed"      // the recipient's socket dropped it (slow consumer, closing)
+)
+
+// Peer is a room member as listed to clients, the device is the master (publisher) of the room
+type Peer struct {
+	UserID string `json:"userId"`
+	Role   string `json:"role,omitempty"`
+}
+
+// PeerIDs returns the user ids of peers, the WsResponse.Peers list
+func PeerIDs(peers []Peer) []string {
+	ids := make([]string, 0, len(peers))
+	for _, p := range peers {
+		ids = append(ids, p.UserID)
+	}
+	return ids
+}
+
+// Presence events generated by the server, sent to room members as WsResponse.Message
+const (
+	PeerJoined      = "peer-joined"
+	PeerLeft        = "peer-left"
+	PeerReconnected = "peer-reconnected"
+	// ServerGoingAway is sent to every member before the instance shuts down, the socket is then
+	// closed with 1001 (going away) and the client should reconnect, possibly to another instance
+	ServerGoingAway = "server-going-away"
+)
+
+// Websocket close codes sent by the server, 4000-4999 are reserved for applications
+const (
+	CloseSessionReplaced = 4001 // a second login with the same identity took over the session
+	CloseKicked          = 4002 // removed from the room by an operator
+	CloseRoomClosed      = 4003 // the room was closed by an operator
+	CloseRoomFull        = 4004 // the room has max-members members already
+	CloseRoleFull        = 4005 // the room has as many members of the role as its policy allows
+)
+
+// SFU signaling over the room websocket: members address the server's SFU as the peer "sfu" on the
+// webrtc channel, with the same offer/answer/candidate payload they use peer to peer.
+// {"type":"layer","publisher":"<userId>","rid":"<rid>"} picks a simulcast layer, an empty rid the best one.
+// On the data channel the "sfu" peer relays data channel messages, an offer with "publisher" only
+// exchanges messages with that member.
+const (
+	SfuPeer        = "sfu"
+	ChannelWebrtc  = "md"
+	ChannelDataRtc = "dt"
+)
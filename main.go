@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"go-rest-api/config"
 	"go-rest-api/controllers"
 	"go-rest-api/repo"
 	"go-rest-api/routes"
 	"go-rest-api/service"
 	"log"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -23,15 +29,56 @@ func main() {
 	productService := service.NewProductService(productRepo)
 	productController := controllers.NewProductController(productService)
 
-	videoCallService := service.NewVideoCallService()
-	videoController := controllers.NewWebRtcController(videoCallService)
+	broker := service.NewBroker(config.AppConfig.Broker)
+	videoCallService := service.NewVideoCallService(broker)
+	authService := service.NewAuthService(config.AppConfig.Auth)
+	videoController := controllers.NewWebRtcController(videoCallService, authService)
+	roomController := controllers.NewRoomController(videoCallService)
+	iceService := service.NewIceService(config.AppConfig.Ice)
+	iceController := controllers.NewIceController(iceService, authService)
+	whipController := controllers.NewWhipController(videoCallService, authService, iceService)
+	whepController := controllers.NewWhepController(videoCallService, authService, iceService)
+	hlsController := controllers.NewHlsController(videoCallService, authService)
+	codecController := controllers.NewCodecController(config.AppConfig.Codecs)
+	var turnServer service.TurnServer
+	if config.AppConfig.Turn.Enabled {
+		turnServer = service.NewTurnServer(config.AppConfig.Turn, config.AppConfig.Ice)
+	}
 
-	r := routes.NewRoute(productController, videoController)
+	r := routes.NewRoute(productController, videoController, roomController, iceController, whipController, whepController, hlsController, codecController)
 	port := config.AppConfig.App.Port
-	log.Println("server run in: " + port)
-	err := r.Run(":" + port)
-	if err != nil {
-		log.Fatal(err)
-		return
+	srv := &http.Server{Addr: ":" + port, Handler: r}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		log.Println("server run in: " + port)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	<-ctx.Done()
+	stop() // a second signal kills the process right away
+
+	timeout := config.AppConfig.App.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	log.Printf("shutting down, draining connections for up to %s\n", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// websockets are hijacked and not tracked by srv.Shutdown, the service drains them itself
+	if err := videoCallService.Shutdown(shutdownCtx); err != nil {
+		log.Println("Room drain:", err)
+	}
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Println("HTTP server shutdown:", err)
+	}
+	if turnServer != nil {
+		log.Printf("closing TURN relay, %d allocations\n", turnServer.Allocations())
+		if err := turnServer.Close(); err != nil {
+			log.Println("TURN relay close:", err)
+		}
 	}
+	log.Println("server stopped")
 }
@@ -3,13 +3,15 @@ package routes
 import (
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go-rest-api/config"
 	api "go-rest-api/controllers"
 	"go-rest-api/middlewares"
 	"log"
 )
 
-func NewRoute(productApi *api.ProductController, rtcApi *api.WebRtcController) *gin.Engine {
+func NewRoute(productApi *api.ProductController, rtcApi *api.WebRtcController, roomApi *api.RoomController, iceApi *api.IceController,
+	whipApi *api.WhipController, whepApi *api.WhepController, hlsApi *api.HlsController, codecApi *api.CodecController) *gin.Engine {
 	r := gin.Default()
 
 	// Register the IPLogger middleware
@@ -31,9 +33,47 @@ func NewRoute(productApi *api.ProductController, rtcApi *api.WebRtcController) *
 	//// webrtc
 	//r.POST("/webrtc/sdp/m/:meetingId/c/:userID/p/:peerID/s/:isSender", rtcApi.MakeVideoCallHandler)
 
+	// Prometheus scrape endpoint, instruments are registered by the service package
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
 	// Join room with websocket
 	r.GET("/ws/join/:roomId/c/:userId", rtcApi.WebSocketConnectHandler)
 
+	// STUN/TURN servers with short-lived TURN credentials for the caller
+	r.GET("/ice-servers", iceApi.IceServersHandler)
+	// the codec registry, clients build their MediaEngine from it
+	r.GET("/codecs", codecApi.CodecsHandler)
+
+	// WHIP ingest, the Location of a session is /whip/:roomId/c/:userId/:resourceId
+	r.POST("/whip/:roomId/c/:userId", whipApi.PublishHandler)
+	r.PATCH("/whip/:roomId/c/:userId/:resourceId", whipApi.TrickleHandler)
+	r.DELETE("/whip/:roomId/c/:userId/:resourceId", whipApi.UnpublishHandler)
+	// WHEP egress for viewers, ?publisher= selects the publisher of the room
+	r.POST("/whep/:roomId/c/:userId", whepApi.SubscribeHandler)
+	r.PATCH("/whep/:roomId/c/:userId/:resourceId", whepApi.TrickleHandler)
+	r.DELETE("/whep/:roomId/c/:userId/:resourceId", whepApi.UnsubscribeHandler)
+	// HLS for players without WebRTC, the stream starts with the first request of index.m3u8
+	r.GET("/hls/:roomId/c/:userId/:file", hlsApi.FileHandler)
+
+	// Room management for operators
+	admin := r.Group("/admin", middlewares.AdminAuth(config.AppConfig.Auth.AdminToken))
+	admin.POST("/rooms", roomApi.CreateRoomHandler)
+	admin.GET("/rooms", roomApi.ListRoomsHandler)
+	admin.GET("/rooms/:roomId/peers", roomApi.ListPeersHandler)
+	// SFU subscribers: bandwidth estimate, forwarded layers and their bitrate
+	admin.GET("/rooms/:roomId/bandwidth", roomApi.ListBandwidthHandler)
+	// recordings of the published tracks, a body {"publisher": ..} records one publisher only
+	admin.POST("/rooms/:roomId/recordings", roomApi.StartRecordingHandler)
+	admin.GET("/rooms/:roomId/recordings", roomApi.ListRecordingsHandler)
+	admin.DELETE("/rooms/:roomId/recordings/:recordingId", roomApi.StopRecordingHandler)
+	// plain RTP/UDP forwards of a publisher's track, the SDP describes the stream for a target
+	admin.POST("/rooms/:roomId/forwards", roomApi.StartForwardHandler)
+	admin.GET("/rooms/:roomId/forwards", roomApi.ListForwardsHandler)
+	admin.GET("/rooms/:roomId/forwards/:forwardId/sdp", roomApi.ForwardSdpHandler)
+	admin.DELETE("/rooms/:roomId/forwards/:forwardId", roomApi.StopForwardHandler)
+	admin.DELETE("/rooms/:roomId/peers/:userId", roomApi.KickPeerHandler)
+	admin.DELETE("/rooms/:roomId", roomApi.CloseRoomHandler)
+
 	// WebSocket endpoint example
 	r.GET("/ws", func(c *gin.Context) {
 		websocket := config.GetWebSocket()
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"crypto"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+	"go-rest-api/config"
+	"go-rest-api/dto"
+)
+
+// bearerProtocol is the websocket subprotocol marker, browsers can't set headers so they send
+// `new WebSocket(url, ["bearer", token])` and the token travels in Sec-WebSocket-Protocol.
+const bearerProtocol = "bearer"
+
+var (
+	ErrUnauthenticated = errors.New("missing or invalid token")
+	ErrForbidden       = errors.New("not allowed to join this room")
+)
+
+type AuthService interface {
+	// AuthorizeJoin resolves who is joining the room and in which role.
+	AuthorizeJoin(*gin.Context, string) (dto.JoinRequest, error)
+	// Authenticate resolves the caller of a REST endpoint from the same token as the room joins.
+	Authenticate(*gin.Context) (string, error)
+}
+
+// authService verifies bearer tokens with the keys from `auth:` and applies the room access lists.
+type authService struct {
+	conf      config.Auth
+	hmacKey   []byte
+	publicKey crypto.PublicKey
+}
+
+func (a *authService) AuthorizeJoin(ctx *gin.Context, roomID string) (dto.JoinRequest, error) {
+	req := dto.JoinRequest{RoomID: roomID, UserID: ctx.Param("userId")}
+	if req.UserID == dto.SfuPeer {
+		return req, ErrForbidden // reserved for the server's SFU
+	}
+	if !a.conf.Enabled {
+		// development mode: trust the path, rooms without an access list let the client pick its role
+		if a.grants(roomID) == nil {
+			req.Role = ctx.DefaultQuery("role", dto.RoleViewer)
+			return req, nil
+		}
+		role, ok := a.roleOf(roomID, req.UserID)
+		if !ok {
+			return req, ErrForbidden
+		}
+		req.Role = role
+		return req, nil
+	}
+
+	raw := bearerToken(ctx.Request)
+	if raw == "" {
+		return req, ErrUnauthenticated
+	}
+	userID, err := a.verify(raw)
+	if err != nil {
+		log.Printf("[%s] rejected token: %v\n", roomID, err)
+		return req, ErrUnauthenticated
+	}
+	if req.UserID != "" && req.UserID != userID {
+		log.Printf("[%s] token of %s used to join as %s\n", roomID, userID, req.UserID)
+		return req, ErrForbidden
+	}
+	if userID == dto.SfuPeer {
+		return req, ErrForbidden
+	}
+	req.UserID = userID
+	role, ok := a.roleOf(roomID, userID)
+	if !ok {
+		return req, ErrForbidden
+	}
+	req.Role = role
+	return req, nil
+}
+
+func (a *authService) Authenticate(ctx *gin.Context) (string, error) {
+	if !a.conf.Enabled {
+		// development mode: trust the caller like the join path does
+		return ctx.DefaultQuery("userId", "anonymous"), nil
+	}
+	raw := bearerToken(ctx.Request)
+	if raw == "" {
+		return "", ErrUnauthenticated
+	}
+	userID, err := a.verify(raw)
+	if err != nil {
+		log.Printf("rejected token: %v\n", err)
+		return "", ErrUnauthenticated
+	}
+	return userID, nil
+}
+
+// verify checks signature, expiry, issuer and audience and returns the user ID claim.
+func (a *authService) verify(raw string) (string, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodHMAC:
+			if a.hmacKey != nil {
+				return a.hmacKey, nil
+			}
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+			if a.publicKey != nil {
+				return a.publicKey, nil
+			}
+		}
+		return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+	})
+	if err != nil {
+		return "", err
+	}
+	if a.conf.Issuer != "" && !claims.VerifyIssuer(a.conf.Issuer, true) {
+		return "", errors.New("invalid issuer")
+	}
+	if a.conf.Audience != "" && !claims.VerifyAudience(a.conf.Audience, true) {
+		return "", errors.New("invalid audience")
+	}
+	userID, _ := claims[a.conf.UserClaim].(string)
+	if userID == "" {
+		return "", errors.Errorf("claim %q is missing", a.conf.UserClaim)
+	}
+	return userID, nil
+}
+
+// grants returns the access list of roomID, the "*" room applies to rooms without their own list.
+func (a *authService) grants(roomID string) []config.RoomGrant {
+	if grants, exists := a.conf.Rooms[roomID]; exists {
+		return grants
+	}
+	return a.conf.Rooms["*"]
+}
+
+// roleOf returns the role of the first grant matching userID.
+func (a *authService) roleOf(roomID, userID string) (string, bool) {
+	for _, grant := range a.grants(roomID) {
+		if grant.Identity == userID || grant.Identity == "*" {
+			return grant.Role, true
+		}
+	}
+	return "", false
+}
+
+// bearerToken reads the token from the Authorization header, the `access_token` query param
+// or the websocket subprotocol list (["bearer", token]) in this order.
+func bearerToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	if token := r.URL.Query().Get("access_token"); token != "" {
+		return token
+	}
+	protocols := strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",")
+	for i := 0; i+1 < len(protocols); i++ {
+		if strings.TrimSpace(protocols[i]) == bearerProtocol {
+			return strings.TrimSpace(protocols[i+1])
+		}
+	}
+	return ""
+}
+
+// NewAuthService loads the verification keys, a broken key config stops the server like other config errors.
+func NewAuthService(conf config.Auth) AuthService {
+	a := &authService{conf: conf}
+	if a.conf.UserClaim == "" {
+		a.conf.UserClaim = "sub"
+	}
+	if conf.HMACSecret != "" {
+		a.hmacKey = []byte(conf.HMACSecret)
+	}
+	if conf.PublicKeyFile != "" {
+		pem, err := os.ReadFile(conf.PublicKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if key, err := jwt.ParseRSAPublicKeyFromPEM(pem); err == nil {
+			a.publicKey = key
+		} else if key, err := jwt.ParseECPublicKeyFromPEM(pem); err == nil {
+			a.publicKey = key
+		} else {
+			log.Fatalf("auth.public-key-file %s is neither an RSA nor an ECDSA public key", conf.PublicKeyFile)
+		}
+	}
+	if conf.Enabled && a.hmacKey == nil && a.publicKey == nil {
+		log.Fatal("auth is enabled but neither auth.hmac-secret nor auth.public-key-file is set")
+	}
+	return a
+}
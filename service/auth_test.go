@@ -0,0 +1,159 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+	"go-rest-api/config"
+	"go-rest-api/dto"
+)
+
+const testSecret = "test-secret"
+
+func testToken(t *testing.T, secret string, claims jwt.MapClaims) string {
+	t.Helper()
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// joinContext is a join request of userID to roomID, the token is sent by setToken.
+func joinContext(roomID, userID string, setToken func(*http.Request)) *gin.Context {
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/ws/"+roomID+"/c/"+userID, nil)
+	ctx.Params = gin.Params{{Key: "roomId", Value: roomID}, {Key: "userId", Value: userID}}
+	if setToken != nil {
+		setToken(ctx.Request)
+	}
+	return ctx
+}
+
+func TestAuthorizeJoin(t *testing.T) {
+	auth := NewAuthService(config.Auth{
+		Enabled:    true,
+		HMACSecret: testSecret,
+		Issuer:     "gcs",
+		Audience:   "signal",
+		Rooms: map[string][]config.RoomGrant{
+			"uav1": {{Identity: "drone1", Role: dto.RoleDevice}, {Identity: "pilot", Role: dto.RoleOperator}},
+			"*":    {{Identity: "*", Role: dto.RoleViewer}},
+		},
+	})
+	valid := func(sub string) jwt.MapClaims {
+		return jwt.MapClaims{"sub": sub, "iss": "gcs", "aud": "signal", "exp": time.Now().Add(time.Hour).Unix()}
+	}
+	with := func(claims jwt.MapClaims, key string, value interface{}) jwt.MapClaims {
+		claims[key] = value
+		return claims
+	}
+	header := func(token string) func(*http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+	tests := []struct {
+		name     string
+		roomID   string
+		userID   string
+		setToken func(t *testing.T) func(*http.Request)
+		wantErr  error
+		wantUser string
+		wantRole string
+	}{
+		{"device from the access list", "uav1", "drone1", func(t *testing.T) func(*http.Request) {
+			return header(testToken(t, testSecret, valid("drone1")))
+		}, nil, "drone1", dto.RoleDevice},
+		{"user id taken from the token", "uav1", "", func(t *testing.T) func(*http.Request) {
+			return header(testToken(t, testSecret, valid("pilot")))
+		}, nil, "pilot", dto.RoleOperator},
+		{"wildcard room and identity", "other", "anyone", func(t *testing.T) func(*http.Request) {
+			return header(testToken(t, testSecret, valid("anyone")))
+		}, nil, "anyone", dto.RoleViewer},
+		{"token in the query", "uav1", "drone1", func(t *testing.T) func(*http.Request) {
+			token := testToken(t, testSecret, valid("drone1"))
+			return func(r *http.Request) { r.URL.RawQuery = "access_token=" + token }
+		}, nil, "drone1", dto.RoleDevice},
+		{"token in the websocket subprotocol", "uav1", "drone1", func(t *testing.T) func(*http.Request) {
+			token := testToken(t, testSecret, valid("drone1"))
+			return func(r *http.Request) { r.Header.Set("Sec-WebSocket-Protocol", "bearer, "+token) }
+		}, nil, "drone1", dto.RoleDevice},
+		{"no token", "uav1", "drone1", func(t *testing.T) func(*http.Request) {
+			return nil
+		}, ErrUnauthenticated, "", ""},
+		{"wrong secret", "uav1", "drone1", func(t *testing.T) func(*http.Request) {
+			return header(testToken(t, "other-secret", valid("drone1")))
+		}, ErrUnauthenticated, "", ""},
+		{"expired", "uav1", "drone1", func(t *testing.T) func(*http.Request) {
+			return header(testToken(t, testSecret, with(valid("drone1"), "exp", time.Now().Add(-time.Minute).Unix())))
+		}, ErrUnauthenticated, "", ""},
+		{"wrong issuer", "uav1", "drone1", func(t *testing.T) func(*http.Request) {
+			return header(testToken(t, testSecret, with(valid("drone1"), "iss", "someone")))
+		}, ErrUnauthenticated, "", ""},
+		{"wrong audience", "uav1", "drone1", func(t *testing.T) func(*http.Request) {
+			return header(testToken(t, testSecret, with(valid("drone1"), "aud", "other")))
+		}, ErrUnauthenticated, "", ""},
+		{"no user claim", "uav1", "drone1", func(t *testing.T) func(*http.Request) {
+			return header(testToken(t, testSecret, with(valid("drone1"), "sub", "")))
+		}, ErrUnauthenticated, "", ""},
+		{"token of another user", "uav1", "drone1", func(t *testing.T) func(*http.Request) {
+			return header(testToken(t, testSecret, valid("pilot")))
+		}, ErrForbidden, "", ""},
+		{"not in the access list", "uav1", "stranger", func(t *testing.T) func(*http.Request) {
+			return header(testToken(t, testSecret, valid("stranger")))
+		}, ErrForbidden, "", ""},
+		{"reserved sfu user", "other", dto.SfuPeer, func(t *testing.T) func(*http.Request) {
+			return header(testToken(t, testSecret, valid(dto.SfuPeer)))
+		}, ErrForbidden, "", ""},
+		{"reserved sfu user from the token", "other", "", func(t *testing.T) func(*http.Request) {
+			return header(testToken(t, testSecret, valid(dto.SfuPeer)))
+		}, ErrForbidden, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := auth.AuthorizeJoin(joinContext(tt.roomID, tt.userID, tt.setToken(t)), tt.roomID)
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("AuthorizeJoin() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (req.UserID != tt.wantUser || req.Role != tt.wantRole || req.RoomID != tt.roomID) {
+				t.Errorf("AuthorizeJoin() = %+v, want %s as %s in %s", req, tt.wantUser, tt.wantRole, tt.roomID)
+			}
+		})
+	}
+}
+
+func TestAuthorizeJoinWithoutAuth(t *testing.T) {
+	auth := NewAuthService(config.Auth{Rooms: map[string][]config.RoomGrant{
+		"uav1": {{Identity: "drone1", Role: dto.RoleDevice}},
+	}})
+	tests := []struct {
+		name     string
+		roomID   string
+		userID   string
+		query    string
+		wantErr  error
+		wantRole string
+	}{
+		{"open room defaults to viewer", "other", "u1", "", nil, dto.RoleViewer},
+		{"open room lets the client pick", "other", "u1", "role=operator", nil, dto.RoleOperator},
+		{"access list applies", "uav1", "drone1", "role=operator", nil, dto.RoleDevice},
+		{"not in the access list", "uav1", "u1", "", ErrForbidden, ""},
+		{"reserved sfu user", "other", dto.SfuPeer, "", ErrForbidden, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := joinContext(tt.roomID, tt.userID, func(r *http.Request) { r.URL.RawQuery = tt.query })
+			req, err := auth.AuthorizeJoin(ctx, tt.roomID)
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("AuthorizeJoin() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && req.Role != tt.wantRole {
+				t.Errorf("AuthorizeJoin() role = %s, want %s", req.Role, tt.wantRole)
+			}
+		})
+	}
+}
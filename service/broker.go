@@ -0,0 +1,142 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"go-rest-api/config"
+)
+
+// Broker carries room traffic between signaling instances serving the same rooms.
+// Every instance publishes what its local sockets do and applies what the others publish,
+// so a peer can reach the members connected to any node behind the load balancer.
+type Broker interface {
+	// NodeID identifies this instance, envelopes published by it are not delivered back to it
+	NodeID() string
+	Publish(envelope) error
+	// Subscribe registers the handler of envelopes published by the other instances
+	Subscribe(func(envelope))
+	Close() error
+}
+
+type envelopeKind string
+
+const (
+	envelopeDirect    envelopeKind = "direct"    // Data to user To in RoomID
+	envelopeBroadcast envelopeKind = "broadcast" // Data to every member of RoomID except From
+	envelopePresence  envelopeKind = "presence"  // user From joined/left/reconnected, Event "" only refreshes the view
+	envelopeSync      envelopeKind = "sync"      // a node (re)started and asks the others to announce their members
+	envelopeMembers   envelopeKind = "members"   // Data lists every member of the node, replacing what was known of it
+	envelopeHeartbeat envelopeKind = "heartbeat" // the node is alive, see hub.beat
+	envelopeNodeDown  envelopeKind = "node-down" // a node is going away, its members are gone with it
+	envelopeKick      envelopeKind = "kick"      // an operator removed user To from RoomID
+	envelopeCloseRoom envelopeKind = "close"     // an operator closed RoomID
+)
+
+// envelope is the unit exchanged through the broker
+type envelope struct {
+	Node   string          `json:"node"`
+	Kind   envelopeKind    `json:"kind"`
+	RoomID string          `json:"roomId,omitempty"`
+	From   string          `json:"from,omitempty"`
+	To     string          `json:"to,omitempty"`
+	Role   string          `json:"role,omitempty"`
+	Event  string          `json:"event,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"` // encoded dto.Message, forwarded as-is
+}
+
+// NewBroker builds the broker selected by `broker.type`, memory keeps everything in this process.
+func NewBroker(conf config.Broker) Broker {
+	node := conf.NodeID
+	if node == "" {
+		node = defaultNodeID()
+	}
+	switch conf.Type {
+	case "", "memory":
+		return newMemoryBroker(node)
+	case "postgres":
+		broker, err := newPostgresBroker(node, conf.Channel)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return broker
+	default:
+		log.Fatalf("unknown broker.type %q, use memory or postgres", conf.Type)
+		return nil
+	}
+}
+
+func defaultNodeID() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+// memoryBus connects the memory brokers of one process, with a single hub it has nobody to talk to
+// and signaling behaves exactly like a standalone server.
+var memoryBus = struct {
+	sync.RWMutex
+	brokers []*memoryBroker
+}{}
+
+type memoryBroker struct {
+	node     string
+	mutex    sync.RWMutex
+	handlers []func(envelope)
+}
+
+func newMemoryBroker(node string) *memoryBroker {
+	b := &memoryBroker{node: node}
+	memoryBus.Lock()
+	memoryBus.brokers = append(memoryBus.brokers, b)
+	memoryBus.Unlock()
+	return b
+}
+
+func (b *memoryBroker) NodeID() string { return b.node }
+
+func (b *memoryBroker) Publish(env envelope) error {
+	env.Node = b.node
+	memoryBus.RLock()
+	brokers := append([]*memoryBroker(nil), memoryBus.brokers...)
+	memoryBus.RUnlock()
+	for _, other := range brokers {
+		if other != b {
+			other.dispatch(env)
+		}
+	}
+	return nil
+}
+
+func (b *memoryBroker) Subscribe(handler func(envelope)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+func (b *memoryBroker) dispatch(env envelope) {
+	b.mutex.RLock()
+	handlers := append([](func(envelope))(nil), b.handlers...)
+	b.mutex.RUnlock()
+	for _, handler := range handlers {
+		handler(env)
+	}
+}
+
+func (b *memoryBroker) Close() error {
+	memoryBus.Lock()
+	defer memoryBus.Unlock()
+	for i, other := range memoryBus.brokers {
+		if other == b {
+			memoryBus.brokers = append(memoryBus.brokers[:i], memoryBus.brokers[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package service
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"go-rest-api/config"
+)
+
+const (
+	// NOTIFY payloads must stay below 8000 bytes, larger envelopes (SDP offers) are split in parts
+	notifyChunkSize = 5000
+	// partialTTL drops parts of an envelope whose remaining parts never arrived
+	partialTTL = 30 * time.Second
+)
+
+// notifyFrame is one NOTIFY payload, Part of Parts of the envelope ID published by Node.
+type notifyFrame struct {
+	Node  string `json:"n"`
+	ID    string `json:"id"`
+	Part  int    `json:"i"`
+	Parts int    `json:"c"`
+	Data  string `json:"d"` // base64 chunk of the encoded envelope
+}
+
+type partialEnvelope struct {
+	parts    []string
+	received int
+	started  time.Time
+}
+
+// postgresBroker fans envelopes out with LISTEN/NOTIFY on the database from config.ConnectDatabase.
+type postgresBroker struct {
+	node     string
+	channel  string
+	db       *sql.DB
+	listener *pq.Listener
+
+	mutex    sync.Mutex
+	handlers []func(envelope)
+	partials map[string]*partialEnvelope // node/id -> parts received so far
+	done     chan struct{}
+}
+
+func newPostgresBroker(node, channel string) (*postgresBroker, error) {
+	if config.DB == nil {
+		return nil, errors.New("postgres broker needs the database, call config.ConnectDatabase first")
+	}
+	if channel == "" {
+		channel = "signaling"
+	}
+	b := &postgresBroker{
+		node:     node,
+		channel:  channel,
+		db:       config.DB.DB(),
+		partials: make(map[string]*partialEnvelope),
+		done:     make(chan struct{}),
+	}
+	b.listener = pq.NewListener(config.DatabaseDSN(), time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("postgres broker listener:", err)
+		}
+	})
+	if err := b.listener.Listen(channel); err != nil {
+		return nil, errors.Wrap(err, "LISTEN "+channel)
+	}
+	go b.listen()
+	log.Printf("postgres broker %s listening on channel %s\n", node, channel)
+	return b, nil
+}
+
+func (b *postgresBroker) NodeID() string { return b.node }
+
+func (b *postgresBroker) Publish(env envelope) error {
+	env.Node = b.node
+	frames, err := b.frames(env)
+	if err != nil {
+		return err
+	}
+	for _, frame := range frames {
+		if _, err := b.db.Exec("SELECT pg_notify($1, $2)", b.channel, frame); err != nil {
+			return errors.Wrap(err, "NOTIFY "+b.channel)
+		}
+	}
+	return nil
+}
+
+// frames encodes env into NOTIFY payloads small enough for postgres.
+func (b *postgresBroker) frames(env envelope) ([]string, error) {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	id := newID()
+	parts := (len(data) + notifyChunkSize - 1) / notifyChunkSize
+	frames := make([]string, 0, parts)
+	for i := 0; i < parts; i++ {
+		end := (i + 1) * notifyChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		frame, err := json.Marshal(notifyFrame{
+			Node:  b.node,
+			ID:    id,
+			Part:  i,
+			Parts: parts,
+			Data:  base64.StdEncoding.EncodeToString(data[i*notifyChunkSize : end]),
+		})
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, string(frame))
+	}
+	return frames, nil
+}
+
+func (b *postgresBroker) Subscribe(handler func(envelope)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+// listen reads notifications until Close, a nil notification means the connection was re-established
+// and notifications may have been lost, so the node asks the others for their members again.
+func (b *postgresBroker) listen() {
+	for {
+		select {
+		case n, ok := <-b.listener.Notify:
+			if !ok {
+				return
+			}
+			if n == nil {
+				log.Println("postgres broker reconnected, resyncing room members")
+				if err := b.Publish(envelope{Kind: envelopeSync}); err != nil {
+					log.Println("postgres broker resync:", err)
+				}
+				continue
+			}
+			b.receive(n.Extra)
+		case <-time.After(90 * time.Second):
+			// detect a dead connection even when the channel is quiet
+			go func() { _ = b.listener.Ping() }()
+		case <-b.done:
+			return
+		}
+	}
+}
+
+func (b *postgresBroker) receive(payload string) {
+	var frame notifyFrame
+	if err := json.Unmarshal([]byte(payload), &frame); err != nil {
+		log.Println("postgres broker: invalid frame:", err)
+		return
+	}
+	if frame.Node == b.node || frame.Parts <= 0 || frame.Part < 0 || frame.Part >= frame.Parts {
+		return
+	}
+	data, complete := b.assemble(frame)
+	if !complete {
+		return
+	}
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		log.Println("postgres broker: invalid envelope:", err)
+		return
+	}
+	b.mutex.Lock()
+	handlers := append([](func(envelope))(nil), b.handlers...)
+	b.mutex.Unlock()
+	for _, handler := range handlers {
+		handler(env)
+	}
+}
+
+// assemble collects the parts of an envelope and returns it once every part arrived.
+func (b *postgresBroker) assemble(frame notifyFrame) ([]byte, bool) {
+	chunk, err := base64.StdEncoding.DecodeString(frame.Data)
+	if err != nil {
+		log.Println("postgres broker: invalid chunk:", err)
+		return nil, false
+	}
+	if frame.Parts == 1 {
+		return chunk, true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	for key, partial := range b.partials {
+		if now.Sub(partial.started) > partialTTL {
+			delete(b.partials, key)
+		}
+	}
+	key := frame.Node + "/" + frame.ID
+	partial, exists := b.partials[key]
+	if !exists {
+		partial = &partialEnvelope{parts: make([]string, frame.Parts), started: now}
+		b.partials[key] = partial
+	}
+	if len(partial.parts) != frame.Parts || partial.parts[frame.Part] != "" {
+		return nil, false
+	}
+	partial.parts[frame.Part] = string(chunk)
+	partial.received++
+	if partial.received < frame.Parts {
+		return nil, false
+	}
+	delete(b.partials, key)
+	var data []byte
+	for _, part := range partial.parts {
+		data = append(data, part...)
+	}
+	return data, true
+}
+
+func (b *postgresBroker) Close() error {
+	close(b.done)
+	return b.listener.Close()
+}
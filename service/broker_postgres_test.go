@@ -0,0 +1,93 @@
+package service
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func testPostgresBroker(node string) (*postgresBroker, *[]envelope) {
+	b := &postgresBroker{node: node, partials: make(map[string]*partialEnvelope)}
+	var received []envelope
+	b.Subscribe(func(env envelope) { received = append(received, env) })
+	return b, &received
+}
+
+func TestBrokerFrames(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		split bool
+	}{
+		{"small envelope", 10, false},
+		{"large offer", 3 * notifyChunkSize, true},
+		{"just over one chunk", notifyChunkSize, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender, _ := testPostgresBroker("a")
+			receiver, received := testPostgresBroker("b")
+			data, _ := json.Marshal(strings.Repeat("x", tt.size))
+			env := envelope{Node: "a", Kind: envelopeDirect, RoomID: "r", To: "u1", Data: data}
+
+			frames, err := sender.frames(env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (len(frames) > 1) != tt.split {
+				t.Fatalf("%d frames, split %v", len(frames), tt.split)
+			}
+			for _, frame := range frames {
+				if len(frame) >= 8000 {
+					t.Errorf("frame of %d bytes is over the NOTIFY limit", len(frame))
+				}
+			}
+			// parts may arrive in any order, a duplicate part is ignored
+			for i := len(frames) - 1; i >= 0; i-- {
+				receiver.receive(frames[i])
+				if i > 0 {
+					receiver.receive(frames[i])
+					if len(*received) != 0 {
+						t.Fatalf("envelope delivered before its %d remaining parts", i)
+					}
+				}
+			}
+			if len(*received) != 1 {
+				t.Fatalf("received %d envelopes, want 1", len(*received))
+			}
+			got := (*received)[0]
+			if got.Kind != env.Kind || got.To != env.To || string(got.Data) != string(env.Data) {
+				t.Errorf("received %s %s with %d bytes, want %s %s with %d bytes", got.Kind, got.To, len(got.Data), env.Kind, env.To, len(env.Data))
+			}
+			if len(receiver.partials) != 0 {
+				t.Errorf("%d partial envelopes left", len(receiver.partials))
+			}
+		})
+	}
+}
+
+func TestBrokerReceiveIgnoresInvalidFrames(t *testing.T) {
+	sender, _ := testPostgresBroker("a")
+	receiver, received := testPostgresBroker("b")
+	frames, err := sender.frames(envelope{Node: "a", Kind: envelopeSync})
+	if err != nil {
+		t.Fatal(err)
+	}
+	own, _ := testPostgresBroker("a")
+	own.receive(frames[0])
+	for _, payload := range []string{
+		"not json",
+		`{"n":"a","id":"x","i":2,"c":2,"d":""}`,
+		`{"n":"a","id":"x","i":0,"c":0,"d":""}`,
+		`{"n":"a","id":"x","i":0,"c":1,"d":"!"}`,
+	} {
+		receiver.receive(payload)
+	}
+	if len(*received) != 0 {
+		t.Fatalf("received %+v from invalid frames", *received)
+	}
+	receiver.receive(frames[0])
+	if len(*received) != 1 || (*received)[0].Kind != envelopeSync || (*received)[0].Node != "a" {
+		t.Errorf("received %+v, want the sync of node a", *received)
+	}
+}
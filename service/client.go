@@ -0,0 +1,163 @@
+package service
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go-rest-api/dto"
+)
+
+const (
+	// writeWait is the time allowed to write a message to the peer, a consumer slower than this is evicted
+	writeWait = 10 * time.Second
+	// defaults used when the `app:` websocket settings are not configured
+	defaultSendQueueSize  = 256
+	defaultPongWait       = 60 * time.Second
+	defaultMaxMessageSize = 64 << 10 // SDP offers with many candidates stay well below this
+)
+
+// client is a websocket connection joined to a room.
+// Every outbound message goes through the bounded send queue and is written by writePump only,
+// so gorilla's "one concurrent writer" rule holds without a shared lock.
+type client struct {
+	hub      *hub
+	conn     *websocket.Conn
+	roomID   string
+	userID   string
+	role     string
+	remoteIP string
+	session  *session // set by hub.join, guarded by hub.mutex
+
+	send       chan []byte // a nil entry asks writePump to send closeFrame and stop, see closeAfterFlush
+	done       chan struct{}
+	closeOnce  sync.Once
+	flushOnce  sync.Once
+	closeFrame []byte
+}
+
+func newClient(h *hub, conn *websocket.Conn, req dto.JoinRequest, remoteIP string) *client {
+	connectionsGauge.Inc()
+	return &client{
+		hub:      h,
+		conn:     conn,
+		roomID:   req.RoomID,
+		userID:   req.UserID,
+		role:     req.Role,
+		remoteIP: remoteIP,
+		send:     make(chan []byte, h.sendQueueSize),
+		done:     make(chan struct{}),
+	}
+}
+
+// prepareRead applies the read limit and the idle deadline, every pong or inbound message extends it.
+// A half-open socket (e.g. UAV lost LTE) then fails ReadMessage after pongWait and runs the normal leave path.
+func (c *client) prepareRead() {
+	c.conn.SetReadLimit(c.hub.maxMessageSize)
+	c.extendReadDeadline()
+	c.conn.SetPongHandler(func(string) error {
+		c.extendReadDeadline()
+		return nil
+	})
+}
+
+func (c *client) extendReadDeadline() {
+	_ = c.conn.SetReadDeadline(time.Now().Add(c.hub.pongWait))
+}
+
+// writePump drains the send queue to the socket and pings the peer until the client is closed.
+func (c *client) writePump() {
+	ticker := time.NewTicker(c.hub.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case data := <-c.send:
+			if data == nil {
+				_ = c.conn.WriteControl(websocket.CloseMessage, c.closeFrame, time.Now().Add(writeWait))
+				c.close()
+				return
+			}
+			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			start := time.Now()
+			err := c.conn.WriteMessage(websocket.TextMessage, data)
+			wsWriteDuration.Observe(time.Since(start).Seconds())
+			if err != nil {
+				log.Printf("[%s] Failed to send message to %s: %v\n", c.roomID, c.userID, err)
+				c.close()
+				return
+			}
+		case <-ticker.C:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				log.Printf("[%s] Failed to ping %s: %v\n", c.roomID, c.userID, err)
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// enqueue schedules data for writing without blocking the caller.
+// A full queue means the consumer can't keep up: it gets evicted instead of stalling the room.
+func (c *client) enqueue(data []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.send <- data:
+		return true
+	default:
+		log.Printf("[%s] %s send queue is full (%d), evicting slow consumer\n", c.roomID, c.userID, cap(c.send))
+		c.close()
+		return false
+	}
+}
+
+// respond sends a server response to this client.
+func (c *client) respond(resp dto.WsResponse) {
+	resp.Time = time.Now().Unix()
+	data, err := json.Marshal(resp)
+	if err != nil {
+		log.Println("Failed to encode response:", err)
+		return
+	}
+	c.enqueue(data)
+}
+
+// closeWith sends a close frame with code and reason before closing, so the peer knows why it was dropped.
+func (c *client) closeWith(code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	if err := c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait)); err != nil {
+		log.Printf("[%s] Failed to send close frame to %s: %v\n", c.roomID, c.userID, err)
+	}
+	c.close()
+}
+
+// closeAfterFlush lets writePump deliver what is already queued (e.g. a final WsResponse) before the close frame.
+func (c *client) closeAfterFlush(code int, reason string) {
+	c.flushOnce.Do(func() {
+		c.closeFrame = websocket.FormatCloseMessage(code, reason)
+		select {
+		case c.send <- nil:
+		default:
+			c.closeWith(code, reason)
+		}
+	})
+}
+
+// close stops the writer and closes the socket, the blocked reader in JoinRoom returns and runs the leave path.
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		connectionsGauge.Dec()
+		if err := c.conn.Close(); err != nil {
+			log.Println("Failed to close WebSocket connection:", err)
+		}
+	})
+}
@@ -0,0 +1,174 @@
+package service
+
+import (
+	"os"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/formats/fmp4"
+	"github.com/bluenviron/mediacommon/pkg/formats/fmp4/seekablebuffer"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+// h264ClockRate is the RTP clock of H.264, also the MP4 timescale of the video tracks
+const h264ClockRate = 90000
+
+// h264Depacketizer rebuilds the access units of an H.264 RTP stream (RFC 6184).
+type h264Depacketizer struct {
+	packet    codecs.H264Packet
+	au        [][]byte
+	timestamp uint32
+}
+
+// push adds a packet and returns the access unit it completes with its RTP timestamp, nil until then.
+// A unit ends with the marker bit, or when a packet of the next one arrives after a lost marker.
+func (d *h264Depacketizer) push(packet *rtp.Packet) ([][]byte, uint32) {
+	var done [][]byte
+	doneTS := d.timestamp
+	if len(d.au) > 0 && packet.Timestamp != d.timestamp {
+		done, d.au = d.au, nil
+	}
+	d.timestamp = packet.Timestamp
+	annexB, err := d.packet.Unmarshal(packet.Payload)
+	if err == nil && len(annexB) > 0 {
+		if nalus, err := h264.AnnexBUnmarshal(annexB); err == nil {
+			d.au = append(d.au, nalus...)
+		}
+	}
+	if packet.Marker && len(d.au) > 0 {
+		if done != nil {
+			return done, doneTS // the next unit is complete too, it is flushed with the following packet
+		}
+		done, d.au = d.au, nil
+		return done, packet.Timestamp
+	}
+	return done, doneTS
+}
+
+// h264Params keeps the last SPS and PPS seen in the stream, the MP4 init segment needs them.
+type h264Params struct {
+	sps, pps []byte
+}
+
+// update takes the parameter sets of au.
+func (p *h264Params) update(au [][]byte) {
+	for _, nalu := range au {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch h264.NALUType(nalu[0] & 0x1f) {
+		case h264.NALUTypeSPS:
+			p.sps = append([]byte(nil), nalu...)
+		case h264.NALUTypePPS:
+			p.pps = append([]byte(nil), nalu...)
+		}
+	}
+}
+
+// mp4Recorder writes an H.264 track as fragmented MP4, one fragment per GOP. It starts at the first
+// IDR frame following the parameter sets and implements media.Writer like the pion writers.
+type mp4Recorder struct {
+	file         *os.File
+	depacketizer h264Depacketizer
+	params       h264Params
+	started      bool
+	sequence     uint32
+	dts          uint64 // of the next fragment, in h264ClockRate since the start
+	samples      []*fmp4.PartSample
+	pending      *fmp4.PartSample // its duration is known with the next access unit
+	pendingTS    uint32
+}
+
+func newMP4Recorder(path string) (*mp4Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &mp4Recorder{file: file}, nil
+}
+
+func (m *mp4Recorder) WriteRTP(packet *rtp.Packet) error {
+	au, timestamp := m.depacketizer.push(packet)
+	if au == nil {
+		return nil
+	}
+	m.params.update(au)
+	idr := h264.IDRPresent(au)
+	if !m.started {
+		if !idr || m.params.sps == nil || m.params.pps == nil {
+			return nil
+		}
+		init := fmp4.Init{Tracks: []*fmp4.InitTrack{{
+			ID:        1,
+			TimeScale: h264ClockRate,
+			Codec:     &fmp4.CodecH264{SPS: m.params.sps, PPS: m.params.pps},
+		}}}
+		var buf seekablebuffer.Buffer
+		if err := init.Marshal(&buf); err != nil {
+			return err
+		}
+		if _, err := m.file.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		m.started = true
+	}
+	sample, err := fmp4.NewPartSampleH26x(0, idr, au)
+	if err != nil {
+		return err
+	}
+	if m.pending != nil {
+		m.pending.Duration = timestamp - m.pendingTS
+		m.samples = append(m.samples, m.pending)
+	}
+	if idr {
+		if err := m.flush(); err != nil {
+			return err
+		}
+	}
+	m.pending, m.pendingTS = sample, timestamp
+	return nil
+}
+
+// flush writes the buffered samples as one fragment.
+func (m *mp4Recorder) flush() error {
+	if len(m.samples) == 0 {
+		return nil
+	}
+	m.sequence++
+	part := fmp4.Part{SequenceNumber: m.sequence, Tracks: []*fmp4.PartTrack{{
+		ID:       1,
+		BaseTime: m.dts,
+		Samples:  m.samples,
+	}}}
+	for _, sample := range m.samples {
+		m.dts += uint64(sample.Duration)
+	}
+	m.samples = nil
+	var buf seekablebuffer.Buffer
+	if err := part.Marshal(&buf); err != nil {
+		return err
+	}
+	_, err := m.file.Write(buf.Bytes())
+	return err
+}
+
+// Close writes the last fragment, the last frame lasts as long as the one before it.
+func (m *mp4Recorder) Close() error {
+	if m.file == nil {
+		return nil
+	}
+	if m.pending != nil {
+		m.pending.Duration = h264ClockRate / 30
+		if n := len(m.samples); n > 0 {
+			m.pending.Duration = m.samples[n-1].Duration
+		}
+		m.samples = append(m.samples, m.pending)
+		m.pending = nil
+	}
+	err := m.flush()
+	if closeErr := m.file.Close(); err == nil {
+		err = closeErr
+	}
+	m.file = nil
+	return err
+}
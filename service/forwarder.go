@@ -0,0 +1,398 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pkg/errors"
+	"go-rest-api/config"
+	"go-rest-api/dto"
+)
+
+var (
+	ErrForwardNotFound  = errors.New("forward not found")
+	ErrInvalidForward   = errors.New("a forward needs host:port targets, a kind video or audio and a dynamic payload type (96-127)")
+	ErrTargetNotAllowed = errors.New("forward target is outside forwarding.allowed-networks")
+	ErrNoTrackOfKind    = errors.New("publisher has no track of this kind")
+)
+
+const (
+	// forwardQueueSize is how many packets of a forward wait for the network before new ones are dropped
+	forwardQueueSize = 1024
+	// forwardRetention is how long a stopped forward stays listed
+	forwardRetention = time.Hour
+)
+
+// forwarder re-sends published tracks as plain RTP over UDP through sinks on the SFU fan-out.
+type forwarder struct {
+	router  *sfuRouter
+	conf    config.Forwarding
+	allowed []*net.IPNet
+
+	mutex    sync.Mutex
+	forwards map[string]*forward // forward ID ->
+}
+
+// forward sends one track to its targets from its own goroutine until it is stopped or unpublished.
+type forward struct {
+	forwarder   *forwarder
+	id          string
+	roomID      string
+	track       *sfuTrack
+	ssrc        uint32
+	payloadType uint8
+	startedAt   time.Time
+	targets     []*forwardTarget
+	packets     chan []byte
+	dropped     atomic.Uint64
+	closing     sync.Once
+	done        chan struct{}
+
+	// guarded by forwarder.mutex
+	dt        *downTrack
+	stoppedAt time.Time
+}
+
+type forwardTarget struct {
+	address string
+	conn    *net.UDPConn
+	sdp     string
+	sdpPath string
+	packets atomic.Uint64
+	errors  atomic.Uint64
+}
+
+func newForwarder(router *sfuRouter, conf config.Forwarding) *forwarder {
+	return &forwarder{
+		router:   router,
+		conf:     conf,
+		allowed:  parseNetworks(conf.AllowedNetworks, "forwarding allowed"),
+		forwards: make(map[string]*forward),
+	}
+}
+
+// start forwards a track of req.Publisher in roomID, of the first publisher with a track of the kind when empty.
+func (fw *forwarder) start(roomID string, req dto.StartForwardRequest) (*forward, error) {
+	kind := webrtc.RTPCodecTypeVideo
+	switch req.Kind {
+	case "", "video":
+	case "audio":
+		kind = webrtc.RTPCodecTypeAudio
+	default:
+		return nil, ErrInvalidForward
+	}
+	payloadType := req.PayloadType
+	if payloadType == 0 {
+		payloadType = 96
+		if kind == webrtc.RTPCodecTypeAudio {
+			payloadType = 111
+		}
+	}
+	if payloadType < 96 || payloadType > 127 || len(req.Targets) == 0 {
+		return nil, ErrInvalidForward
+	}
+	addrs := make([]*net.UDPAddr, 0, len(req.Targets))
+	for _, target := range req.Targets {
+		addr, err := net.ResolveUDPAddr("udp", target)
+		if err != nil || addr.Port == 0 || addr.IP == nil {
+			return nil, errors.Wrap(ErrInvalidForward, target)
+		}
+		if !inNetworks(addr.IP, fw.allowed) {
+			return nil, errors.Wrap(ErrTargetNotAllowed, target)
+		}
+		addrs = append(addrs, addr)
+	}
+
+	var track *sfuTrack
+	tracks := fw.router.tracksOf(roomID, req.Publisher)
+	sort.Slice(tracks, func(i, j int) bool {
+		a, b := tracks[i], tracks[j]
+		return a.owner.userID < b.owner.userID || (a.owner.userID == b.owner.userID && a.id < b.id)
+	})
+	for _, t := range tracks {
+		if t.kind == kind {
+			track = t
+			break
+		}
+	}
+	if track == nil {
+		return nil, ErrNoTrackOfKind
+	}
+
+	ssrc := req.SSRC
+	for ssrc == 0 {
+		ssrc = rand.Uint32()
+	}
+	f := &forward{
+		forwarder:   fw,
+		id:          newID()[:16],
+		roomID:      roomID,
+		track:       track,
+		ssrc:        ssrc,
+		payloadType: payloadType,
+		startedAt:   time.Now(),
+		packets:     make(chan []byte, forwardQueueSize),
+		done:        make(chan struct{}),
+	}
+	for _, addr := range addrs {
+		conn, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			f.closeTargets()
+			return nil, err
+		}
+		target := &forwardTarget{address: addr.String(), conn: conn, sdp: f.sdp(addr)}
+		target.sdpPath = fw.writeSdp(f, target)
+		f.targets = append(f.targets, target)
+	}
+	go f.send()
+
+	fw.mutex.Lock()
+	fw.prune()
+	fw.forwards[f.id] = f
+	fw.mutex.Unlock()
+	dt, live := fw.router.addSink(track, f)
+	if !live {
+		fw.mutex.Lock()
+		delete(fw.forwards, f.id)
+		fw.mutex.Unlock()
+		_ = f.Close()
+		return nil, ErrPublisherNotStreaming
+	}
+	fw.mutex.Lock()
+	f.dt = dt
+	stopped := !f.stoppedAt.IsZero()
+	fw.mutex.Unlock()
+	if stopped {
+		fw.router.removeSink(dt) // stopped meanwhile
+		return f, nil
+	}
+	if kind == webrtc.RTPCodecTypeVideo && fw.conf.KeyframeInterval > 0 {
+		go f.refresh(dt, fw.conf.KeyframeInterval)
+	}
+	log.Printf("[%s] forwarding %s of %s to %s, forward %s\n", roomID, track.id, track.owner.userID, strings.Join(req.Targets, ", "), f.id)
+	return f, nil
+}
+
+// writeSdp writes the SDP of target to sdp-dir and returns its path, "" when disabled or failed.
+func (fw *forwarder) writeSdp(f *forward, target *forwardTarget) string {
+	if fw.conf.SdpDir == "" {
+		return ""
+	}
+	dir := filepath.Join(fw.conf.SdpDir, safeName(f.roomID))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Println("Failed to create SDP directory:", err)
+		return ""
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s-%s-%s.sdp", safeName(f.track.owner.userID), f.track.kind, f.id[:8], safeName(target.address)))
+	if err := os.WriteFile(path, []byte(target.sdp), 0o644); err != nil {
+		log.Println("Failed to write SDP:", err)
+		return ""
+	}
+	return path
+}
+
+// stop ends the forward id of roomID.
+func (fw *forwarder) stop(roomID, id string) (*forward, error) {
+	fw.mutex.Lock()
+	f, exists := fw.forwards[id]
+	if !exists || f.roomID != roomID {
+		fw.mutex.Unlock()
+		return nil, ErrForwardNotFound
+	}
+	dt := f.dt
+	fw.mutex.Unlock()
+	if dt != nil {
+		fw.router.removeSink(dt)
+	}
+	_ = f.Close()
+	log.Printf("[%s] forward %s stopped\n", roomID, id)
+	return f, nil
+}
+
+// stopAll stops the active forwards, e.g. on shutdown.
+func (fw *forwarder) stopAll() {
+	fw.mutex.Lock()
+	var active []*forward
+	for _, f := range fw.forwards {
+		if f.stoppedAt.IsZero() {
+			active = append(active, f)
+		}
+	}
+	fw.mutex.Unlock()
+	for _, f := range active {
+		_, _ = fw.stop(f.roomID, f.id)
+	}
+}
+
+// list returns the forwards of roomID, active or stopped within forwardRetention, the oldest first.
+func (fw *forwarder) list(roomID string) []dto.Forward {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	fw.prune()
+	forwards := make([]dto.Forward, 0)
+	for _, f := range fw.forwards {
+		if f.roomID == roomID {
+			forwards = append(forwards, f.summary())
+		}
+	}
+	sort.Slice(forwards, func(i, j int) bool { return forwards[i].StartedAt.Before(forwards[j].StartedAt) })
+	return forwards
+}
+
+// prune forgets the forwards stopped more than forwardRetention ago. Caller holds forwarder.mutex.
+func (fw *forwarder) prune() {
+	for id, f := range fw.forwards {
+		if !f.stoppedAt.IsZero() && time.Since(f.stoppedAt) > forwardRetention {
+			delete(fw.forwards, id)
+		}
+	}
+}
+
+// get returns the forward id of roomID.
+func (fw *forwarder) get(roomID, id string) (dto.Forward, error) {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	f, exists := fw.forwards[id]
+	if !exists || f.roomID != roomID {
+		return dto.Forward{}, ErrForwardNotFound
+	}
+	return f.summary(), nil
+}
+
+// summary describes f. Caller holds forwarder.mutex.
+func (f *forward) summary() dto.Forward {
+	s := dto.Forward{
+		ID:          f.id,
+		RoomID:      f.roomID,
+		Publisher:   f.track.owner.userID,
+		TrackID:     f.track.id,
+		Kind:        f.track.kind.String(),
+		MimeType:    f.track.codec.MimeType,
+		SSRC:        f.ssrc,
+		PayloadType: f.payloadType,
+		Dropped:     f.dropped.Load(),
+		Active:      f.stoppedAt.IsZero(),
+		StartedAt:   f.startedAt,
+		Targets:     make([]dto.ForwardTarget, 0, len(f.targets)),
+	}
+	if !s.Active {
+		stoppedAt := f.stoppedAt
+		s.StoppedAt = &stoppedAt
+	}
+	for _, target := range f.targets {
+		s.Targets = append(s.Targets, dto.ForwardTarget{
+			Address: target.address,
+			Sdp:     target.sdp,
+			SdpPath: target.sdpPath,
+			Packets: target.packets.Load(),
+			Errors:  target.errors.Load(),
+		})
+	}
+	return s
+}
+
+// sdp describes the stream received at addr, e.g. for `ffplay -protocol_whitelist file,udp,rtp`.
+func (f *forward) sdp(addr *net.UDPAddr) string {
+	network := "IP4"
+	if addr.IP.To4() == nil {
+		network = "IP6"
+	}
+	codec := f.track.codec
+	encoding := codec.MimeType[strings.IndexByte(codec.MimeType, '/')+1:]
+	rtpmap := fmt.Sprintf("%s/%d", encoding, codec.ClockRate)
+	if codec.Channels > 1 {
+		rtpmap += fmt.Sprintf("/%d", codec.Channels)
+	}
+	lines := []string{
+		"v=0",
+		fmt.Sprintf("o=- %d 1 IN %s %s", f.ssrc, network, addr.IP),
+		fmt.Sprintf("s=%s %s of %s", f.track.owner.userID, f.track.kind, f.roomID),
+		fmt.Sprintf("c=IN %s %s", network, addr.IP),
+		"t=0 0",
+		fmt.Sprintf("m=%s %d RTP/AVP %d", f.track.kind, addr.Port, f.payloadType),
+		fmt.Sprintf("a=rtpmap:%d %s", f.payloadType, rtpmap),
+	}
+	if codec.SDPFmtpLine != "" {
+		lines = append(lines, fmt.Sprintf("a=fmtp:%d %s", f.payloadType, codec.SDPFmtpLine))
+	}
+	lines = append(lines, fmt.Sprintf("a=ssrc:%d cname:%s", f.ssrc, f.track.owner.userID), "a=recvonly")
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// refresh asks the publisher for a keyframe every interval, the targets have no RTCP to ask for one.
+func (f *forward) refresh(dt *downTrack, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			dt.requestKeyframe()
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// WriteRTP queues a packet for the targets, it is dropped when they are behind.
+func (f *forward) WriteRTP(packet *rtp.Packet) error {
+	out := *packet
+	out.SSRC = f.ssrc
+	out.PayloadType = f.payloadType
+	buf, err := out.Marshal()
+	if err != nil {
+		return err
+	}
+	select {
+	case f.packets <- buf:
+	default:
+		f.dropped.Add(1)
+	}
+	return nil
+}
+
+// send writes the queued packets to every target until f is closed.
+func (f *forward) send() {
+	for buf := range f.packets {
+		for _, target := range f.targets {
+			// a target that is not listening yet answers with ICMP, it is counted and retried with the next packet
+			if _, err := target.conn.Write(buf); err != nil {
+				target.errors.Add(1)
+				continue
+			}
+			target.packets.Add(1)
+		}
+	}
+	f.closeTargets()
+	close(f.done)
+}
+
+// Close stops the forward, it returns once the queued packets are sent.
+func (f *forward) Close() error {
+	f.closing.Do(func() {
+		f.forwarder.mutex.Lock()
+		if f.stoppedAt.IsZero() {
+			f.stoppedAt = time.Now()
+		}
+		f.forwarder.mutex.Unlock()
+		close(f.packets)
+	})
+	<-f.done
+	return nil
+}
+
+func (f *forward) closeTargets() {
+	for _, target := range f.targets {
+		_ = target.conn.Close()
+	}
+}
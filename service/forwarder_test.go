@@ -0,0 +1,142 @@
+package service
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pkg/errors"
+	"go-rest-api/config"
+	"go-rest-api/dto"
+)
+
+func testForward(kind webrtc.RTPCodecType, codec webrtc.RTPCodecCapability) *forward {
+	return &forward{
+		forwarder:   newForwarder(newSfuRouter(nil, nil), config.Forwarding{}),
+		id:          "0123456789abcdef",
+		roomID:      "r",
+		track:       &sfuTrack{id: "t1", owner: &sfuPeer{roomID: "r", userID: "uav1"}, kind: kind, codec: codec},
+		ssrc:        1234,
+		payloadType: 100,
+		packets:     make(chan []byte, forwardQueueSize),
+		done:        make(chan struct{}),
+	}
+}
+
+func TestForwardRewritesSsrcAndPayloadType(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet rtp.Packet
+	}{
+		{"marker set", rtp.Packet{Header: rtp.Header{Version: 2, Marker: true, PayloadType: 102, SequenceNumber: 7, Timestamp: 90000, SSRC: 42}, Payload: []byte{1, 2, 3}}},
+		{"last sequence number", rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 111, SequenceNumber: 65535, Timestamp: 960, SSRC: 43}, Payload: []byte{4}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := testForward(webrtc.RTPCodecTypeVideo, webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000})
+			in := tt.packet
+			if err := f.WriteRTP(&in); err != nil {
+				t.Fatal(err)
+			}
+			var out rtp.Packet
+			if err := out.Unmarshal(<-f.packets); err != nil {
+				t.Fatal(err)
+			}
+			if out.SSRC != f.ssrc || out.PayloadType != f.payloadType {
+				t.Errorf("forwarded SSRC %d and payload type %d, want %d and %d", out.SSRC, out.PayloadType, f.ssrc, f.payloadType)
+			}
+			if out.SequenceNumber != in.SequenceNumber || out.Timestamp != in.Timestamp || out.Marker != in.Marker || string(out.Payload) != string(in.Payload) {
+				t.Errorf("forwarded %+v, want the rest of %+v unchanged", out, in)
+			}
+			if in.SSRC != tt.packet.SSRC || in.PayloadType != tt.packet.PayloadType {
+				t.Errorf("the packet of the other subscribers was rewritten: %+v", in.Header)
+			}
+		})
+	}
+}
+
+func TestForwardDropsWhenTheQueueIsFull(t *testing.T) {
+	f := testForward(webrtc.RTPCodecTypeVideo, webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000})
+	for i := 0; i < forwardQueueSize+3; i++ {
+		_ = f.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: uint16(i)}})
+	}
+	if got := f.dropped.Load(); got != 3 {
+		t.Errorf("dropped %d packets, want 3", got)
+	}
+}
+
+func TestForwardSdp(t *testing.T) {
+	tests := []struct {
+		name  string
+		kind  webrtc.RTPCodecType
+		codec webrtc.RTPCodecCapability
+		addr  string
+		want  []string
+		not   []string
+	}{
+		{"H.264 over IPv4", webrtc.RTPCodecTypeVideo,
+			webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "packetization-mode=1;profile-level-id=42e01f"},
+			"192.0.2.10:5004",
+			[]string{"o=- 1234 1 IN IP4 192.0.2.10", "c=IN IP4 192.0.2.10", "m=video 5004 RTP/AVP 100", "a=rtpmap:100 H264/90000\r\n",
+				"a=fmtp:100 packetization-mode=1;profile-level-id=42e01f", "a=ssrc:1234 cname:uav1", "a=recvonly"},
+			nil},
+		{"stereo Opus over IPv6", webrtc.RTPCodecTypeAudio,
+			webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+			"[2001:db8::1]:5006",
+			[]string{"c=IN IP6 2001:db8::1", "m=audio 5006 RTP/AVP 100", "a=rtpmap:100 opus/48000/2\r\n"},
+			[]string{"a=fmtp"}},
+		{"mono codec without channels", webrtc.RTPCodecTypeAudio,
+			webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000, Channels: 1},
+			"192.0.2.10:5008",
+			[]string{"a=rtpmap:100 PCMU/8000\r\n"},
+			nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := net.ResolveUDPAddr("udp", tt.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sdp := testForward(tt.kind, tt.codec).sdp(addr)
+			if !strings.HasPrefix(sdp, "v=0\r\n") || !strings.HasSuffix(sdp, "\r\n") {
+				t.Errorf("sdp is not CRLF separated:\n%s", sdp)
+			}
+			for _, line := range tt.want {
+				if !strings.Contains(sdp, line) {
+					t.Errorf("sdp misses %q:\n%s", line, sdp)
+				}
+			}
+			for _, line := range tt.not {
+				if strings.Contains(sdp, line) {
+					t.Errorf("sdp has %q:\n%s", line, sdp)
+				}
+			}
+		})
+	}
+}
+
+func TestForwarderStartRejectsInvalidRequests(t *testing.T) {
+	fw := newForwarder(newSfuRouter(nil, nil), config.Forwarding{AllowedNetworks: []string{"192.0.2.0/24"}})
+	tests := []struct {
+		name    string
+		req     dto.StartForwardRequest
+		wantErr error
+	}{
+		{"no targets", dto.StartForwardRequest{}, ErrInvalidForward},
+		{"unknown kind", dto.StartForwardRequest{Kind: "data", Targets: []string{"192.0.2.10:5004"}}, ErrInvalidForward},
+		{"static payload type", dto.StartForwardRequest{PayloadType: 8, Targets: []string{"192.0.2.10:5004"}}, ErrInvalidForward},
+		{"no port", dto.StartForwardRequest{Targets: []string{"192.0.2.10:0"}}, ErrInvalidForward},
+		{"outside the allowed networks", dto.StartForwardRequest{Targets: []string{"198.51.100.10:5004"}}, ErrTargetNotAllowed},
+		{"one target outside the allowed networks", dto.StartForwardRequest{Targets: []string{"192.0.2.10:5004", "127.0.0.1:5004"}}, ErrTargetNotAllowed},
+		{"no track of the kind", dto.StartForwardRequest{Kind: "audio", Targets: []string{"192.0.2.10:5004"}}, ErrNoTrackOfKind},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := fw.start("r", tt.req); !errors.Is(err, tt.wantErr) {
+				t.Errorf("start() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"go-rest-api/dto"
+)
+
+// StartForward sends a track of a publisher of roomID to UDP targets as plain RTP.
+// It fails with ErrPublisherNotFound or ErrPublisherNotStreaming when there is no track yet.
+func (v *videoCallService) StartForward(roomID string, req dto.StartForwardRequest) (dto.Forward, error) {
+	if err := v.publisherStreaming(roomID, req.Publisher); err != nil {
+		return dto.Forward{}, err
+	}
+	f, err := v.forwarder.start(roomID, req)
+	if err != nil {
+		return dto.Forward{}, err
+	}
+	return v.forwarder.get(roomID, f.id)
+}
+
+// StopForward stops a forward of roomID.
+func (v *videoCallService) StopForward(roomID, forwardID string) (dto.Forward, error) {
+	f, err := v.forwarder.stop(roomID, forwardID)
+	if err != nil {
+		return dto.Forward{}, err
+	}
+	return v.forwarder.get(roomID, f.id)
+}
+
+// ListForwards returns the active forwards of roomID and the ones stopped within forwardRetention.
+func (v *videoCallService) ListForwards(roomID string) []dto.Forward {
+	return v.forwarder.list(roomID)
+}
+
+// GetForward returns a forward of roomID with the SDP of its targets.
+func (v *videoCallService) GetForward(roomID, forwardID string) (dto.Forward, error) {
+	return v.forwarder.get(roomID, forwardID)
+}
@@ -0,0 +1,19 @@
+package service
+
+import (
+	"context"
+	"net/url"
+)
+
+// HlsFile returns a file of the HLS stream of publisherID in roomID, or of the first H.264 publisher
+// of the room when empty, with its content type. Requesting the playlist starts the stream.
+func (v *videoCallService) HlsFile(ctx context.Context, roomID, publisherID, name string, query url.Values) (string, []byte, error) {
+	if err := v.publisherStreaming(roomID, publisherID); err != nil {
+		return "", nil, err
+	}
+	stream, err := v.hls.stream(roomID, publisherID, name == "index.m3u8")
+	if err != nil {
+		return "", nil, err
+	}
+	return stream.file(ctx, name, query)
+}
@@ -0,0 +1,672 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/formats/fmp4"
+	"github.com/bluenviron/mediacommon/pkg/formats/fmp4/seekablebuffer"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pkg/errors"
+	"go-rest-api/config"
+)
+
+const (
+	// hlsStartTimeout is how long the first playlist request waits for the first segment
+	hlsStartTimeout = 10 * time.Second
+	// hlsKeptSegments are kept past the playlist for players still downloading them
+	hlsKeptSegments = 2
+	// hlsPartSegments is how many of the last segments list their partial segments
+	hlsPartSegments = 3
+)
+
+// the fMP4 track IDs
+const (
+	hlsVideoTrack = 1
+	hlsAudioTrack = 2
+)
+
+var (
+	ErrHlsUnsupported  = errors.New("HLS needs an H.264 video track")
+	ErrHlsFileNotFound = errors.New("HLS file not found")
+	ErrHlsNotReady     = errors.New("HLS stream is not ready yet, retry later")
+	ErrHlsBadRequest   = errors.New("invalid HLS blocking request")
+)
+
+// hlsPackager serves the HLS stream of each publisher, shared by all its players.
+type hlsPackager struct {
+	router *sfuRouter
+	conf   config.Hls
+
+	mutex   sync.Mutex
+	streams map[string]*hlsStream // roomID/publisherID ->
+}
+
+// hlsStream cuts the H.264 and Opus tracks of a publisher into fMP4 segments and parts.
+type hlsStream struct {
+	packager  *hlsPackager
+	key       string
+	roomID    string
+	publisher string
+	video     *sfuTrack
+	audio     *sfuTrack // nil without Opus
+
+	mutex      sync.Mutex
+	sinks      []*downTrack
+	ended      bool
+	lastAccess time.Time
+	changed    chan struct{} // closed and replaced on every new part
+
+	depacketizer  h264Depacketizer
+	params        h264Params
+	init          []byte
+	started       time.Time // wall clock of the start of the first segment
+	sequence      uint32
+	keyframeAsked bool
+
+	videoDTS     uint64 // of the next part, in h264ClockRate
+	videoSamples []*fmp4.PartSample
+	pending      *fmp4.PartSample // its duration is known with the next access unit
+	pendingTS    uint32
+	partDuration uint64
+	segDuration  uint64
+
+	audioStarted bool
+	audioDTS     uint64 // of the next part, in the clock of the audio
+	audioSamples []*fmp4.PartSample
+	audioPending *fmp4.PartSample
+	audioTS      uint32 // RTP timestamp of audioPending
+
+	segments []*hlsSegment // the last one is being written
+}
+
+// hlsSegment starts with a keyframe. Its parts are complete fragments, the segment is their concatenation.
+type hlsSegment struct {
+	id       uint64
+	start    time.Time
+	parts    []*hlsPart
+	duration time.Duration
+	complete bool
+	data     []byte // once complete
+}
+
+type hlsPart struct {
+	data        []byte
+	duration    time.Duration
+	independent bool // starts with a keyframe
+}
+
+// hlsSink feeds one track of a stream, it implements media.Writer for the router.
+type hlsSink struct {
+	stream *hlsStream
+	video  bool
+}
+
+func newHlsPackager(router *sfuRouter, conf config.Hls) *hlsPackager {
+	return &hlsPackager{router: router, conf: conf, streams: make(map[string]*hlsStream)}
+}
+
+// stream returns the stream of publisherID in roomID, of the first H.264 publisher when empty, started when start is set.
+func (p *hlsPackager) stream(roomID, publisherID string, start bool) (*hlsStream, error) {
+	var video, audio *sfuTrack
+	tracks := p.router.tracksOf(roomID, publisherID)
+	sort.Slice(tracks, func(i, j int) bool {
+		a, b := tracks[i], tracks[j]
+		return a.owner.userID < b.owner.userID || (a.owner.userID == b.owner.userID && a.id < b.id)
+	})
+	for _, track := range tracks {
+		if strings.EqualFold(track.codec.MimeType, webrtc.MimeTypeH264) {
+			video = track
+			break
+		}
+	}
+	if video == nil {
+		return nil, ErrHlsUnsupported
+	}
+	for _, track := range tracks {
+		if track.owner == video.owner && strings.EqualFold(track.codec.MimeType, webrtc.MimeTypeOpus) {
+			audio = track
+			break
+		}
+	}
+
+	key := roomID + "/" + video.owner.userID
+	p.mutex.Lock()
+	previous, exists := p.streams[key]
+	if exists && previous.video == video {
+		p.mutex.Unlock()
+		return previous, nil
+	}
+	if !start {
+		p.mutex.Unlock()
+		return nil, ErrHlsFileNotFound
+	}
+	s := &hlsStream{
+		packager:   p,
+		key:        key,
+		roomID:     roomID,
+		publisher:  video.owner.userID,
+		video:      video,
+		audio:      audio,
+		lastAccess: time.Now(),
+		changed:    make(chan struct{}),
+	}
+	p.streams[key] = s
+	p.mutex.Unlock()
+	if exists {
+		previous.end() // of a track published before, e.g. the publisher republished
+	}
+
+	for _, track := range []*sfuTrack{video, audio} {
+		if track == nil {
+			continue
+		}
+		dt, live := p.router.addSink(track, &hlsSink{stream: s, video: track == video})
+		if !live {
+			s.end()
+			return nil, ErrPublisherNotStreaming
+		}
+		s.mutex.Lock()
+		ended := s.ended
+		if !ended {
+			s.sinks = append(s.sinks, dt)
+		}
+		s.mutex.Unlock()
+		if ended {
+			p.router.removeSink(dt) // unpublished meanwhile
+			return nil, ErrPublisherNotStreaming
+		}
+	}
+	go s.expire()
+	log.Printf("[%s] HLS stream of %s started\n", roomID, s.publisher)
+	return s, nil
+}
+
+// stopAll ends the streams, e.g. on shutdown.
+func (p *hlsPackager) stopAll() {
+	p.mutex.Lock()
+	streams := make([]*hlsStream, 0, len(p.streams))
+	for _, s := range p.streams {
+		streams = append(streams, s)
+	}
+	p.mutex.Unlock()
+	for _, s := range streams {
+		s.end()
+	}
+}
+
+// end stops packaging and detaches the sinks, the players get 404 from now on.
+func (s *hlsStream) end() {
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	sinks := s.sinks
+	s.notify()
+	s.mutex.Unlock()
+
+	s.packager.mutex.Lock()
+	if s.packager.streams[s.key] == s {
+		delete(s.packager.streams, s.key)
+	}
+	s.packager.mutex.Unlock()
+	for _, dt := range sinks {
+		s.packager.router.removeSink(dt)
+	}
+	log.Printf("[%s] HLS stream of %s ended\n", s.roomID, s.publisher)
+}
+
+// expire ends the stream once nobody requested it for idle-timeout.
+func (s *hlsStream) expire() {
+	timeout := s.packager.conf.IdleTimeout
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mutex.Lock()
+		ended, idle := s.ended, time.Since(s.lastAccess) > timeout
+		s.mutex.Unlock()
+		if ended {
+			return
+		}
+		if idle {
+			s.end()
+			return
+		}
+	}
+}
+
+// notify wakes up the blocked requests. Caller holds s.mutex.
+func (s *hlsStream) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// wait blocks until ready holds or it gives up, it returns with s.mutex held and tells whether ready holds.
+func (s *hlsStream) wait(ctx context.Context, timeout time.Duration, ready func() bool) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	s.mutex.Lock()
+	s.lastAccess = time.Now()
+	for !ready() {
+		if s.ended {
+			return false
+		}
+		changed := s.changed
+		s.mutex.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			s.mutex.Lock()
+			return false
+		case <-timer.C:
+			s.mutex.Lock()
+			return false
+		}
+		s.mutex.Lock()
+	}
+	return true
+}
+
+func (sink *hlsSink) WriteRTP(packet *rtp.Packet) error {
+	if sink.video {
+		return sink.stream.writeVideo(packet)
+	}
+	sink.stream.writeAudio(packet)
+	return nil
+}
+
+// Close ends the stream, its publisher is gone.
+func (sink *hlsSink) Close() error {
+	sink.stream.end()
+	return nil
+}
+
+// writeVideo adds the access units of the H.264 track, segments start with an IDR frame.
+func (s *hlsStream) writeVideo(packet *rtp.Packet) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ended {
+		return nil
+	}
+	au, timestamp := s.depacketizer.push(packet)
+	if au == nil {
+		return nil
+	}
+	s.params.update(au)
+	idr := h264.IDRPresent(au)
+	if s.init == nil {
+		if !idr || s.params.sps == nil || s.params.pps == nil {
+			return nil
+		}
+		if err := s.writeInit(); err != nil {
+			return err
+		}
+		s.started = time.Now()
+		s.segments = []*hlsSegment{{start: s.started}}
+	}
+	sample, err := fmp4.NewPartSampleH26x(0, idr, au)
+	if err != nil {
+		return err
+	}
+	conf := s.packager.conf
+	if s.pending != nil {
+		s.pending.Duration = timestamp - s.pendingTS
+		if conf.PartDuration > 0 && s.partDuration+uint64(s.pending.Duration) > uint64(conf.PartDuration)*h264ClockRate/uint64(time.Second) {
+			if err := s.cutPart(); err != nil {
+				return err
+			}
+		}
+		s.videoSamples = append(s.videoSamples, s.pending)
+		s.partDuration += uint64(s.pending.Duration)
+		s.segDuration += uint64(s.pending.Duration)
+	}
+	target := uint64(conf.SegmentDuration) * h264ClockRate / uint64(time.Second)
+	if idr && s.segDuration >= target {
+		if err := s.cutPart(); err != nil {
+			return err
+		}
+		s.cutSegment()
+	} else if s.segDuration >= target && !s.keyframeAsked {
+		// publishers send keyframes on request only, the segment would grow until the next loss
+		s.keyframeAsked = true
+		go s.requestKeyframe()
+	}
+	s.pending, s.pendingTS = sample, timestamp
+	return nil
+}
+
+// writeAudio adds an Opus packet, timed by its RTP timestamp from the first one.
+func (s *hlsStream) writeAudio(packet *rtp.Packet) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ended || s.init == nil || len(packet.Payload) == 0 {
+		return
+	}
+	if !s.audioStarted {
+		s.audioStarted = true
+		s.audioDTS = uint64(time.Since(s.started)) * uint64(s.audio.codec.ClockRate) / uint64(time.Second)
+	} else {
+		duration := int32(packet.Timestamp - s.audioTS)
+		if duration <= 0 {
+			return // reordered or repeated
+		}
+		// after a gap the previous sample lasts until this one, the timeline stays on the RTP clock
+		s.audioPending.Duration = uint32(duration)
+		s.audioSamples = append(s.audioSamples, s.audioPending)
+	}
+	s.audioPending = &fmp4.PartSample{Payload: append([]byte(nil), packet.Payload...)}
+	s.audioTS = packet.Timestamp
+}
+
+// writeInit builds the init segment from the parameter sets. Caller holds s.mutex.
+func (s *hlsStream) writeInit() error {
+	init := fmp4.Init{Tracks: []*fmp4.InitTrack{{
+		ID:        hlsVideoTrack,
+		TimeScale: h264ClockRate,
+		Codec:     &fmp4.CodecH264{SPS: s.params.sps, PPS: s.params.pps},
+	}}}
+	if s.audio != nil {
+		channels := int(s.audio.codec.Channels)
+		if channels == 0 {
+			channels = 2
+		}
+		init.Tracks = append(init.Tracks, &fmp4.InitTrack{
+			ID:        hlsAudioTrack,
+			TimeScale: s.audio.codec.ClockRate,
+			Codec:     &fmp4.CodecOpus{ChannelCount: channels},
+		})
+	}
+	var buf seekablebuffer.Buffer
+	if err := init.Marshal(&buf); err != nil {
+		return err
+	}
+	s.init = buf.Bytes()
+	return nil
+}
+
+// cutPart writes the buffered samples as a part of the current segment. Caller holds s.mutex.
+func (s *hlsStream) cutPart() error {
+	if len(s.videoSamples) == 0 {
+		return nil
+	}
+	s.sequence++
+	part := fmp4.Part{SequenceNumber: s.sequence, Tracks: []*fmp4.PartTrack{{
+		ID:       hlsVideoTrack,
+		BaseTime: s.videoDTS,
+		Samples:  s.videoSamples,
+	}}}
+	if len(s.audioSamples) > 0 {
+		part.Tracks = append(part.Tracks, &fmp4.PartTrack{
+			ID:       hlsAudioTrack,
+			BaseTime: s.audioDTS,
+			Samples:  s.audioSamples,
+		})
+	}
+	var buf seekablebuffer.Buffer
+	if err := part.Marshal(&buf); err != nil {
+		return err
+	}
+	for _, sample := range s.audioSamples {
+		s.audioDTS += uint64(sample.Duration)
+	}
+	segment := s.segments[len(s.segments)-1]
+	segment.parts = append(segment.parts, &hlsPart{
+		data:        buf.Bytes(),
+		duration:    time.Duration(s.partDuration) * time.Second / h264ClockRate,
+		independent: !s.videoSamples[0].IsNonSyncSample,
+	})
+	s.videoDTS += s.partDuration
+	s.videoSamples, s.audioSamples, s.partDuration = nil, nil, 0
+	s.notify()
+	return nil
+}
+
+// cutSegment completes the current segment and opens the next one. Caller holds s.mutex.
+func (s *hlsStream) cutSegment() {
+	current := s.segments[len(s.segments)-1]
+	var data bytes.Buffer
+	for _, part := range current.parts {
+		data.Write(part.data)
+	}
+	current.data = data.Bytes()
+	current.duration = time.Duration(s.segDuration) * time.Second / h264ClockRate
+	current.complete = true
+	s.segDuration, s.keyframeAsked = 0, false
+	s.segments = append(s.segments, &hlsSegment{
+		id:    current.id + 1,
+		start: s.started.Add(time.Duration(s.videoDTS) * time.Second / h264ClockRate),
+	})
+	if drop := len(s.segments) - 1 - s.packager.conf.PlaylistSize - hlsKeptSegments; drop > 0 {
+		s.segments = s.segments[drop:]
+	}
+	s.notify()
+}
+
+// requestKeyframe asks the publisher for a keyframe of the layer the stream receives.
+func (s *hlsStream) requestKeyframe() {
+	s.mutex.Lock()
+	var dt *downTrack
+	if len(s.sinks) > 0 {
+		dt = s.sinks[0]
+	}
+	s.mutex.Unlock()
+	if dt != nil {
+		dt.requestKeyframe()
+	}
+}
+
+// segment returns segment id, nil when it is not kept. Caller holds s.mutex.
+func (s *hlsStream) segment(id uint64) *hlsSegment {
+	if len(s.segments) == 0 || id < s.segments[0].id {
+		return nil
+	}
+	if i := id - s.segments[0].id; i < uint64(len(s.segments)) {
+		return s.segments[i]
+	}
+	return nil
+}
+
+// open returns the segment being written. Caller holds s.mutex, the stream has started.
+func (s *hlsStream) open() *hlsSegment {
+	return s.segments[len(s.segments)-1]
+}
+
+// hasPart tells whether part of segment id is written, the whole segment when part < 0. Caller holds s.mutex.
+func (s *hlsStream) hasPart(id uint64, part int) bool {
+	if len(s.segments) == 0 {
+		return false
+	}
+	open := s.open()
+	if id != open.id {
+		return id < open.id
+	}
+	return part >= 0 && part < len(open.parts)
+}
+
+// file returns the playlist, the init segment, a segment or a part, waiting for the next ones.
+func (s *hlsStream) file(ctx context.Context, name string, query url.Values) (string, []byte, error) {
+	conf := s.packager.conf
+	blockTimeout := 3 * conf.SegmentDuration
+	started := func() bool { return len(s.segments) > 1 }
+	if !s.wait(ctx, hlsStartTimeout, started) {
+		ended := s.ended
+		s.mutex.Unlock()
+		if ended {
+			return "", nil, ErrHlsFileNotFound
+		}
+		return "", nil, ErrHlsNotReady
+	}
+	s.mutex.Unlock()
+
+	switch name {
+	case "index.m3u8":
+		msn, part, err := blockingQuery(query)
+		if err != nil {
+			return "", nil, err
+		}
+		if conf.PartDuration <= 0 {
+			part = -1
+		}
+		if msn >= 0 {
+			s.mutex.Lock()
+			tooFar := uint64(msn) > s.open().id+2
+			s.mutex.Unlock()
+			if tooFar {
+				return "", nil, ErrHlsBadRequest
+			}
+			ready := s.wait(ctx, blockTimeout, func() bool { return s.hasPart(uint64(msn), part) })
+			s.mutex.Unlock()
+			if !ready {
+				return "", nil, ErrHlsNotReady
+			}
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return "application/vnd.apple.mpegurl", []byte(s.playlist(uriQuery(query))), nil
+	case "init.mp4":
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return "video/mp4", s.init, nil
+	}
+
+	id, part, ok := parseSegmentName(name)
+	if !ok {
+		return "", nil, ErrHlsFileNotFound
+	}
+	s.mutex.Lock()
+	known := s.segment(id) != nil || id == s.open().id+1
+	s.mutex.Unlock()
+	if !known {
+		return "", nil, ErrHlsFileNotFound
+	}
+	ready := s.wait(ctx, blockTimeout, func() bool { return s.hasPart(id, part) })
+	defer s.mutex.Unlock()
+	segment := s.segment(id)
+	switch {
+	case !ready && !s.ended:
+		return "", nil, ErrHlsNotReady
+	case !ready, segment == nil, part >= len(segment.parts):
+		return "", nil, ErrHlsFileNotFound
+	case part < 0:
+		return "video/iso.segment", segment.data, nil
+	default:
+		return "video/iso.segment", segment.parts[part].data, nil
+	}
+}
+
+// playlist renders the media playlist, query is appended to every URI. Caller holds s.mutex.
+func (s *hlsStream) playlist(query string) string {
+	conf := s.packager.conf
+	lowLatency := conf.PartDuration > 0
+	complete := s.segments[:len(s.segments)-1]
+	if len(complete) > conf.PlaylistSize {
+		complete = complete[len(complete)-conf.PlaylistSize:]
+	}
+	target := conf.SegmentDuration
+	for _, segment := range complete {
+		if segment.duration > target {
+			target = segment.duration
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	if lowLatency {
+		b.WriteString("#EXT-X-VERSION:9\n")
+	} else {
+		b.WriteString("#EXT-X-VERSION:7\n")
+	}
+	// the segment durations rounded to the nearest second must not exceed it
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", max(1, int(math.Round(target.Seconds()))))
+	if lowLatency {
+		fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*conf.PartDuration.Seconds())
+		fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", conf.PartDuration.Seconds())
+	}
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", complete[0].id)
+	fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init.mp4%s\"\n", query)
+	for i, segment := range complete {
+		fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", segment.start.UTC().Format("2006-01-02T15:04:05.000Z"))
+		if lowLatency && len(complete)-i <= hlsPartSegments {
+			s.writeParts(&b, segment, query)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.5f,\nseg%d.m4s%s\n", segment.duration.Seconds(), segment.id, query)
+	}
+	if lowLatency {
+		open := s.open()
+		fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", open.start.UTC().Format("2006-01-02T15:04:05.000Z"))
+		s.writeParts(&b, open, query)
+		fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part%d.%d.m4s%s\"\n", open.id, len(open.parts), query)
+	}
+	return b.String()
+}
+
+// writeParts lists the parts of segment. Caller holds s.mutex.
+func (s *hlsStream) writeParts(b *strings.Builder, segment *hlsSegment, query string) {
+	for i, part := range segment.parts {
+		fmt.Fprintf(b, "#EXT-X-PART:DURATION=%.5f,URI=\"part%d.%d.m4s%s\"", part.duration.Seconds(), segment.id, i, query)
+		if part.independent {
+			b.WriteString(",INDEPENDENT=YES")
+		}
+		b.WriteString("\n")
+	}
+}
+
+// blockingQuery reads _HLS_msn and _HLS_part, -1 when absent.
+func blockingQuery(query url.Values) (int, int, error) {
+	msn, part := -1, -1
+	var err error
+	if v := query.Get("_HLS_msn"); v != "" {
+		if msn, err = strconv.Atoi(v); err != nil || msn < 0 {
+			return 0, 0, ErrHlsBadRequest
+		}
+	}
+	if v := query.Get("_HLS_part"); v != "" {
+		if part, err = strconv.Atoi(v); err != nil || part < 0 || msn < 0 {
+			return 0, 0, ErrHlsBadRequest
+		}
+	}
+	return msn, part, nil
+}
+
+// uriQuery is the playlist query to append to its URIs, e.g. an access token, without the _HLS_ parameters.
+func uriQuery(query url.Values) string {
+	kept := url.Values{}
+	for key, values := range query {
+		if !strings.HasPrefix(key, "_HLS_") {
+			kept[key] = values
+		}
+	}
+	if len(kept) == 0 {
+		return ""
+	}
+	return "?" + kept.Encode()
+}
+
+// parseSegmentName reads seg<id>.m4s and part<id>.<n>.m4s, the part is -1 for a segment.
+func parseSegmentName(name string) (uint64, int, bool) {
+	if rest, ok := strings.CutPrefix(name, "seg"); ok {
+		id, err := strconv.ParseUint(strings.TrimSuffix(rest, ".m4s"), 10, 64)
+		return id, -1, err == nil && strings.HasSuffix(rest, ".m4s")
+	}
+	rest, ok := strings.CutPrefix(name, "part")
+	if !ok || !strings.HasSuffix(rest, ".m4s") {
+		return 0, 0, false
+	}
+	segment, part, ok := strings.Cut(strings.TrimSuffix(rest, ".m4s"), ".")
+	id, err := strconv.ParseUint(segment, 10, 64)
+	n, partErr := strconv.Atoi(part)
+	return id, n, ok && err == nil && partErr == nil && n >= 0
+}
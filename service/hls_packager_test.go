@@ -0,0 +1,153 @@
+package service
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go-rest-api/config"
+)
+
+// testStream is a low-latency stream with the complete segments 0..complete-1, each of one 2s part,
+// and an open one without parts.
+func testStream(complete int) *hlsStream {
+	conf := config.Hls{SegmentDuration: 2 * time.Second, PartDuration: 500 * time.Millisecond, PlaylistSize: 3, IdleTimeout: time.Minute}
+	s := &hlsStream{
+		packager: &hlsPackager{conf: conf, streams: make(map[string]*hlsStream)},
+		init:     []byte("init"),
+		started:  time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		changed:  make(chan struct{}),
+	}
+	for i := 0; i < complete; i++ {
+		s.segments = append(s.segments, &hlsSegment{
+			id:       uint64(i),
+			start:    s.started.Add(time.Duration(i) * 2 * time.Second),
+			parts:    []*hlsPart{{data: []byte("part"), duration: 2 * time.Second, independent: true}},
+			duration: 2 * time.Second,
+			complete: true,
+			data:     []byte("part"),
+		})
+	}
+	s.segments = append(s.segments, &hlsSegment{id: uint64(complete), start: s.started.Add(time.Duration(complete) * 2 * time.Second)})
+	return s
+}
+
+func TestParseSegmentName(t *testing.T) {
+	tests := []struct {
+		name string
+		id   uint64
+		part int
+		ok   bool
+	}{
+		{"seg12.m4s", 12, -1, true},
+		{"part12.3.m4s", 12, 3, true},
+		{"part0.0.m4s", 0, 0, true},
+		{"seg12", 0, 0, false},
+		{"segx.m4s", 0, 0, false},
+		{"part12.m4s", 0, 0, false},
+		{"part12.-1.m4s", 0, 0, false},
+		{"part12.1.mp4", 0, 0, false},
+		{"init.mp4", 0, 0, false},
+	}
+	for _, test := range tests {
+		id, part, ok := parseSegmentName(test.name)
+		if ok != test.ok || (ok && (id != test.id || part != test.part)) {
+			t.Errorf("parseSegmentName(%q) = %d, %d, %v, want %d, %d, %v", test.name, id, part, ok, test.id, test.part, test.ok)
+		}
+	}
+}
+
+func TestBlockingQuery(t *testing.T) {
+	tests := []struct {
+		query   string
+		msn     int
+		part    int
+		invalid bool
+	}{
+		{"", -1, -1, false},
+		{"_HLS_msn=4", 4, -1, false},
+		{"_HLS_msn=4&_HLS_part=2", 4, 2, false},
+		{"_HLS_part=2", 0, 0, true},
+		{"_HLS_msn=-1", 0, 0, true},
+		{"_HLS_msn=4&_HLS_part=x", 0, 0, true},
+	}
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		msn, part, err := blockingQuery(query)
+		if (err != nil) != test.invalid || (err == nil && (msn != test.msn || part != test.part)) {
+			t.Errorf("blockingQuery(%q) = %d, %d, %v, want %d, %d, invalid %v", test.query, msn, part, err, test.msn, test.part, test.invalid)
+		}
+	}
+}
+
+func TestPlaylistListsTheLastSegmentsAndTheirParts(t *testing.T) {
+	s := testStream(5)
+	s.open().parts = []*hlsPart{{data: []byte("p"), duration: 500 * time.Millisecond}}
+	query, _ := url.ParseQuery("token=abc&_HLS_msn=5")
+	playlist := s.playlist(uriQuery(query))
+
+	for _, line := range []string{
+		"#EXT-X-VERSION:9",
+		"#EXT-X-TARGETDURATION:2",
+		"#EXT-X-PART-INF:PART-TARGET=0.500",
+		"#EXT-X-MEDIA-SEQUENCE:2",
+		`#EXT-X-MAP:URI="init.mp4?token=abc"`,
+		"#EXT-X-PROGRAM-DATE-TIME:2026-01-02T03:04:09.000Z",
+		"#EXTINF:2.00000,\nseg2.m4s?token=abc",
+		"seg4.m4s?token=abc",
+		`#EXT-X-PART:DURATION=2.00000,URI="part4.0.m4s?token=abc",INDEPENDENT=YES`,
+		`#EXT-X-PART:DURATION=0.50000,URI="part5.0.m4s?token=abc"`,
+		`#EXT-X-PRELOAD-HINT:TYPE=PART,URI="part5.1.m4s?token=abc"`,
+	} {
+		if !strings.Contains(playlist, line) {
+			t.Errorf("playlist misses %q:\n%s", line, playlist)
+		}
+	}
+	if strings.Contains(playlist, "seg1.m4s") || strings.Contains(playlist, "_HLS_") {
+		t.Errorf("playlist lists a dropped segment or the blocking query:\n%s", playlist)
+	}
+}
+
+func TestPlaylistBlocksUntilTheRequestedPart(t *testing.T) {
+	s := testStream(2)
+	query, _ := url.ParseQuery("_HLS_msn=2&_HLS_part=0")
+	type result struct {
+		playlist string
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		_, data, err := s.file(context.Background(), "index.m3u8", query)
+		done <- result{string(data), err}
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("the playlist was returned before part 2.0 was written")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.mutex.Lock()
+	s.open().parts = append(s.open().parts, &hlsPart{data: []byte("p"), duration: 500 * time.Millisecond})
+	s.notify()
+	s.mutex.Unlock()
+
+	select {
+	case got := <-done:
+		if got.err != nil || !strings.Contains(got.playlist, `URI="part2.0.m4s"`) {
+			t.Fatalf("file = %v, playlist:\n%s", got.err, got.playlist)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the playlist request is still blocked after part 2.0 was written")
+	}
+}
+
+func TestPlaylistRejectsAFarMediaSequence(t *testing.T) {
+	s := testStream(2)
+	query, _ := url.ParseQuery("_HLS_msn=5")
+	if _, _, err := s.file(context.Background(), "index.m3u8", query); !errors.Is(err, ErrHlsBadRequest) {
+		t.Fatalf("file = %v, want %v", err, ErrHlsBadRequest)
+	}
+}
@@ -0,0 +1,538 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go-rest-api/config"
+	"go-rest-api/dto"
+)
+
+// joinKind tells JoinRoom how a client entered its room.
+type joinKind int
+
+const (
+	joinNew      joinKind = iota // first session of the user in the room
+	joinResumed                  // valid resume token, the session continues silently
+	joinReplaced                 // second login with the same identity took the session over
+)
+
+// hub keeps every joined user session grouped by room.
+// Room membership is guarded by its own lock; socket writes never happen while holding it,
+// each client owns a writer goroutine (see client.writePump) so a stalled viewer only blocks itself.
+type hub struct {
+	mutex         sync.RWMutex
+	rooms         map[string]map[string]*session // roomId -> (userId -> session)
+	resources     map[string]map[string]dto.Peer // roomId -> (resource ID -> WHIP/WHEP client), counted by admit
+	sendQueueSize int
+	resumeGrace   time.Duration
+
+	defaultPolicy dto.RoomPolicy
+	policies      map[string]dto.RoomPolicy // roomId -> policy from config, kept for the instance's lifetime
+	created       map[string]dto.RoomPolicy // roomId -> policy from the room creation API, dropped when the room is closed
+
+	pingInterval   time.Duration
+	pongWait       time.Duration
+	maxMessageSize int64
+
+	broker Broker
+	remote map[string]map[string]remotePeer // roomId -> (userId -> member connected to another instance)
+	nodes  map[string]time.Time             // node -> last envelope received from it
+	// heartbeat and nodeTTL detect instances that went away without a node-down, see beat
+	heartbeat time.Duration
+	nodeTTL   time.Duration
+	done      chan struct{}
+
+	draining bool // set by drain, joins are refused while the instance shuts down
+
+	// onKick and onCloseRoom apply an operator's kick or room close published by another instance
+	onKick      func(roomID, userID string)
+	onCloseRoom func(roomID string)
+}
+
+var (
+	ErrShuttingDown = errors.New("Server is shutting down, reconnect later")
+	ErrRoomFull     = errors.New("room is full")
+	ErrRoleFull     = errors.New("room has no seat left for this role")
+)
+
+func newHub(conf config.App, rooms config.Rooms, brokerConf config.Broker, broker Broker) *hub {
+	h := &hub{
+		rooms:          make(map[string]map[string]*session),
+		resources:      make(map[string]map[string]dto.Peer),
+		broker:         broker,
+		remote:         make(map[string]map[string]remotePeer),
+		nodes:          make(map[string]time.Time),
+		heartbeat:      brokerConf.Heartbeat,
+		nodeTTL:        brokerConf.NodeTTL,
+		done:           make(chan struct{}),
+		defaultPolicy:  rooms.Default,
+		policies:       make(map[string]dto.RoomPolicy, len(rooms.Policies)),
+		created:        make(map[string]dto.RoomPolicy),
+		sendQueueSize:  conf.SendQueueSize,
+		resumeGrace:    conf.ResumeGrace,
+		pingInterval:   conf.PingInterval,
+		pongWait:       conf.PongWait,
+		maxMessageSize: conf.MaxMessageSize,
+	}
+	if h.sendQueueSize <= 0 {
+		h.sendQueueSize = defaultSendQueueSize
+	}
+	if h.pongWait <= 0 {
+		h.pongWait = defaultPongWait
+	}
+	if h.pingInterval <= 0 || h.pingInterval >= h.pongWait {
+		h.pingInterval = h.pongWait * 9 / 10 // ping must land before the peer's read deadline
+	}
+	if h.maxMessageSize <= 0 {
+		h.maxMessageSize = defaultMaxMessageSize
+	}
+	for roomID, policy := range rooms.Policies {
+		h.policies[roomID] = policy
+	}
+	if h.heartbeat <= 0 {
+		h.heartbeat = defaultHeartbeat
+	}
+	if h.nodeTTL <= h.heartbeat {
+		h.nodeTTL = 3 * h.heartbeat
+	}
+	broker.Subscribe(h.handleEnvelope)
+	h.publish(envelope{Kind: envelopeSync}) // learn the members already connected to other instances
+	go h.beat()
+	return h
+}
+
+// joinResult tells JoinRoom what happened when a client was attached to its session.
+type joinResult struct {
+	others   []dto.Peer // other members of the room
+	kind     joinKind
+	old      *client // client previously attached to the session, to be closed by the caller
+	buffered int     // messages buffered while the session was detached, sent after the welcome
+}
+
+// join attaches c to the session of its user, creating the room and session when needed, and queues
+// its welcome. The room policy is checked first so a full room (or role) is left untouched.
+func (h *hub) join(c *client, resumeToken string) (joinResult, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.draining {
+		return joinResult{}, ErrShuttingDown
+	}
+	if err := h.admit(c.roomID, c.userID, c.role); err != nil {
+		return joinResult{}, err
+	}
+	members, exists := h.rooms[c.roomID]
+	if !exists {
+		// create new room!
+		members = make(map[string]*session)
+		h.rooms[c.roomID] = members
+		roomsGauge.Inc()
+	}
+	var result joinResult
+	s, exists := members[c.userID]
+	switch {
+	case !exists:
+		s = &session{roomID: c.roomID, userID: c.userID, joinedAt: time.Now()}
+		members[c.userID] = s
+		result.kind = joinNew
+	case resumeToken != "" && resumeToken == s.token:
+		result.kind = joinResumed
+	default:
+		log.Println("Warning Re-join room:", c.roomID, c.userID)
+		result.kind = joinReplaced
+	}
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	result.old = s.client
+	s.client = c
+	s.role = c.role
+	s.remoteIP = c.remoteIP
+	s.token = newResumeToken() // rotate on every attach, a token is good for one resume only
+	c.session = s
+
+	result.others = make([]dto.Peer, 0, len(members)-1)
+	for userID, other := range members {
+		if userID != c.userID {
+			result.others = append(result.others, dto.Peer{UserID: userID, Role: other.role})
+		}
+	}
+	for userID, other := range h.remote[c.roomID] {
+		if _, local := members[userID]; !local && userID != c.userID {
+			result.others = append(result.others, dto.Peer{UserID: userID, Role: other.role})
+		}
+	}
+
+	// queued under the lock so the welcome and the buffered messages come before anything delivered to c
+	c.respond(welcome(result, s.token))
+	for _, data := range s.pending {
+		c.enqueue(data)
+	}
+	result.buffered = len(s.pending)
+	s.pending = nil
+	return result, nil
+}
+
+// welcome is the first response of a joined client: `onConnected`, or `onResumed` for a resumed session
+// so the client keeps its peers.
+func welcome(joined joinResult, token string) dto.WsResponse {
+	event := "onConnected-"
+	if joined.kind == joinResumed {
+		event = "onResumed-"
+	}
+	ids := dto.PeerIDs(joined.others)
+	return dto.WsResponse{
+		Status:      http.StatusOK,
+		Message:     event + fmt.Sprint(len(joined.others)+1),
+		Peers:       &ids,
+		Members:     &joined.others,
+		ResumeToken: &token,
+	}
+}
+
+// admit checks the room policy for userID joining roomID as role, its own previous session and WHIP/WHEP
+// clients do not count. Caller holds the lock.
+func (h *hub) admit(roomID, userID, role string) error {
+	policy := h.policyOf(roomID)
+	others := make(map[string]string) // userId -> role
+	for other, s := range h.rooms[roomID] {
+		others[other] = s.role
+	}
+	for other, peer := range h.remote[roomID] {
+		if _, local := others[other]; !local {
+			others[other] = peer.role
+		}
+	}
+	for _, peer := range h.resources[roomID] {
+		if _, counted := others[peer.UserID]; !counted {
+			others[peer.UserID] = peer.Role
+		}
+	}
+	delete(others, userID)
+	total, sameRole := len(others), 0
+	for _, otherRole := range others {
+		if otherRole == role {
+			sameRole++
+		}
+	}
+	if policy.MaxMembers > 0 && total >= policy.MaxMembers {
+		return errors.Wrapf(ErrRoomFull, "Room %s has %d members", roomID, policy.MaxMembers)
+	}
+	if limit := policy.MaxPerRole[role]; limit > 0 && sameRole >= limit {
+		return errors.Wrapf(ErrRoleFull, "Room %s has %d/%d members of role %s", roomID, sameRole, limit, role)
+	}
+	return nil
+}
+
+// admitPeer checks the room policy for the WHIP/WHEP client of resourceID and counts it in the room until
+// releasePeer, it does not become a member the others are told about.
+func (h *hub) admitPeer(req dto.JoinRequest, resourceID string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.draining {
+		return ErrShuttingDown
+	}
+	if err := h.admit(req.RoomID, req.UserID, req.Role); err != nil {
+		return err
+	}
+	if h.resources[req.RoomID] == nil {
+		h.resources[req.RoomID] = make(map[string]dto.Peer)
+	}
+	h.resources[req.RoomID][resourceID] = dto.Peer{UserID: req.UserID, Role: req.Role}
+	return nil
+}
+
+// releasePeer stops counting the WHIP/WHEP client of resourceID in roomID.
+func (h *hub) releasePeer(roomID, resourceID string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.resources[roomID], resourceID)
+	if len(h.resources[roomID]) == 0 {
+		delete(h.resources, roomID)
+	}
+}
+
+// policyOf returns the policy of roomID: created by the API, configured for the room or the default. Caller holds the lock.
+func (h *hub) policyOf(roomID string) dto.RoomPolicy {
+	if policy, exists := h.created[roomID]; exists {
+		return policy
+	}
+	if policy, exists := h.policies[roomID]; exists {
+		return policy
+	}
+	return h.defaultPolicy
+}
+
+// policy returns the policy of roomID, see policyOf.
+func (h *hub) policy(roomID string) dto.RoomPolicy {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.policyOf(roomID)
+}
+
+// setPolicy stores the policy of roomID, it applies to joins from now on and lasts until the room is closed,
+// the configured policy applies again afterwards.
+func (h *hub) setPolicy(roomID string, policy dto.RoomPolicy) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.created[roomID] = policy
+}
+
+// detach is called when c's socket is gone. If c still owns its session the session is kept
+// for the resume grace period, onLeave runs once it expires (or right away without a grace period).
+// It returns false when c no longer owns the session (replaced or resumed by another socket).
+func (h *hub) detach(c *client, onLeave func()) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s := c.session
+	if s == nil || s.client != c {
+		return false
+	}
+	s.client = nil
+	if h.resumeGrace <= 0 {
+		h.remove(s)
+		go onLeave()
+		return true
+	}
+	s.expiry = time.AfterFunc(h.resumeGrace, func() {
+		h.mutex.Lock()
+		expired := s.client == nil && h.rooms[s.roomID][s.userID] == s
+		if expired {
+			h.remove(s)
+		}
+		h.mutex.Unlock()
+		if expired {
+			onLeave()
+		}
+	})
+	return true
+}
+
+// remove drops s from its room, the room is dropped when it becomes empty. Caller holds the lock.
+func (h *hub) remove(s *session) {
+	members := h.rooms[s.roomID]
+	delete(members, s.userID)
+	if len(members) == 0 {
+		delete(h.rooms, s.roomID) // Xóa phòng nếu không còn user
+		roomsGauge.Dec()
+	}
+}
+
+// kick removes userID from roomID and returns its session, the caller closes the attached client.
+func (h *hub) kick(roomID, userID string) (*session, *client) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s, exists := h.rooms[roomID][userID]
+	if !exists {
+		return nil, nil
+	}
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+	c := s.client
+	s.client = nil // detach of the kicked socket becomes a no-op
+	h.remove(s)
+	return s, c
+}
+
+// closeRoom removes roomID with all its sessions and returns the attached clients to be closed
+// and the members that left.
+func (h *hub) closeRoom(roomID string) ([]*client, []dto.Peer, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	members, exists := h.rooms[roomID]
+	if !exists {
+		return nil, nil, false
+	}
+	clients := make([]*client, 0, len(members))
+	left := make([]dto.Peer, 0, len(members))
+	for _, s := range members {
+		if s.expiry != nil {
+			s.expiry.Stop()
+		}
+		if s.client != nil {
+			clients = append(clients, s.client)
+		}
+		s.client = nil
+		left = append(left, dto.Peer{UserID: s.userID, Role: s.role})
+	}
+	delete(h.rooms, roomID)
+	delete(h.created, roomID)
+	roomsGauge.Dec()
+	return clients, left, true
+}
+
+// drain refuses further joins and removes every room, it returns the attached clients to be closed.
+// Sessions are dropped without the leave path: the members are told the server is going away instead.
+func (h *hub) drain() []*client {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.draining = true
+	var clients []*client
+	for roomID, members := range h.rooms {
+		for _, s := range members {
+			if s.expiry != nil {
+				s.expiry.Stop()
+			}
+			if s.client != nil {
+				clients = append(clients, s.client)
+			}
+			s.client = nil
+		}
+		delete(h.rooms, roomID)
+		roomsGauge.Dec()
+	}
+	return clients
+}
+
+// roomSizes returns the member count of every room with members here or on another instance.
+func (h *hub) roomSizes() map[string]int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	sizes := make(map[string]int, len(h.rooms)+len(h.remote))
+	for roomID, members := range h.rooms {
+		sizes[roomID] = len(members)
+	}
+	for roomID, members := range h.remote {
+		for userID := range members {
+			if _, local := h.rooms[roomID][userID]; !local {
+				sizes[roomID]++
+			}
+		}
+	}
+	return sizes
+}
+
+// peerSummaries describes the members of roomID here and on the other instances, false if it has none.
+func (h *hub) peerSummaries(roomID string) ([]dto.PeerSummary, bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	local, remote := h.rooms[roomID], h.remote[roomID]
+	if len(local) == 0 && len(remote) == 0 {
+		return nil, false
+	}
+	peers := make([]dto.PeerSummary, 0, len(local)+len(remote))
+	for _, s := range local {
+		peers = append(peers, dto.PeerSummary{
+			UserID:    s.userID,
+			Role:      s.role,
+			JoinedAt:  s.joinedAt,
+			RemoteIP:  s.remoteIP,
+			Connected: s.client != nil,
+		})
+	}
+	for userID, other := range remote {
+		if _, exists := local[userID]; !exists {
+			peers = append(peers, dto.PeerSummary{UserID: userID, Role: other.role, Connected: true, Node: other.node})
+		}
+	}
+	return peers, true
+}
+
+// members returns a snapshot of the sessions in roomID, nil if the room does not exist.
+func (h *hub) members(roomID string) []*session {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	room, exists := h.rooms[roomID]
+	if !exists {
+		return nil
+	}
+	sessions := make([]*session, 0, len(room))
+	for _, s := range room {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// session returns the session of userID in roomID, nil if it is not a member here.
+func (h *hub) session(roomID, userID string) *session {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.rooms[roomID][userID]
+}
+
+// deliver hands data to the live socket of s, or buffers it while s is detached.
+func (h *hub) deliver(s *session, data []byte) delivery {
+	h.mutex.Lock()
+	c := s.client
+	if c == nil {
+		defer h.mutex.Unlock()
+		if h.rooms[s.roomID][s.userID] != s {
+			return deliveryFailed // already left
+		}
+		if len(s.pending) >= h.sendQueueSize {
+			log.Printf("[%s] %s resume buffer is full (%d), dropping message\n", s.roomID, s.userID, len(s.pending))
+			return deliveryFailed
+		}
+		s.pending = append(s.pending, data)
+		return deliveryQueued
+	}
+	h.mutex.Unlock()
+	if c.enqueue(data) {
+		return deliverySent
+	}
+	if h.resumeGrace <= 0 {
+		return deliveryFailed
+	}
+	// the socket just died and the reader has not detached yet, keep the message for the resume
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(s.pending) >= h.sendQueueSize {
+		return deliveryFailed
+	}
+	s.pending = append(s.pending, data)
+	return deliveryQueued
+}
+
+// peers returns the members currently in roomID with their role, on this and other instances.
+func (h *hub) peers(roomID string) []dto.Peer {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	peers := make([]dto.Peer, 0, len(h.rooms[roomID])+len(h.remote[roomID]))
+	for userID, s := range h.rooms[roomID] {
+		peers = append(peers, dto.Peer{UserID: userID, Role: s.role})
+	}
+	for userID, other := range h.remote[roomID] {
+		if _, local := h.rooms[roomID][userID]; !local {
+			peers = append(peers, dto.Peer{UserID: userID, Role: other.role})
+		}
+	}
+	return peers
+}
+
+// notifyPresence tells every member of roomID, here and on the other instances, that peer joined, left or reconnected.
+func (h *hub) notifyPresence(roomID string, peer dto.Peer, event string) {
+	h.notifyLocal(roomID, peer.UserID, event)
+	h.publish(envelope{Kind: envelopePresence, RoomID: roomID, From: peer.UserID, Role: peer.Role, Event: event})
+}
+
+// notifyLocal tells the members of roomID connected to this instance, except userID, about a presence change.
+// Peers and Members carry the current member list so clients can resync instead of tracking deltas.
+func (h *hub) notifyLocal(roomID, userID, event string) {
+	peers := h.peers(roomID)
+	ids := dto.PeerIDs(peers)
+	resp := dto.WsResponse{
+		Status:  http.StatusOK,
+		Message: event,
+		Time:    time.Now().Unix(),
+		Peers:   &ids,
+		Members: &peers,
+		From:    &userID,
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		log.Println("Failed to encode presence event:", err)
+		return
+	}
+	for _, s := range h.members(roomID) {
+		if s.userID != userID {
+			h.deliver(s, data)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package service
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"go-rest-api/dto"
+)
+
+// defaultHeartbeat is used when `broker.heartbeat` is not configured
+const defaultHeartbeat = 10 * time.Second
+
+// remotePeer is a room member connected to another signaling instance
+type remotePeer struct {
+	node string
+	role string
+}
+
+// memberEntry is one member listed in an envelopeMembers
+type memberEntry struct {
+	RoomID string `json:"roomId"`
+	UserID string `json:"userId"`
+	Role   string `json:"role,omitempty"`
+}
+
+// publish hands env to the broker, a failure only costs the other instances this message.
+func (h *hub) publish(env envelope) {
+	if err := h.broker.Publish(env); err != nil {
+		log.Println("Broker publish error:", err)
+	}
+}
+
+// remoteNode returns the instance serving userID in roomID when it is not connected here.
+func (h *hub) remoteNode(roomID, userID string) (string, bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if _, local := h.rooms[roomID][userID]; local {
+		return "", false
+	}
+	other, exists := h.remote[roomID][userID]
+	return other.node, exists
+}
+
+// handleEnvelope applies what another instance published to the members connected here.
+func (h *hub) handleEnvelope(env envelope) {
+	if env.Kind != envelopeNodeDown {
+		h.mutex.Lock()
+		_, known := h.nodes[env.Node]
+		h.nodes[env.Node] = time.Now()
+		h.mutex.Unlock()
+		if !known && env.Kind == envelopeHeartbeat {
+			// a node dropped as silent is back, its members have to be learned again
+			h.publish(envelope{Kind: envelopeSync})
+		}
+	}
+	switch env.Kind {
+	case envelopeDirect:
+		h.mutex.RLock()
+		s := h.rooms[env.RoomID][env.To]
+		h.mutex.RUnlock()
+		if s == nil {
+			log.Printf("[%s] %s is not connected here, dropping message from node %s\n", env.RoomID, env.To, env.Node)
+			return
+		}
+		h.deliver(s, env.Data)
+	case envelopeBroadcast:
+		for _, s := range h.members(env.RoomID) {
+			if s.userID != env.From {
+				h.deliver(s, env.Data)
+			}
+		}
+	case envelopePresence:
+		h.mutex.Lock()
+		_, local := h.rooms[env.RoomID][env.From]
+		if env.Event == dto.PeerLeft {
+			h.forgetRemote(env.RoomID, env.From, env.Node)
+		} else {
+			if h.remote[env.RoomID] == nil {
+				h.remote[env.RoomID] = make(map[string]remotePeer)
+			}
+			h.remote[env.RoomID][env.From] = remotePeer{node: env.Node, role: env.Role}
+		}
+		h.mutex.Unlock()
+		// a left from the old instance of a user who moved here must not reach the room
+		if env.Event != "" && !(local && env.Event == dto.PeerLeft) {
+			h.notifyLocal(env.RoomID, env.From, env.Event)
+		}
+	case envelopeSync:
+		h.announce()
+	case envelopeMembers:
+		var members []memberEntry
+		if err := json.Unmarshal(env.Data, &members); err != nil {
+			log.Printf("Invalid member list from node %s: %v\n", env.Node, err)
+			return
+		}
+		h.replaceNode(env.Node, members)
+	case envelopeNodeDown:
+		h.dropNode(env.Node)
+	case envelopeKick:
+		if h.onKick != nil {
+			h.onKick(env.RoomID, env.To)
+		}
+	case envelopeCloseRoom:
+		if h.onCloseRoom != nil {
+			h.onCloseRoom(env.RoomID)
+		}
+	}
+}
+
+// hasRemote tells whether roomID has members connected to other instances.
+func (h *hub) hasRemote(roomID string) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return len(h.remote[roomID]) > 0
+}
+
+// announce publishes the whole member list of this instance, it replaces what the others knew about it.
+func (h *hub) announce() {
+	members := []memberEntry{}
+	h.mutex.RLock()
+	for roomID, sessions := range h.rooms {
+		for userID, s := range sessions {
+			members = append(members, memberEntry{RoomID: roomID, UserID: userID, Role: s.role})
+		}
+	}
+	h.mutex.RUnlock()
+	data, err := json.Marshal(members)
+	if err != nil {
+		log.Println("Failed to encode member list:", err)
+		return
+	}
+	h.publish(envelope{Kind: envelopeMembers, Data: data})
+}
+
+// replaceNode sets the remote members of node to members, the ones missing from it left.
+func (h *hub) replaceNode(node string, members []memberEntry) {
+	listed := make(map[string]map[string]bool)
+	h.mutex.Lock()
+	for _, m := range members {
+		if listed[m.RoomID] == nil {
+			listed[m.RoomID] = make(map[string]bool)
+		}
+		listed[m.RoomID][m.UserID] = true
+		if h.remote[m.RoomID] == nil {
+			h.remote[m.RoomID] = make(map[string]remotePeer)
+		}
+		h.remote[m.RoomID][m.UserID] = remotePeer{node: node, role: m.Role}
+	}
+	left := h.forgetNode(node, func(roomID, userID string) bool { return !listed[roomID][userID] })
+	h.mutex.Unlock()
+	h.notifyLeft(left)
+}
+
+// dropNode forgets the members of an instance that went away and tells the rooms they left.
+func (h *hub) dropNode(node string) {
+	h.mutex.Lock()
+	delete(h.nodes, node)
+	left := h.forgetNode(node, func(string, string) bool { return true })
+	h.mutex.Unlock()
+	h.notifyLeft(left)
+	log.Printf("node %s went away, %d remote members dropped\n", node, len(left))
+}
+
+// remoteMember is a member forgotten by forgetNode
+type remoteMember struct{ roomID, userID string }
+
+// forgetNode removes the remote members of node matching drop and returns the ones that are not
+// connected here either. Caller holds the lock.
+func (h *hub) forgetNode(node string, drop func(roomID, userID string) bool) []remoteMember {
+	var left []remoteMember
+	for roomID, members := range h.remote {
+		for userID, other := range members {
+			if other.node != node || !drop(roomID, userID) {
+				continue
+			}
+			h.forgetRemote(roomID, userID, node)
+			if _, local := h.rooms[roomID][userID]; !local {
+				left = append(left, remoteMember{roomID, userID})
+			}
+		}
+	}
+	return left
+}
+
+func (h *hub) notifyLeft(left []remoteMember) {
+	for _, peer := range left {
+		h.notifyLocal(peer.roomID, peer.userID, dto.PeerLeft)
+	}
+}
+
+// beat publishes a heartbeat every h.heartbeat and drops the instances silent for h.nodeTTL,
+// a node that crashed never sends its node-down. It runs until leave.
+func (h *hub) beat() {
+	ticker := time.NewTicker(h.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.publish(envelope{Kind: envelopeHeartbeat})
+			h.expireNodes(time.Now())
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// expireNodes drops the instances not heard from for h.nodeTTL before now.
+func (h *hub) expireNodes(now time.Time) {
+	var silent []string
+	h.mutex.RLock()
+	for node, seen := range h.nodes {
+		if now.Sub(seen) > h.nodeTTL {
+			silent = append(silent, node)
+		}
+	}
+	h.mutex.RUnlock()
+	for _, node := range silent {
+		log.Printf("node %s silent for %s\n", node, h.nodeTTL)
+		h.dropNode(node)
+	}
+}
+
+// leave tells the other instances that the members connected here are gone and closes the broker.
+func (h *hub) leave() {
+	close(h.done)
+	h.publish(envelope{Kind: envelopeNodeDown})
+	if err := h.broker.Close(); err != nil {
+		log.Println("Broker close error:", err)
+	}
+}
+
+// forgetRemote removes userID from the remote view if node still serves it. Caller holds the lock.
+func (h *hub) forgetRemote(roomID, userID, node string) {
+	members := h.remote[roomID]
+	if other, exists := members[userID]; !exists || other.node != node {
+		return
+	}
+	delete(members, userID)
+	if len(members) == 0 {
+		delete(h.remote, roomID)
+	}
+}
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"go-rest-api/config"
+	"go-rest-api/dto"
+)
+
+func testHub(t *testing.T) *hub {
+	t.Helper()
+	h := newHub(config.App{}, config.Rooms{}, config.Broker{}, newMemoryBroker(t.Name()))
+	t.Cleanup(h.leave)
+	return h
+}
+
+func remoteView(h *hub) map[string]string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	view := make(map[string]string)
+	for roomID, members := range h.remote {
+		for userID, other := range members {
+			view[roomID+"/"+userID] = other.node
+		}
+	}
+	return view
+}
+
+func membersEnvelope(t *testing.T, node string, members ...memberEntry) envelope {
+	t.Helper()
+	data, err := json.Marshal(members)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return envelope{Node: node, Kind: envelopeMembers, Data: data}
+}
+
+func TestHandleEnvelopeMembership(t *testing.T) {
+	tests := []struct {
+		name      string
+		envelopes func(t *testing.T) []envelope
+		want      map[string]string
+	}{
+		{"presence join", func(t *testing.T) []envelope {
+			return []envelope{{Node: "a", Kind: envelopePresence, RoomID: "r", From: "u1", Event: dto.PeerJoined}}
+		}, map[string]string{"r/u1": "a"}},
+		{"presence left", func(t *testing.T) []envelope {
+			return []envelope{
+				{Node: "a", Kind: envelopePresence, RoomID: "r", From: "u1", Event: dto.PeerJoined},
+				{Node: "a", Kind: envelopePresence, RoomID: "r", From: "u1", Event: dto.PeerLeft},
+			}
+		}, map[string]string{}},
+		{"left from the node a user moved away from", func(t *testing.T) []envelope {
+			return []envelope{
+				{Node: "a", Kind: envelopePresence, RoomID: "r", From: "u1", Event: dto.PeerJoined},
+				{Node: "b", Kind: envelopePresence, RoomID: "r", From: "u1", Event: dto.PeerJoined},
+				{Node: "a", Kind: envelopePresence, RoomID: "r", From: "u1", Event: dto.PeerLeft},
+			}
+		}, map[string]string{"r/u1": "b"}},
+		{"member list replaces the node's members", func(t *testing.T) []envelope {
+			return []envelope{
+				{Node: "a", Kind: envelopePresence, RoomID: "r", From: "u1", Event: dto.PeerJoined},
+				{Node: "a", Kind: envelopePresence, RoomID: "r2", From: "u2", Event: dto.PeerJoined},
+				{Node: "b", Kind: envelopePresence, RoomID: "r", From: "u3", Event: dto.PeerJoined},
+				membersEnvelope(t, "a", memberEntry{RoomID: "r", UserID: "u1"}, memberEntry{RoomID: "r", UserID: "u4"}),
+			}
+		}, map[string]string{"r/u1": "a", "r/u4": "a", "r/u3": "b"}},
+		{"empty member list", func(t *testing.T) []envelope {
+			return []envelope{
+				{Node: "a", Kind: envelopePresence, RoomID: "r", From: "u1", Event: dto.PeerJoined},
+				membersEnvelope(t, "a"),
+			}
+		}, map[string]string{}},
+		{"node down", func(t *testing.T) []envelope {
+			return []envelope{
+				{Node: "a", Kind: envelopePresence, RoomID: "r", From: "u1", Event: dto.PeerJoined},
+				{Node: "b", Kind: envelopePresence, RoomID: "r", From: "u2", Event: dto.PeerJoined},
+				{Node: "a", Kind: envelopeNodeDown},
+			}
+		}, map[string]string{"r/u2": "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := testHub(t)
+			for _, env := range tt.envelopes(t) {
+				h.handleEnvelope(env)
+			}
+			got := remoteView(h)
+			if len(got) != len(tt.want) {
+				t.Fatalf("remote members %v, want %v", got, tt.want)
+			}
+			for key, node := range tt.want {
+				if got[key] != node {
+					t.Fatalf("remote members %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestExpireSilentNodes(t *testing.T) {
+	h := testHub(t)
+	h.handleEnvelope(envelope{Node: "a", Kind: envelopePresence, RoomID: "r", From: "u1", Event: dto.PeerJoined})
+	h.handleEnvelope(envelope{Node: "b", Kind: envelopePresence, RoomID: "r", From: "u2", Event: dto.PeerJoined})
+	now := time.Now()
+	h.mutex.Lock()
+	h.nodes["a"] = now.Add(-h.nodeTTL - time.Second)
+	h.mutex.Unlock()
+
+	h.expireNodes(now)
+	if got := remoteView(h); len(got) != 1 || got["r/u2"] != "b" {
+		t.Fatalf("remote members %v after node a went silent, want only r/u2 on b", got)
+	}
+	if _, known := h.nodes["a"]; known {
+		t.Error("silent node a is still tracked")
+	}
+
+	h.handleEnvelope(envelope{Node: "b", Kind: envelopeHeartbeat})
+	h.expireNodes(now.Add(h.nodeTTL / 2))
+	if got := remoteView(h); len(got) != 1 {
+		t.Fatalf("remote members %v, node b sent a heartbeat and must be kept", got)
+	}
+}
+
+func TestAnnounceListsLocalMembers(t *testing.T) {
+	h := testHub(t)
+	other := newMemoryBroker("other")
+	defer other.Close()
+	var got []envelope
+	other.Subscribe(func(env envelope) { got = append(got, env) })
+
+	h.mutex.Lock()
+	h.rooms["r"] = map[string]*session{"u1": {roomID: "r", userID: "u1", role: "device"}}
+	h.mutex.Unlock()
+	h.announce()
+
+	if len(got) != 1 || got[0].Kind != envelopeMembers || got[0].Node != h.broker.NodeID() {
+		t.Fatalf("announce published %+v, want one member list", got)
+	}
+	var members []memberEntry
+	if err := json.Unmarshal(got[0].Data, &members); err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0] != (memberEntry{RoomID: "r", UserID: "u1", Role: "device"}) {
+		t.Errorf("announced %+v", members)
+	}
+}
+
+func TestHandleEnvelopeOperatorActions(t *testing.T) {
+	h := testHub(t)
+	var kicked, closed []string
+	h.onKick = func(roomID, userID string) { kicked = append(kicked, roomID+"/"+userID) }
+	h.onCloseRoom = func(roomID string) { closed = append(closed, roomID) }
+	h.handleEnvelope(envelope{Node: "a", Kind: envelopeKick, RoomID: "r", To: "u1"})
+	h.handleEnvelope(envelope{Node: "a", Kind: envelopeCloseRoom, RoomID: "r2"})
+	if len(kicked) != 1 || kicked[0] != "r/u1" {
+		t.Errorf("kicked %v, want r/u1", kicked)
+	}
+	if len(closed) != 1 || closed[0] != "r2" {
+		t.Errorf("closed %v, want r2", closed)
+	}
+}
+
+func TestRoomsOfOtherInstancesAreListed(t *testing.T) {
+	h := testHub(t)
+	local := testClient(h, "r", "u1")
+	if _, err := h.join(local, ""); err != nil {
+		t.Fatal(err)
+	}
+	h.handleEnvelope(membersEnvelope(t, "a",
+		memberEntry{RoomID: "r", UserID: "u1", Role: dto.RoleOperator}, // moved here, listed once
+		memberEntry{RoomID: "r", UserID: "u2", Role: dto.RoleDevice},
+		memberEntry{RoomID: "remote", UserID: "u3", Role: dto.RoleViewer}))
+
+	sizes := h.roomSizes()
+	if len(sizes) != 2 || sizes["r"] != 2 || sizes["remote"] != 1 {
+		t.Fatalf("roomSizes() = %v, want r: 2 and remote: 1", sizes)
+	}
+	peers, exists := h.peerSummaries("remote")
+	if !exists || len(peers) != 1 || peers[0].UserID != "u3" || peers[0].Node != "a" || peers[0].Role != dto.RoleViewer {
+		t.Fatalf("peerSummaries(remote) = %+v, %v, want u3 on node a", peers, exists)
+	}
+	if _, exists := h.peerSummaries("none"); exists {
+		t.Fatal("peerSummaries of a room without members reports it")
+	}
+}
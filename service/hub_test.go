@@ -0,0 +1,86 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/pkg/errors"
+	"go-rest-api/dto"
+)
+
+func testClient(h *hub, roomID, userID string) *client {
+	return &client{hub: h, roomID: roomID, userID: userID, role: dto.RoleOperator,
+		send: make(chan []byte, h.sendQueueSize), done: make(chan struct{})}
+}
+
+func TestJoinResumeQueuesWelcomeBeforeBufferedMessages(t *testing.T) {
+	h := testHub(t)
+	first := testClient(h, "r", "u1")
+	if _, err := h.join(first, ""); err != nil {
+		t.Fatal(err)
+	}
+	<-first.send // welcome
+	s := first.session
+	token := s.token
+	h.mutex.Lock()
+	s.client = nil // detached, waiting for the resume
+	h.mutex.Unlock()
+	for _, msg := range []string{`"m1"`, `"m2"`} {
+		if got := h.deliver(s, []byte(msg)); got != deliveryQueued {
+			t.Fatalf("deliver to a detached session = %v, want queued", got)
+		}
+	}
+
+	second := testClient(h, "r", "u1")
+	joined, err := h.join(second, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joined.kind != joinResumed || joined.buffered != 2 {
+		t.Fatalf("join = kind %v, %d buffered, want a resume with 2", joined.kind, joined.buffered)
+	}
+	h.deliver(s, []byte(`"m3"`))
+
+	var welcome dto.WsResponse
+	if err := json.Unmarshal(<-second.send, &welcome); err != nil || welcome.Message != "onResumed-1" {
+		t.Fatalf("first message %+v (%v), want onResumed-1", welcome, err)
+	}
+	for _, want := range []string{`"m1"`, `"m2"`, `"m3"`} {
+		if got := string(<-second.send); got != want {
+			t.Fatalf("got %s, want %s", got, want)
+		}
+	}
+	if len(s.pending) != 0 {
+		t.Errorf("%d messages left in the resume buffer", len(s.pending))
+	}
+}
+
+func TestWhipPublishersCountTowardsTheRoleLimit(t *testing.T) {
+	h := testHub(t)
+	h.defaultPolicy = dto.RoomPolicy{MaxPerRole: map[string]int{dto.RoleDevice: 1}}
+	device := func(userID string) dto.JoinRequest {
+		return dto.JoinRequest{RoomID: "r", UserID: userID, Role: dto.RoleDevice}
+	}
+	if err := h.admitPeer(device("uav1"), "res1"); err != nil {
+		t.Fatalf("first WHIP device: %v", err)
+	}
+	if err := h.admitPeer(device("uav2"), "res2"); !errors.Is(err, ErrRoleFull) {
+		t.Fatalf("second WHIP device = %v, want %v", err, ErrRoleFull)
+	}
+	ws := testClient(h, "r", "uav3")
+	ws.role = dto.RoleDevice
+	if _, err := h.join(ws, ""); !errors.Is(err, ErrRoleFull) {
+		t.Fatalf("websocket device next to a WHIP one = %v, want %v", err, ErrRoleFull)
+	}
+	same := testClient(h, "r", "uav1")
+	same.role = dto.RoleDevice
+	if _, err := h.join(same, ""); err != nil {
+		t.Fatalf("websocket session of the WHIP device: %v", err)
+	}
+
+	h.releasePeer("r", "res1")
+	h.kick("r", "uav1")
+	if err := h.admitPeer(device("uav2"), "res2"); err != nil {
+		t.Fatalf("WHIP device after the first one left: %v", err)
+	}
+}
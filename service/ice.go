@@ -0,0 +1,42 @@
+package service
+
+import (
+	"time"
+
+	"go-rest-api/config"
+	"go-rest-api/dto"
+)
+
+type IceService interface {
+	// IceServers returns the ICE servers with TURN credentials issued to userID.
+	IceServers(string) dto.IceServersResponse
+}
+
+type iceService struct {
+	conf config.Ice
+}
+
+func (s *iceService) IceServers(userID string) dto.IceServersResponse {
+	resp := dto.IceServersResponse{
+		URIs:       append(append([]string{}, s.conf.StunURLs...), s.conf.TurnURLs...),
+		IceServers: make([]dto.IceServer, 0, 2),
+	}
+	for _, server := range s.conf.Servers(userID, time.Now()) {
+		credential, _ := server.Credential.(string)
+		resp.IceServers = append(resp.IceServers, dto.IceServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: credential,
+		})
+		if credential != "" {
+			resp.Username = server.Username
+			resp.Password = credential
+			resp.TTL = int64(s.conf.CredentialTTL / time.Second)
+		}
+	}
+	return resp
+}
+
+func NewIceService(conf config.Ice) IceService {
+	return &iceService{conf: conf}
+}
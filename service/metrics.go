@@ -0,0 +1,92 @@
+package service
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go-rest-api/dto"
+)
+
+// route label values of the message metrics
+const (
+	routeDirect    = "direct"
+	routeBroadcast = "broadcast"
+)
+
+// Instruments exported on /metrics. They live here so the hub, the clients and the SFU code
+// record what they do themselves, handlers only expose the registry.
+var (
+	messagesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "signaling",
+		Name:      "messages_total",
+		Help:      "Messages received from room members by route (direct, broadcast) and outcome (the ack sent back).",
+	}, []string{"route", "outcome"})
+
+	roomsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "signaling",
+		Name:      "rooms",
+		Help:      "Rooms with at least one session on this instance.",
+	})
+
+	connectionsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "signaling",
+		Name:      "connections",
+		Help:      "Open room websockets on this instance.",
+	})
+
+	forwardDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "signaling",
+		Name:      "forward_duration_seconds",
+		Help:      "Time from reading a message to handing it to the recipients' send queues or the broker.",
+		Buckets:   []float64{.00005, .0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1},
+	}, []string{"route"})
+
+	wsWriteDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "signaling",
+		Name:      "ws_write_duration_seconds",
+		Help:      "Duration of a single websocket message write, slow consumers show up in the upper buckets.",
+		Buckets:   []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5, 10},
+	})
+
+	sfuPeerConnectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sfu",
+		Name:      "peer_connections_total",
+		Help:      "Peer connections created by the SFU by role (publisher, subscriber, member, data) and result.",
+	}, []string{"role", "result"})
+
+	sfuTracksTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sfu",
+		Name:      "tracks_total",
+		Help:      "Tracks handled by the SFU: published by a sender or attached to a subscriber, by kind.",
+	}, []string{"direction", "kind"})
+
+	sfuDataMessagesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sfu",
+		Name:      "data_messages_total",
+		Help:      "Data channel messages relayed by the SFU by route (broadcast to followers, direct reply) and outcome.",
+	}, []string{"route", "outcome"})
+
+	sfuKeyframeRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sfu",
+		Name:      "keyframe_requests_total",
+		Help:      "PLI/FIR of subscribers and new subscriptions, forwarded to the publisher or throttled.",
+	}, []string{"result"})
+)
+
+// countMessage records one message outcome.
+func countMessage(route, ack string) {
+	messagesTotal.WithLabelValues(route, ack).Inc()
+}
+
+// observeForward records the forwarding time of a message read at start.
+func observeForward(route string, start time.Time) {
+	forwardDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+}
+
+func routeOf(msg dto.Message) string {
+	if msg.To == nil {
+		return routeBroadcast
+	}
+	return routeDirect
+}
@@ -0,0 +1,398 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/h264writer"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+	"github.com/pkg/errors"
+	"go-rest-api/config"
+	"go-rest-api/dto"
+)
+
+// H.264 recording formats, the other codecs have one format each
+const (
+	formatAnnexB = "annexb"
+	formatMP4    = "mp4"
+)
+
+const (
+	// recordQueueSize is how many packets of a track wait for the disk before new ones are dropped
+	recordQueueSize = 1024
+	// recordingRetention is how long a stopped recording stays listed, its files stay on disk
+	recordingRetention = time.Hour
+)
+
+var (
+	ErrRecordingNotFound = errors.New("recording not found")
+	ErrAlreadyRecording  = errors.New("this publisher is already being recorded")
+	ErrInvalidFormat     = errors.New("unknown H.264 recording format, use annexb or mp4")
+)
+
+// unsafePathChars are replaced in the room and user IDs used in file names
+var unsafePathChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// recorder writes the tracks published in the SFU to disk, one file per track.
+type recorder struct {
+	router *sfuRouter
+	conf   config.Recording
+
+	mutex      sync.Mutex
+	recordings map[string]*recording // recording ID ->
+}
+
+// recording records the tracks of a publisher, or of every publisher of the room, until it is stopped.
+type recording struct {
+	id        string
+	roomID    string
+	publisher string // "" for every publisher
+	format    string
+	auto      bool
+	startedAt time.Time
+
+	// guarded by recorder.mutex
+	stoppedAt time.Time
+	files     []*recordedTrack
+	tracks    map[*sfuTrack]bool // recorded or being set up
+}
+
+// recordedTrack is the file of one track, written by its own goroutine.
+type recordedTrack struct {
+	rec     *recording
+	track   *sfuTrack
+	file    dto.RecordingFile
+	writer  media.Writer
+	dt      *downTrack
+	packets chan *rtp.Packet
+	dropped atomic.Uint64
+	closing sync.Once
+	done    chan struct{}
+}
+
+func newRecorder(router *sfuRouter, conf config.Recording) *recorder {
+	return &recorder{router: router, conf: conf, recordings: make(map[string]*recording)}
+}
+
+// start records the tracks publisherID publishes in roomID, of every publisher when empty, without overlap.
+func (r *recorder) start(roomID, publisherID, format string, auto bool) (*recording, error) {
+	if format == "" {
+		format = r.conf.H264Format
+	}
+	if format != formatAnnexB && format != formatMP4 {
+		return nil, ErrInvalidFormat
+	}
+	r.mutex.Lock()
+	r.prune()
+	for _, rec := range r.recordings {
+		if rec.active() && rec.roomID == roomID && (rec.publisher == "" || publisherID == "" || rec.publisher == publisherID) {
+			r.mutex.Unlock()
+			if rec.publisher != "" {
+				return nil, errors.Wrap(ErrAlreadyRecording, rec.publisher)
+			}
+			return nil, ErrAlreadyRecording
+		}
+	}
+	rec := &recording{
+		id:        newID()[:16],
+		roomID:    roomID,
+		publisher: publisherID,
+		format:    format,
+		auto:      auto,
+		startedAt: time.Now(),
+		tracks:    make(map[*sfuTrack]bool),
+	}
+	r.recordings[rec.id] = rec
+	r.mutex.Unlock()
+
+	for _, track := range r.router.tracksOf(roomID, publisherID) {
+		r.record(rec, track)
+	}
+	who := publisherID
+	if who == "" {
+		who = "every publisher"
+	}
+	log.Printf("[%s] recording %s started for %s\n", roomID, rec.id, who)
+	return rec, nil
+}
+
+// trackPublished records a new track for its active recordings, or starts one with autoRecord.
+func (r *recorder) trackPublished(track *sfuTrack, autoRecord bool) {
+	roomID, publisherID := track.owner.roomID, track.owner.userID
+	var recordings []*recording
+	r.mutex.Lock()
+	for _, rec := range r.recordings {
+		if rec.active() && rec.roomID == roomID && (rec.publisher == "" || rec.publisher == publisherID) {
+			recordings = append(recordings, rec)
+		}
+	}
+	r.mutex.Unlock()
+	if len(recordings) == 0 && autoRecord {
+		// records the tracks published so far, this one included
+		if _, err := r.start(roomID, publisherID, "", true); err != nil && !errors.Is(err, ErrAlreadyRecording) {
+			log.Printf("[%s] failed to record %s: %v\n", roomID, publisherID, err)
+		}
+		return
+	}
+	for _, rec := range recordings {
+		r.record(rec, track)
+	}
+}
+
+// record adds a file for track to rec, unless rec already records it or its codec cannot be written.
+func (r *recorder) record(rec *recording, track *sfuTrack) {
+	r.mutex.Lock()
+	recorded := rec.tracks[track]
+	rec.tracks[track] = true
+	r.mutex.Unlock()
+	if recorded {
+		return
+	}
+
+	dir := filepath.Join(r.conf.Dir, safeName(rec.roomID))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Println("Failed to create recording directory:", err)
+		return
+	}
+	base := filepath.Join(dir, fmt.Sprintf("%s-%s-%s-%s", safeName(track.owner.userID), rec.startedAt.UTC().Format("20060102T150405Z"), rec.id[:8], safeName(track.id)))
+	writer, path, err := newMediaWriter(base, track.codec, rec.format)
+	if err != nil {
+		log.Printf("[%s] cannot record track %s of %s: %v\n", rec.roomID, track.id, track.owner.userID, err)
+		return
+	}
+	f := &recordedTrack{
+		rec:    rec,
+		track:  track,
+		writer: writer,
+		file: dto.RecordingFile{
+			TrackID:   track.id,
+			Publisher: track.owner.userID,
+			Kind:      track.kind.String(),
+			MimeType:  track.codec.MimeType,
+			Path:      path,
+		},
+		packets: make(chan *rtp.Packet, recordQueueSize),
+		done:    make(chan struct{}),
+	}
+	go r.write(f)
+
+	r.mutex.Lock()
+	if !rec.active() {
+		r.mutex.Unlock()
+		_ = f.Close()
+		return
+	}
+	rec.files = append(rec.files, f)
+	r.mutex.Unlock()
+	dt, live := r.router.addSink(track, f)
+	if !live {
+		_ = f.Close()
+		return
+	}
+	r.mutex.Lock()
+	f.dt = dt
+	stopped := !rec.active()
+	r.mutex.Unlock()
+	if stopped {
+		r.router.removeSink(dt) // stopped meanwhile
+	}
+	log.Printf("[%s] recording %s of %s to %s\n", rec.roomID, track.id, track.owner.userID, path)
+}
+
+// newMediaWriter opens the pion writer of codec, the file is base with the extension of the format.
+func newMediaWriter(base string, codec webrtc.RTPCodecCapability, h264Format string) (media.Writer, string, error) {
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeH264):
+		if h264Format == formatMP4 {
+			w, err := newMP4Recorder(base + ".mp4")
+			return w, base + ".mp4", err
+		}
+		w, err := h264writer.New(base + ".h264")
+		return w, base + ".h264", err
+	case strings.ToLower(webrtc.MimeTypeVP8), strings.ToLower(webrtc.MimeTypeVP9), strings.ToLower(webrtc.MimeTypeAV1):
+		w, err := ivfwriter.New(base+".ivf", ivfwriter.WithCodec(codec.MimeType))
+		return w, base + ".ivf", err
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		channels := codec.Channels
+		if channels == 0 {
+			channels = 2
+		}
+		w, err := oggwriter.New(base+".ogg", codec.ClockRate, channels)
+		return w, base + ".ogg", err
+	}
+	return nil, "", errors.Errorf("no recording format for %s", codec.MimeType)
+}
+
+// write drains the packets of f to its file until f is closed, then finishes the file.
+func (r *recorder) write(f *recordedTrack) {
+	failed := false
+	for packet := range f.packets {
+		if err := f.writer.WriteRTP(packet); err != nil && !failed {
+			failed = true // logged once, a full disk would flood the log
+			log.Printf("[%s] failed to record %s: %v\n", f.rec.roomID, f.file.Path, err)
+		}
+	}
+	if err := f.writer.Close(); err != nil {
+		log.Printf("[%s] failed to close %s: %v\n", f.rec.roomID, f.file.Path, err)
+	}
+	close(f.done)
+	r.trackEnded(f)
+}
+
+// trackEnded marks the file of f closed, an automatic recording stops with its last file.
+func (r *recorder) trackEnded(f *recordedTrack) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	f.file.Closed = true
+	rec := f.rec
+	if !rec.auto || !rec.active() {
+		return
+	}
+	for _, other := range rec.files {
+		if !other.file.Closed {
+			return
+		}
+	}
+	rec.stoppedAt = time.Now()
+	log.Printf("[%s] recording %s ended with its publisher\n", rec.roomID, rec.id)
+}
+
+// stop ends the recording id of roomID and returns it once its files are complete.
+func (r *recorder) stop(roomID, id string) (*recording, error) {
+	r.mutex.Lock()
+	rec, exists := r.recordings[id]
+	if !exists || rec.roomID != roomID {
+		r.mutex.Unlock()
+		return nil, ErrRecordingNotFound
+	}
+	if rec.stoppedAt.IsZero() {
+		rec.stoppedAt = time.Now()
+	}
+	files := append([]*recordedTrack(nil), rec.files...)
+	sinks := make([]*downTrack, 0, len(files))
+	for _, f := range files {
+		if f.dt != nil {
+			sinks = append(sinks, f.dt)
+		}
+	}
+	r.mutex.Unlock()
+	for _, dt := range sinks {
+		r.router.removeSink(dt)
+	}
+	for _, f := range files {
+		<-f.done
+	}
+	log.Printf("[%s] recording %s stopped\n", roomID, id)
+	return rec, nil
+}
+
+// stopAll stops the active recordings, e.g. on shutdown so their files are complete.
+func (r *recorder) stopAll() {
+	r.mutex.Lock()
+	var active []*recording
+	for _, rec := range r.recordings {
+		if rec.active() {
+			active = append(active, rec)
+		}
+	}
+	r.mutex.Unlock()
+	for _, rec := range active {
+		_, _ = r.stop(rec.roomID, rec.id)
+	}
+}
+
+// list returns the recordings of roomID, active or stopped within recordingRetention, the oldest first.
+func (r *recorder) list(roomID string) []dto.Recording {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.prune()
+	recordings := make([]dto.Recording, 0)
+	for _, rec := range r.recordings {
+		if rec.roomID == roomID {
+			recordings = append(recordings, rec.summary())
+		}
+	}
+	sort.Slice(recordings, func(i, j int) bool { return recordings[i].StartedAt.Before(recordings[j].StartedAt) })
+	return recordings
+}
+
+// prune forgets the recordings stopped more than recordingRetention ago. Caller holds recorder.mutex.
+func (r *recorder) prune() {
+	for id, rec := range r.recordings {
+		if !rec.active() && time.Since(rec.stoppedAt) > recordingRetention {
+			delete(r.recordings, id)
+		}
+	}
+}
+
+// summary describes rec.
+func (r *recorder) summary(rec *recording) dto.Recording {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return rec.summary()
+}
+
+// active tells whether rec still records. Caller holds recorder.mutex.
+func (rec *recording) active() bool {
+	return rec.stoppedAt.IsZero()
+}
+
+// summary describes rec. Caller holds recorder.mutex.
+func (rec *recording) summary() dto.Recording {
+	s := dto.Recording{
+		ID:        rec.id,
+		RoomID:    rec.roomID,
+		Publisher: rec.publisher,
+		Auto:      rec.auto,
+		Active:    rec.active(),
+		StartedAt: rec.startedAt,
+		Files:     make([]dto.RecordingFile, 0, len(rec.files)),
+	}
+	if !rec.active() {
+		stoppedAt := rec.stoppedAt
+		s.StoppedAt = &stoppedAt
+	}
+	for _, f := range rec.files {
+		file := f.file
+		file.Dropped = f.dropped.Load()
+		s.Files = append(s.Files, file)
+	}
+	return s
+}
+
+// WriteRTP queues a packet for the file, it is dropped when the disk is behind.
+func (f *recordedTrack) WriteRTP(packet *rtp.Packet) error {
+	select {
+	case f.packets <- packet.Clone():
+	default:
+		f.dropped.Add(1)
+	}
+	return nil
+}
+
+// Close stops queuing, the queued packets are still written. It returns once the file is complete.
+func (f *recordedTrack) Close() error {
+	f.closing.Do(func() { close(f.packets) })
+	<-f.done
+	return nil
+}
+
+// safeName keeps an ID usable as a file name.
+func safeName(id string) string {
+	if name := unsafePathChars.ReplaceAllString(id, "_"); name != "" {
+		return name
+	}
+	return "_"
+}
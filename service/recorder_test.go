@@ -0,0 +1,108 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go-rest-api/config"
+)
+
+func testRecorder(t *testing.T) *recorder {
+	return newRecorder(newSfuRouter(nil, nil), config.Recording{Dir: t.TempDir(), H264Format: formatAnnexB})
+}
+
+func TestRecorderStartRejectsOverlaps(t *testing.T) {
+	tests := []struct {
+		name      string
+		existing  []*recording
+		roomID    string
+		publisher string
+		wantErr   error
+		wantMsg   string
+	}{
+		{"first recording", nil, "r", "", nil, ""},
+		{"room next to a room recording", []*recording{{roomID: "r"}}, "r", "", ErrAlreadyRecording, ErrAlreadyRecording.Error()},
+		{"publisher within a room recording", []*recording{{roomID: "r"}}, "r", "u1", ErrAlreadyRecording, ErrAlreadyRecording.Error()},
+		{"room over a publisher recording", []*recording{{roomID: "r", publisher: "u1"}}, "r", "", ErrAlreadyRecording, "u1: " + ErrAlreadyRecording.Error()},
+		{"same publisher", []*recording{{roomID: "r", publisher: "u1"}}, "r", "u1", ErrAlreadyRecording, "u1: " + ErrAlreadyRecording.Error()},
+		{"other publisher", []*recording{{roomID: "r", publisher: "u1"}}, "r", "u2", nil, ""},
+		{"other room", []*recording{{roomID: "r2"}}, "r", "", nil, ""},
+		{"after a stopped recording", []*recording{{roomID: "r", stoppedAt: time.Now()}}, "r", "", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testRecorder(t)
+			for i, rec := range tt.existing {
+				rec.id = string(rune('a' + i))
+				r.recordings[rec.id] = rec
+			}
+			rec, err := r.start(tt.roomID, tt.publisher, "", false)
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("start() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil && err.Error() != tt.wantMsg {
+				t.Errorf("start() error = %q, want %q", err, tt.wantMsg)
+			}
+			if err == nil && (rec.roomID != tt.roomID || rec.publisher != tt.publisher || !rec.active() || rec.format != formatAnnexB) {
+				t.Errorf("start() = %+v, want an active annexb recording of %q in %s", rec, tt.publisher, tt.roomID)
+			}
+		})
+	}
+}
+
+func TestRecorderStartRejectsUnknownFormats(t *testing.T) {
+	if _, err := testRecorder(t).start("r", "", "mkv", false); !errors.Is(err, ErrInvalidFormat) {
+		t.Fatalf("start() error = %v, want %v", err, ErrInvalidFormat)
+	}
+}
+
+func TestRecordingStopsWithItsLastFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		auto     bool
+		files    int
+		ended    int
+		wantStop bool
+	}{
+		{"automatic, every file ended", true, 2, 2, true},
+		{"automatic, a file still open", true, 2, 1, false},
+		{"started by the API", false, 2, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testRecorder(t)
+			rec := &recording{id: "a", roomID: "r", auto: tt.auto}
+			r.recordings[rec.id] = rec
+			for i := 0; i < tt.files; i++ {
+				rec.files = append(rec.files, &recordedTrack{rec: rec})
+			}
+			for _, f := range rec.files[:tt.ended] {
+				r.trackEnded(f)
+			}
+			if stopped := !rec.active(); stopped != tt.wantStop {
+				t.Errorf("stopped = %v, want %v", stopped, tt.wantStop)
+			}
+		})
+	}
+}
+
+func TestRecorderListForgetsOldRecordings(t *testing.T) {
+	r := testRecorder(t)
+	now := time.Now()
+	for _, rec := range []*recording{
+		{id: "active", roomID: "r", startedAt: now.Add(-3 * time.Hour)},
+		{id: "recent", roomID: "r", startedAt: now.Add(-2 * time.Hour), stoppedAt: now.Add(-time.Minute)},
+		{id: "old", roomID: "r", startedAt: now.Add(-3 * time.Hour), stoppedAt: now.Add(-recordingRetention - time.Minute)},
+		{id: "other", roomID: "r2", startedAt: now},
+	} {
+		r.recordings[rec.id] = rec
+	}
+	got := r.list("r")
+	if len(got) != 2 || got[0].ID != "active" || got[1].ID != "recent" {
+		t.Fatalf("list() = %+v, want active and recent", got)
+	}
+	if _, exists := r.recordings["old"]; exists {
+		t.Error("a recording stopped before the retention period is still kept")
+	}
+}
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"go-rest-api/dto"
+)
+
+// StartRecording records a publisher of roomID, or every publisher when none is named, from now on.
+// It fails with ErrPublisherNotFound or ErrPublisherNotStreaming when there is no track to record yet.
+func (v *videoCallService) StartRecording(roomID string, req dto.StartRecordingRequest) (dto.Recording, error) {
+	if err := v.publisherStreaming(roomID, req.Publisher); err != nil {
+		return dto.Recording{}, err
+	}
+	rec, err := v.recorder.start(roomID, req.Publisher, req.H264Format, false)
+	if err != nil {
+		return dto.Recording{}, err
+	}
+	return v.recorder.summary(rec), nil
+}
+
+// StopRecording stops a recording of roomID, it returns once the files are complete.
+func (v *videoCallService) StopRecording(roomID, recordingID string) (dto.Recording, error) {
+	rec, err := v.recorder.stop(roomID, recordingID)
+	if err != nil {
+		return dto.Recording{}, err
+	}
+	return v.recorder.summary(rec), nil
+}
+
+// ListRecordings returns the active recordings of roomID and the ones stopped within recordingRetention.
+func (v *videoCallService) ListRecordings(roomID string) []dto.Recording {
+	return v.recorder.list(roomID)
+}
+
+// trackPublished starts the recordings a new track belongs to.
+func (v *videoCallService) trackPublished(track *sfuTrack) {
+	v.recorder.trackPublished(track, v.hub.policy(track.owner.roomID).AutoRecord)
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"log"
+	"sort"
+
+	"github.com/pkg/errors"
+	"go-rest-api/dto"
+)
+
+var (
+	ErrRoomNotFound = errors.New("room not found")
+	ErrPeerNotFound = errors.New("peer not found")
+)
+
+func (v *videoCallService) CreateRoom(req dto.CreateRoomRequest) {
+	v.hub.setPolicy(req.RoomID, req.Policy)
+	log.Printf("[%s] room policy set: %+v\n", req.RoomID, req.Policy)
+}
+
+func (v *videoCallService) ListRooms() []dto.RoomSummary {
+	sizes := v.hub.roomSizes()
+	rooms := make([]dto.RoomSummary, 0, len(sizes))
+	for roomID, members := range sizes {
+		rooms = append(rooms, dto.RoomSummary{RoomID: roomID, Members: members, Policy: v.hub.policy(roomID)})
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].RoomID < rooms[j].RoomID })
+	return rooms
+}
+
+// ListBandwidth returns the bandwidth estimate of the SFU subscribers of roomID.
+func (v *videoCallService) ListBandwidth(roomID string) ([]dto.SubscriberBandwidth, error) {
+	estimates, exists := v.router.bandwidth(roomID)
+	if !exists {
+		return nil, ErrRoomNotFound
+	}
+	return estimates, nil
+}
+
+func (v *videoCallService) ListPeers(roomID string) ([]dto.PeerSummary, error) {
+	peers, exists := v.hub.peerSummaries(roomID)
+	if !exists {
+		return nil, ErrRoomNotFound
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].JoinedAt.Before(peers[j].JoinedAt) })
+	return peers, nil
+}
+
+// KickPeer removes userID from roomID on every instance.
+func (v *videoCallService) KickPeer(roomID, userID string) error {
+	_, remote := v.hub.remoteNode(roomID, userID)
+	if !v.kick(roomID, userID) && !remote {
+		return ErrPeerNotFound
+	}
+	v.hub.publish(envelope{Kind: envelopeKick, RoomID: roomID, To: userID})
+	return nil
+}
+
+// kick removes userID from roomID on this instance and tells whether it was a member here.
+func (v *videoCallService) kick(roomID, userID string) bool {
+	v.router.removeMember(roomID, userID)
+	v.data.removeMember(roomID, userID)
+	s, c := v.hub.kick(roomID, userID)
+	if s == nil {
+		return false
+	}
+	if c != nil {
+		c.closeWith(dto.CloseKicked, "kicked by operator")
+	}
+	v.hub.notifyPresence(roomID, dto.Peer{UserID: userID, Role: s.role}, dto.PeerLeft)
+	log.Printf("[%s] %s kicked from room %s\n", roomID, userID, roomID)
+	return true
+}
+
+// CloseRoom closes roomID on every instance.
+func (v *videoCallService) CloseRoom(roomID string) error {
+	remote := v.hub.hasRemote(roomID)
+	if !v.closeRoom(roomID) && !remote {
+		return ErrRoomNotFound
+	}
+	v.hub.publish(envelope{Kind: envelopeCloseRoom, RoomID: roomID})
+	return nil
+}
+
+// closeRoom closes roomID on this instance and tells whether it had members here. The other
+// instances are told that they left.
+func (v *videoCallService) closeRoom(roomID string) bool {
+	v.router.closeRoom(roomID)
+	v.data.closeRoom(roomID)
+	clients, left, exists := v.hub.closeRoom(roomID)
+	if !exists {
+		return false
+	}
+	for _, c := range clients {
+		c.closeWith(dto.CloseRoomClosed, "room closed by operator")
+	}
+	for _, peer := range left {
+		v.hub.notifyPresence(roomID, peer, dto.PeerLeft)
+	}
+	log.Printf("[%s] room closed, %d sockets dropped\n", roomID, len(clients))
+	return true
+}
@@ -0,0 +1,47 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// session is the membership of one user in a room. It outlives a single websocket:
+// when the socket drops the session is detached for the resume grace period, messages
+// addressed to the user are buffered and flushed once a client presents the resume token.
+// All fields are guarded by hub.mutex.
+type session struct {
+	roomID   string
+	userID   string
+	role     string
+	token    string
+	joinedAt time.Time
+	remoteIP string  // of the last attached socket
+	client   *client // nil while detached, waiting for resume
+
+	pending [][]byte    // messages addressed to the user while detached
+	expiry  *time.Timer // fires the leave path when the grace period is over
+}
+
+// delivery is the outcome of handing a message to a session.
+type delivery int
+
+const (
+	deliveryFailed delivery = iota
+	deliverySent            // enqueued on the live socket
+	deliveryQueued          // buffered until the user resumes
+)
+
+// newResumeToken is the secret a client presents to resume its session.
+func newResumeToken() string {
+	return newID()
+}
+
+// newID returns a random hex ID, e.g. of a WHIP resource or a recording.
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
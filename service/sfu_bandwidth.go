@@ -0,0 +1,118 @@
+package service
+
+import (
+	"sort"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"go-rest-api/dto"
+)
+
+// allocate fits the down tracks of sub into its bandwidth estimate every layerWindow until it is done.
+// Audio is always forwarded, the rest of the estimate is split evenly between the video down tracks,
+// each of them picks the best layer within its share and drops temporal layers above it.
+func (r *sfuRouter) allocate(sub *sfuPeer) {
+	ticker := time.NewTicker(layerWindow)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-sub.done:
+			return
+		}
+		estimate := uint64(sub.estimator.GetTargetBitrate())
+		var video []*downTrack
+		var audio uint64
+		r.mutex.Lock()
+		for track, dt := range sub.downTracks {
+			if track.kind == webrtc.RTPCodecTypeVideo {
+				video = append(video, dt)
+			} else {
+				audio += track.bitrate()
+			}
+		}
+		r.mutex.Unlock()
+		if len(video) == 0 {
+			continue
+		}
+		budget := uint64(1) // below the audio: the lowest layers, without temporal layers
+		if estimate > audio {
+			budget = (estimate - audio) / uint64(len(video))
+		}
+		for _, dt := range video {
+			dt.mutex.Lock()
+			dt.budget = budget
+			dt.mutex.Unlock()
+			dt.track.selectLayer(dt)
+		}
+	}
+}
+
+// bitrate returns the bitrate of the layers of track.
+func (track *sfuTrack) bitrate() uint64 {
+	track.mutex.RLock()
+	defer track.mutex.RUnlock()
+	var rate uint64
+	for _, layer := range track.layers {
+		rate += layer.bitrate()
+	}
+	return rate
+}
+
+// bandwidth returns the estimate of every subscriber of roomID and how its down tracks use it,
+// false when the SFU has no peer in the room.
+func (r *sfuRouter) bandwidth(roomID string) ([]dto.SubscriberBandwidth, bool) {
+	r.mutex.Lock()
+	peers, exists := r.rooms[roomID]
+	var subscribers []*sfuPeer
+	downTracks := make(map[*sfuPeer][]*downTrack)
+	for _, p := range peers {
+		if !p.subscribe {
+			continue
+		}
+		subscribers = append(subscribers, p)
+		for _, dt := range p.downTracks {
+			downTracks[p] = append(downTracks[p], dt)
+		}
+	}
+	r.mutex.Unlock()
+
+	estimates := make([]dto.SubscriberBandwidth, 0, len(subscribers))
+	for _, p := range subscribers {
+		estimate := dto.SubscriberBandwidth{UserID: p.userID, Tracks: make([]dto.DownTrackBandwidth, 0, len(downTracks[p]))}
+		if p.estimator != nil {
+			estimate.Estimate = p.estimator.GetTargetBitrate()
+			estimate.Stats = p.estimator.GetStats()
+		}
+		for _, dt := range downTracks[p] {
+			estimate.Tracks = append(estimate.Tracks, dt.stats())
+		}
+		sort.Slice(estimate.Tracks, func(i, j int) bool {
+			a, b := estimate.Tracks[i], estimate.Tracks[j]
+			return a.Publisher < b.Publisher || (a.Publisher == b.Publisher && a.TrackID < b.TrackID)
+		})
+		estimates = append(estimates, estimate)
+	}
+	sort.Slice(estimates, func(i, j int) bool { return estimates[i].UserID < estimates[j].UserID })
+	return estimates, exists
+}
+
+// stats describes what dt forwards.
+func (dt *downTrack) stats() dto.DownTrackBandwidth {
+	dt.mutex.Lock()
+	s := dto.DownTrackBandwidth{
+		TrackID:      dt.track.id,
+		Publisher:    dt.track.owner.userID,
+		Kind:         dt.track.kind.String(),
+		Layer:        dt.current,
+		Target:       dt.target,
+		Budget:       dt.budget,
+		TemporalDrop: dt.dropping,
+	}
+	active := dt.active
+	dt.mutex.Unlock()
+	if layer := dt.track.layer(s.Layer); layer != nil && active {
+		s.Bitrate = layer.bitrate()
+	}
+	return s
+}
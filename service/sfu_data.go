@@ -0,0 +1,393 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/webrtc/v4"
+	"github.com/pkg/errors"
+	"go-rest-api/dto"
+)
+
+const (
+	// dataBufferLimit is the SCTP send buffer past which messages to a slow member are dropped
+	dataBufferLimit = 1 << 20
+	// dataPendingLimit bounds the messages kept for a relayed channel that is not open yet
+	dataPendingLimit = 64
+)
+
+// dataHub relays the data channels of the members so a UAV sends each message once, whatever the number of viewers.
+type dataHub struct {
+	mutex sync.Mutex
+	rooms map[string]map[string]*dataPeer // roomId -> (userId -> peer)
+
+	// send delivers a server message to a member's websocket
+	send func(roomID, userID string, data []byte) bool
+	// newPeerConnection creates a registered peer connection and its done channel
+	newPeerConnection func() (*webrtc.PeerConnection, cc.BandwidthEstimator, <-chan struct{}, error)
+}
+
+// dataPeer is the data peer connection of a member.
+type dataPeer struct {
+	roomID    string
+	userID    string
+	publisher string // exchanges messages with this member only, "" with every member following it
+	pc        *webrtc.PeerConnection
+	done      <-chan struct{}
+
+	// guarded by dataHub.mutex
+	links   map[string]*dataLink // userId of the relayed member -> channel the server opened for it
+	joined  bool                 // links are set up once the first offer is answered
+	removed bool
+
+	negotiation sync.Mutex                // serializes offer/answer on pc
+	candidates  []webrtc.ICECandidateInit // received before the remote description
+}
+
+// dataLink is a channel the server opened on a member for another member.
+type dataLink struct {
+	mutex   sync.Mutex
+	channel *webrtc.DataChannel
+	open    bool
+	pending []webrtc.DataChannelMessage // sent before the channel opened
+}
+
+func newDataHub(send func(string, string, []byte) bool,
+	newPeerConnection func() (*webrtc.PeerConnection, cc.BandwidthEstimator, <-chan struct{}, error)) *dataHub {
+	return &dataHub{
+		rooms:             make(map[string]map[string]*dataPeer),
+		send:              send,
+		newPeerConnection: newPeerConnection,
+	}
+}
+
+// follows tells whether to gets the messages of from. Caller holds the hub lock.
+func (to *dataPeer) follows(from *dataPeer) bool {
+	return to != from && !to.removed && to.joined &&
+		(to.publisher == "" || to.publisher == from.userID) &&
+		(from.publisher == "" || from.publisher == to.userID)
+}
+
+// handleSignal applies a message a member sent to the "sfu" member, the server never offers.
+func (h *dataHub) handleSignal(roomID, userID, payload string) error {
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		data = []byte(payload)
+	}
+	var signal sfuSignal
+	if err := json.Unmarshal(data, &signal); err != nil {
+		return errors.Wrap(err, "invalid SFU signal")
+	}
+
+	h.mutex.Lock()
+	p := h.rooms[roomID][userID]
+	h.mutex.Unlock()
+	created := false
+	if p == nil {
+		if signal.Type != webrtc.SDPTypeOffer.String() {
+			return errors.New("no SFU data session, send an offer first")
+		}
+		if signal.Publisher == userID {
+			return errors.New("a member cannot follow itself")
+		}
+		pc, _, done, err := h.newPeerConnection()
+		if err != nil {
+			return err
+		}
+		p = &dataPeer{roomID: roomID, userID: userID, publisher: signal.Publisher, pc: pc, done: done}
+		h.addPeer(p)
+		created = true
+		sfuPeerConnectionsTotal.WithLabelValues("data", "ok").Inc()
+	}
+
+	switch signal.Type {
+	case webrtc.SDPTypeOffer.String():
+		var offer webrtc.SessionDescription
+		if err := json.Unmarshal(signal.Sdp, &offer); err != nil {
+			if created {
+				h.removePeer(p)
+			}
+			return errors.Wrap(err, "invalid offer")
+		}
+		if err := h.answer(p, offer); err != nil {
+			if created {
+				h.removePeer(p)
+			}
+			return err
+		}
+		if created {
+			h.join(p)
+		}
+	case signalCandidate:
+		var candidate webrtc.ICECandidateInit
+		if err := json.Unmarshal(signal.Sdp, &candidate); err != nil {
+			return errors.Wrap(err, "invalid candidate")
+		}
+		p.negotiation.Lock()
+		defer p.negotiation.Unlock()
+		if p.pc.RemoteDescription() == nil {
+			p.candidates = append(p.candidates, candidate)
+			return nil
+		}
+		return p.pc.AddICECandidate(candidate)
+	default:
+		return errors.Errorf("unknown SFU data signal %q", signal.Type)
+	}
+	return nil
+}
+
+// addPeer registers p in its room, replacing an older session of the member, until its peer connection is done.
+func (h *dataHub) addPeer(p *dataPeer) {
+	p.links = make(map[string]*dataLink)
+	h.mutex.Lock()
+	peers, exists := h.rooms[p.roomID]
+	if !exists {
+		peers = make(map[string]*dataPeer)
+		h.rooms[p.roomID] = peers
+	}
+	old := peers[p.userID]
+	peers[p.userID] = p
+	h.mutex.Unlock()
+	if old != nil {
+		h.removePeer(old)
+	}
+
+	p.pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate != nil {
+			h.signal(p, signalCandidate, candidate.ToJSON())
+		}
+	})
+	// channels opened by the member carry its messages to its followers
+	p.pc.OnDataChannel(func(channel *webrtc.DataChannel) {
+		channel.OnMessage(func(msg webrtc.DataChannelMessage) {
+			h.relay(p, msg)
+		})
+	})
+	go func() {
+		<-p.done
+		h.removePeer(p)
+	}()
+}
+
+// join opens the channels between p and the members following it or followed by it.
+func (h *dataHub) join(p *dataPeer) {
+	type opening struct {
+		on    *dataPeer
+		label string
+		link  *dataLink
+	}
+	var links []opening
+	h.mutex.Lock()
+	if p.removed {
+		h.mutex.Unlock()
+		return
+	}
+	p.joined = true
+	for _, other := range h.rooms[p.roomID] {
+		if !other.joined {
+			continue // links the pair when it joins
+		}
+		if other.follows(p) {
+			link := &dataLink{}
+			other.links[p.userID] = link
+			links = append(links, opening{other, p.userID, link})
+		}
+		if p.follows(other) {
+			link := &dataLink{}
+			p.links[other.userID] = link
+			links = append(links, opening{p, other.userID, link})
+		}
+	}
+	h.mutex.Unlock()
+	for _, l := range links {
+		h.open(l.on, l.label, l.link)
+	}
+	log.Printf("[%s] %s joined the SFU data channels, %d channels opened\n", p.roomID, p.userID, len(links))
+}
+
+// open creates the channel of link on the peer connection of p, labelled with the relayed member.
+func (h *dataHub) open(p *dataPeer, label string, link *dataLink) {
+	channel, err := p.pc.CreateDataChannel(label, nil)
+	if err != nil {
+		log.Printf("[%s] failed to open data channel %s to %s: %v\n", p.roomID, label, p.userID, err)
+		return
+	}
+	link.mutex.Lock()
+	link.channel = channel
+	link.mutex.Unlock()
+	channel.OnOpen(func() {
+		link.mutex.Lock()
+		defer link.mutex.Unlock()
+		link.open = true
+		for _, msg := range link.pending {
+			link.write(msg)
+		}
+		link.pending = nil
+	})
+	// what p writes to the channel of a member goes back to that member
+	channel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		h.reply(p, label, msg)
+	})
+}
+
+// relay sends a message of from to the members following it.
+func (h *dataHub) relay(from *dataPeer, msg webrtc.DataChannelMessage) {
+	h.mutex.Lock()
+	var links []*dataLink
+	for _, to := range h.rooms[from.roomID] {
+		if link := to.links[from.userID]; link != nil && to.follows(from) {
+			links = append(links, link)
+		}
+	}
+	h.mutex.Unlock()
+	for _, link := range links {
+		sfuDataMessagesTotal.WithLabelValues(routeBroadcast, link.send(msg)).Inc()
+	}
+}
+
+// reply sends a message p wrote to the channel of userID back to userID.
+func (h *dataHub) reply(p *dataPeer, userID string, msg webrtc.DataChannelMessage) {
+	h.mutex.Lock()
+	var link *dataLink
+	if to := h.rooms[p.roomID][userID]; to != nil && !to.removed {
+		link = to.links[p.userID]
+	}
+	h.mutex.Unlock()
+	if link == nil {
+		sfuDataMessagesTotal.WithLabelValues(routeDirect, dto.AckNotInRoom).Inc()
+		return
+	}
+	sfuDataMessagesTotal.WithLabelValues(routeDirect, link.send(msg)).Inc()
+}
+
+// send writes msg to the channel, queued until it opens, and returns the outcome for the metrics.
+func (l *dataLink) send(msg webrtc.DataChannelMessage) string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.open {
+		if len(l.pending) >= dataPendingLimit {
+			return dto.AckFailed
+		}
+		l.pending = append(l.pending, msg)
+		return dto.AckQueued
+	}
+	if l.channel.BufferedAmount() > dataBufferLimit {
+		return dto.AckFailed
+	}
+	return l.write(msg)
+}
+
+// write sends msg as received, text or binary. Caller holds l.mutex.
+func (l *dataLink) write(msg webrtc.DataChannelMessage) string {
+	var err error
+	if msg.IsString {
+		err = l.channel.SendText(string(msg.Data))
+	} else {
+		err = l.channel.Send(msg.Data)
+	}
+	if err != nil {
+		return dto.AckFailed
+	}
+	return dto.AckDelivered
+}
+
+// removePeer closes the channels opened for p on the other members and the peer connection of p.
+func (h *dataHub) removePeer(p *dataPeer) {
+	h.mutex.Lock()
+	if p.removed {
+		h.mutex.Unlock()
+		return
+	}
+	p.removed = true
+	peers := h.rooms[p.roomID]
+	if peers[p.userID] == p {
+		delete(peers, p.userID)
+		if len(peers) == 0 {
+			delete(h.rooms, p.roomID)
+		}
+	}
+	var links []*dataLink
+	for _, other := range peers {
+		if link := other.links[p.userID]; link != nil {
+			delete(other.links, p.userID)
+			links = append(links, link)
+		}
+	}
+	h.mutex.Unlock()
+
+	// the followers see the channel of p close
+	for _, link := range links {
+		link.mutex.Lock()
+		if link.channel != nil {
+			_ = link.channel.Close()
+		}
+		link.mutex.Unlock()
+	}
+	if err := p.pc.Close(); err != nil {
+		log.Println("Failed to close peer connection:", err)
+	}
+	log.Printf("[%s] %s left the SFU data channels\n", p.roomID, p.userID)
+}
+
+// removeMember removes the data peer of userID, e.g. when the member left the room.
+func (h *dataHub) removeMember(roomID, userID string) {
+	h.mutex.Lock()
+	p := h.rooms[roomID][userID]
+	h.mutex.Unlock()
+	if p != nil {
+		h.removePeer(p)
+	}
+}
+
+// closeRoom removes every data peer of roomID.
+func (h *dataHub) closeRoom(roomID string) {
+	h.mutex.Lock()
+	peers := make([]*dataPeer, 0, len(h.rooms[roomID]))
+	for _, p := range h.rooms[roomID] {
+		peers = append(peers, p)
+	}
+	h.mutex.Unlock()
+	for _, p := range peers {
+		h.removePeer(p)
+	}
+}
+
+// answer applies an offer of the member, the first one or a renegotiation of its own.
+func (h *dataHub) answer(p *dataPeer, offer webrtc.SessionDescription) error {
+	p.negotiation.Lock()
+	if err := p.pc.SetRemoteDescription(offer); err != nil {
+		p.negotiation.Unlock()
+		return errors.Wrap(ErrInvalidOffer, err.Error())
+	}
+	for _, candidate := range p.candidates {
+		if err := p.pc.AddICECandidate(candidate); err != nil {
+			log.Println("Failed to add ICE candidate:", err)
+		}
+	}
+	p.candidates = nil
+	answer, err := p.pc.CreateAnswer(nil)
+	if err == nil {
+		err = p.pc.SetLocalDescription(answer)
+	}
+	p.negotiation.Unlock()
+	if err != nil {
+		return err
+	}
+	h.signal(p, answer.Type.String(), p.pc.LocalDescription())
+	return nil
+}
+
+// signal sends an SFU data message to the member behind p, from the "sfu" member.
+func (h *dataHub) signal(p *dataPeer, kind string, value interface{}) {
+	data, err := sfuMessage(p.roomID, p.userID, dto.ChannelDataRtc, kind, value)
+	if err != nil {
+		log.Println("JSON encoding error:", err)
+		return
+	}
+	if !h.send(p.roomID, p.userID, data) {
+		log.Printf("[%s] failed to send SFU data %s to %s\n", p.roomID, kind, p.userID)
+	}
+}
@@ -0,0 +1,32 @@
+package service
+
+import "testing"
+
+func TestDataPeerFollows(t *testing.T) {
+	peer := func(userID, publisher string) *dataPeer {
+		return &dataPeer{roomID: "r", userID: userID, publisher: publisher, joined: true}
+	}
+	self := peer("gcs", "")
+	tests := []struct {
+		name     string
+		to, from *dataPeer
+		want     bool
+	}{
+		{"everyone follows everyone", peer("gcs", ""), peer("uav1", ""), true},
+		{"not itself", self, self, false},
+		{"follower of the sender", peer("gcs", "uav1"), peer("uav1", ""), true},
+		{"follower of another member", peer("gcs", "uav2"), peer("uav1", ""), false},
+		{"sender talking to the receiver only", peer("gcs", ""), peer("uav1", "gcs"), true},
+		{"sender talking to another member", peer("viewer", ""), peer("uav1", "gcs"), false},
+		{"pair following each other", peer("gcs", "uav1"), peer("uav1", "gcs"), true},
+		{"receiver not joined yet", &dataPeer{userID: "gcs"}, peer("uav1", ""), false},
+		{"receiver removed", &dataPeer{userID: "gcs", joined: true, removed: true}, peer("uav1", ""), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.to.follows(tt.from); got != tt.want {
+				t.Errorf("%s follows %s = %v, want %v", tt.to.userID, tt.from.userID, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// keyframeMinInterval rate limits the keyframe requests forwarded to a publisher, every subscriber
+	// asks for one after a loss and the publisher only needs to send a single keyframe for all of them
+	keyframeMinInterval = 500 * time.Millisecond
+	// reportInterval is how often the aggregated receiver report of a track is sent to its publisher
+	reportInterval = time.Second
+)
+
+// trackFeedback is the upstream RTCP state of a published track: the latest reception report of its
+// subscribers with the layer it is about, aggregated into one report per layer for the publisher.
+type trackFeedback struct {
+	mutex   sync.Mutex
+	firSeq  uint8
+	reports map[*sfuPeer]layerReport
+}
+
+type layerReport struct {
+	rid    string
+	report rtcp.ReceptionReport
+}
+
+func newTrackFeedback() *trackFeedback {
+	return &trackFeedback{reports: make(map[*sfuPeer]layerReport)}
+}
+
+// requestKeyframe asks the publisher for a keyframe of layer, as a FIR when fir is set and a PLI otherwise.
+// Requests closer than keyframeMinInterval to the previous one are dropped, the pending keyframe serves them too.
+func (track *sfuTrack) requestKeyframe(layer *sfuLayer, fir bool) {
+	if track.kind != webrtc.RTPCodecTypeVideo {
+		return
+	}
+	layer.mutex.Lock()
+	if time.Since(layer.lastKeyframe) < keyframeMinInterval {
+		layer.mutex.Unlock()
+		sfuKeyframeRequestsTotal.WithLabelValues("throttled").Inc()
+		return
+	}
+	layer.lastKeyframe = time.Now()
+	layer.mutex.Unlock()
+
+	ssrc := uint32(layer.remote.SSRC())
+	var packet rtcp.Packet = &rtcp.PictureLossIndication{MediaSSRC: ssrc}
+	if fir {
+		track.feedback.mutex.Lock()
+		track.feedback.firSeq++
+		seq := track.feedback.firSeq
+		track.feedback.mutex.Unlock()
+		packet = &rtcp.FullIntraRequest{MediaSSRC: ssrc, FIR: []rtcp.FIREntry{{SSRC: ssrc, SequenceNumber: seq}}}
+	}
+	if err := track.owner.pc.WriteRTCP([]rtcp.Packet{packet}); err != nil {
+		log.Println("Failed to request keyframe:", err)
+		return
+	}
+	sfuKeyframeRequestsTotal.WithLabelValues("forwarded").Inc()
+}
+
+// layer returns the layer rid of the track, nil once it is gone.
+func (track *sfuTrack) layer(rid string) *sfuLayer {
+	track.mutex.RLock()
+	defer track.mutex.RUnlock()
+	return track.layers[rid]
+}
+
+// readRTCP handles the RTCP a subscriber sends for its down track until the sender is removed: keyframe
+// requests go upstream to the layer it receives, reception reports are kept for the aggregated report.
+// The first packet means the subscriber's transport is up, it gets a keyframe right away.
+func (r *sfuRouter) readRTCP(dt *downTrack) {
+	track, f := dt.track, dt.track.feedback
+	defer func() {
+		f.mutex.Lock()
+		delete(f.reports, dt.sub)
+		f.mutex.Unlock()
+	}()
+	first := true
+	for {
+		packets, _, err := dt.sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		rid := dt.feedbackLayer()
+		layer := track.layer(rid)
+		if layer == nil {
+			continue
+		}
+		if first {
+			first = false
+			track.requestKeyframe(layer, false)
+		}
+		for _, packet := range packets {
+			switch p := packet.(type) {
+			case *rtcp.PictureLossIndication:
+				track.requestKeyframe(layer, false)
+			case *rtcp.FullIntraRequest:
+				track.requestKeyframe(layer, true)
+			case *rtcp.ReceiverReport:
+				for _, report := range p.Reports {
+					f.mutex.Lock()
+					f.reports[dt.sub] = layerReport{rid: rid, report: report}
+					f.mutex.Unlock()
+				}
+			}
+		}
+	}
+}
+
+// sendReports sends the aggregated receiver reports of track to its publisher every reportInterval until
+// it is unpublished, the publisher adapts to the worst subscriber of each layer.
+func (track *sfuTrack) sendReports() {
+	ticker := time.NewTicker(reportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-track.done:
+			return
+		}
+		var reports []rtcp.ReceptionReport
+		for rid, report := range track.feedback.aggregate() {
+			if layer := track.layer(rid); layer != nil {
+				reports = append(reports, layer.rescale(report))
+			}
+		}
+		if len(reports) == 0 {
+			continue
+		}
+		if err := track.owner.pc.WriteRTCP([]rtcp.Packet{&rtcp.ReceiverReport{Reports: reports}}); err != nil {
+			log.Println("Failed to send receiver report:", err)
+		}
+	}
+}
+
+// aggregate merges the reports received since the last call per layer: the worst fraction lost, the
+// highest jitter and the most packets lost of the subscribers.
+func (f *trackFeedback) aggregate() map[string]rtcp.ReceptionReport {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	merged := make(map[string]rtcp.ReceptionReport)
+	for sub, received := range f.reports {
+		report, m := received.report, merged[received.rid]
+		m.FractionLost = max(m.FractionLost, report.FractionLost)
+		m.TotalLost = max(m.TotalLost, report.TotalLost)
+		m.Jitter = max(m.Jitter, report.Jitter)
+		merged[received.rid] = m
+		delete(f.reports, sub)
+	}
+	return merged
+}
+
+// rescale addresses an aggregated report to the layer: its SSRC and the highest sequence number the SFU
+// received of it, the subscribers counted theirs in the rewritten sequence space of their down tracks.
+func (l *sfuLayer) rescale(report rtcp.ReceptionReport) rtcp.ReceptionReport {
+	report.SSRC = uint32(l.remote.SSRC())
+	report.LastSequenceNumber = l.highestSeq.Load()
+	return report
+}
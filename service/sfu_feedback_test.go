@@ -0,0 +1,85 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/pion/rtcp"
+)
+
+func TestAggregateKeepsTheWorstSubscriberOfEachLayer(t *testing.T) {
+	tests := []struct {
+		name    string
+		reports []layerReport
+		want    map[string]rtcp.ReceptionReport
+	}{
+		{"no reports", nil, map[string]rtcp.ReceptionReport{}},
+		{
+			"one subscriber",
+			[]layerReport{{rid: "", report: rtcp.ReceptionReport{SSRC: 7, FractionLost: 12, TotalLost: 40, Jitter: 90, LastSequenceNumber: 500}}},
+			map[string]rtcp.ReceptionReport{"": {FractionLost: 12, TotalLost: 40, Jitter: 90}},
+		},
+		{
+			"worst loss and jitter of different subscribers",
+			[]layerReport{
+				{rid: "h", report: rtcp.ReceptionReport{FractionLost: 30, TotalLost: 5, Jitter: 10}},
+				{rid: "h", report: rtcp.ReceptionReport{FractionLost: 2, TotalLost: 80, Jitter: 400}},
+				{rid: "h", report: rtcp.ReceptionReport{}},
+			},
+			map[string]rtcp.ReceptionReport{"h": {FractionLost: 30, TotalLost: 80, Jitter: 400}},
+		},
+		{
+			"layers apart",
+			[]layerReport{
+				{rid: "h", report: rtcp.ReceptionReport{FractionLost: 50, Jitter: 20}},
+				{rid: "l", report: rtcp.ReceptionReport{FractionLost: 1, Jitter: 300}},
+			},
+			map[string]rtcp.ReceptionReport{"h": {FractionLost: 50, Jitter: 20}, "l": {FractionLost: 1, Jitter: 300}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTrackFeedback()
+			for _, report := range tt.reports {
+				f.reports[&sfuPeer{}] = report
+			}
+			got := f.aggregate()
+			if len(got) != len(tt.want) {
+				t.Fatalf("aggregate() = %+v, want %+v", got, tt.want)
+			}
+			for rid, want := range tt.want {
+				if got[rid] != want {
+					t.Errorf("aggregate()[%q] = %+v, want %+v", rid, got[rid], want)
+				}
+			}
+			if again := f.aggregate(); len(again) != 0 {
+				t.Errorf("second aggregate() = %+v, want the reports consumed", again)
+			}
+		})
+	}
+}
+
+func TestLayerExtendsTheHighestSequenceNumber(t *testing.T) {
+	tests := []struct {
+		name string
+		seqs []uint16
+		want uint32
+	}{
+		{"in order", []uint16{10, 11, 12}, 12},
+		{"reordered", []uint16{10, 12, 11}, 12},
+		{"duplicate", []uint16{10, 10}, 10},
+		{"wraps", []uint16{65534, 65535, 0, 1}, 1<<16 | 1},
+		{"reordered across the wrap", []uint16{65535, 1, 0}, 1<<16 | 1},
+		{"late packet before the wrap", []uint16{1, 65535}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &sfuLayer{}
+			for _, seq := range tt.seqs {
+				l.received(seq)
+			}
+			if got := l.highestSeq.Load(); got != tt.want {
+				t.Errorf("highest sequence number = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
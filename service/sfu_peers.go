@@ -0,0 +1,123 @@
+package service
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// disconnectGrace is how long a disconnected peer connection may take to recover before it is torn down,
+// ICE often reconnects on its own when a UAV switches cells
+const disconnectGrace = 10 * time.Second
+
+// peerRegistry keeps the SFU peer connections created by CallBroadcast so a shutdown can close them.
+// Each connection gets a done channel, closed once the connection is over, that stops its goroutines.
+type peerRegistry struct {
+	mutex    sync.Mutex
+	conns    map[*webrtc.PeerConnection]*registeredPeer
+	draining bool
+}
+
+type registeredPeer struct {
+	done     chan struct{}
+	grace    *time.Timer // running while the connection is disconnected
+	handlers []func(webrtc.PeerConnectionState)
+}
+
+func newPeerRegistry() *peerRegistry {
+	return &peerRegistry{conns: make(map[*webrtc.PeerConnection]*registeredPeer)}
+}
+
+// add registers pc and returns its done channel, false when the server is shutting down (pc is closed).
+func (r *peerRegistry) add(pc *webrtc.PeerConnection) (<-chan struct{}, bool) {
+	r.mutex.Lock()
+	if r.draining {
+		r.mutex.Unlock()
+		_ = pc.Close()
+		return nil, false
+	}
+	peer := &registeredPeer{done: make(chan struct{})}
+	r.conns[pc] = peer
+	r.mutex.Unlock()
+
+	// the registry owns the single state handler of pc, others register with onStateChange
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		r.stateChanged(pc, state)
+	})
+	return peer.done, true
+}
+
+// onStateChange registers handler for the connection state changes of pc, after the ones registered before.
+func (r *peerRegistry) onStateChange(pc *webrtc.PeerConnection, handler func(webrtc.PeerConnectionState)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if peer, exists := r.conns[pc]; exists {
+		peer.handlers = append(peer.handlers, handler)
+	}
+}
+
+// stateChanged runs the handlers of pc and removes it once it failed or closed, or stayed disconnected
+// for disconnectGrace.
+func (r *peerRegistry) stateChanged(pc *webrtc.PeerConnection, state webrtc.PeerConnectionState) {
+	log.Println("Connection state changed:", state)
+	r.mutex.Lock()
+	peer, exists := r.conns[pc]
+	var handlers []func(webrtc.PeerConnectionState)
+	if exists {
+		handlers = append(handlers, peer.handlers...)
+		switch state {
+		case webrtc.PeerConnectionStateDisconnected:
+			if peer.grace == nil {
+				peer.grace = time.AfterFunc(disconnectGrace, func() {
+					log.Printf("peer connection still disconnected after %s, closing it\n", disconnectGrace)
+					r.remove(pc)
+				})
+			}
+		case webrtc.PeerConnectionStateConnected:
+			if peer.grace != nil {
+				peer.grace.Stop()
+				peer.grace = nil
+			}
+		}
+	}
+	r.mutex.Unlock()
+	for _, handler := range handlers {
+		handler(state)
+	}
+	if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
+		r.remove(pc)
+	}
+}
+
+// remove forgets pc and stops its goroutines (PLI sender, subscriber waiting for a publisher).
+func (r *peerRegistry) remove(pc *webrtc.PeerConnection) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if peer, exists := r.conns[pc]; exists {
+		if peer.grace != nil {
+			peer.grace.Stop()
+		}
+		close(peer.done)
+		delete(r.conns, pc)
+	}
+}
+
+// closeAll refuses new peer connections and closes the registered ones.
+func (r *peerRegistry) closeAll() {
+	r.mutex.Lock()
+	r.draining = true
+	conns := make([]*webrtc.PeerConnection, 0, len(r.conns))
+	for pc := range r.conns {
+		conns = append(conns, pc)
+	}
+	r.mutex.Unlock()
+	for _, pc := range conns {
+		if err := pc.Close(); err != nil {
+			log.Println("Failed to close peer connection:", err)
+		}
+		r.remove(pc) // the state change handler runs asynchronously, stop the goroutines now
+	}
+	log.Printf("closed %d SFU peer connections\n", len(conns))
+}
@@ -0,0 +1,599 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pkg/errors"
+	"go-rest-api/config"
+	"go-rest-api/dto"
+)
+
+// sfuSignal types besides offers and answers, which use the SDP type
+const (
+	signalCandidate = "candidate"
+	signalLayer     = "layer"
+)
+
+// sfuSignal is the payload of SFU signaling, the same base64 JSON the clients exchange peer to peer:
+// {"type":"offer|answer","sdp":{"type":..,"sdp":..}} or {"type":"candidate","sdp":{"candidate":..}}.
+// {"type":"layer","publisher":..,"rid":..} picks the simulcast layer received from a publisher.
+type sfuSignal struct {
+	Type      string          `json:"type"`
+	Sdp       json.RawMessage `json:"sdp,omitempty"`
+	Publisher string          `json:"publisher,omitempty"`
+	Rid       string          `json:"rid,omitempty"`
+}
+
+// sfuRouter forwards the tracks published in a room to the other peers of the same room.
+// Every subscriber of a track gets its own down track, fed from the simulcast layer picked for it.
+// Peers are websocket members talking to the "sfu" member, WHIP/WHEP resources and CallBroadcast callers.
+type sfuRouter struct {
+	mutex sync.Mutex
+	rooms map[string]map[string]*sfuPeer // roomId -> (peer key -> peer)
+
+	// send delivers a server message to a member's websocket
+	send func(roomID, userID string, data []byte) bool
+	// newPeerConnection creates a registered peer connection, its bandwidth estimator and done channel
+	newPeerConnection func() (*webrtc.PeerConnection, cc.BandwidthEstimator, <-chan struct{}, error)
+	// onPublish is called with every new track, once it is forwarded to the subscribers
+	onPublish func(track *sfuTrack)
+}
+
+// sfuPeer is one peer connection of the SFU.
+type sfuPeer struct {
+	key       string // userId for websocket members, resource ID otherwise
+	roomID    string
+	userID    string
+	pc        *webrtc.PeerConnection
+	estimator cc.BandwidthEstimator // of what the SFU sends to the peer, nil if unavailable
+	done      <-chan struct{}
+	subscribe bool   // receives the tracks published in the room
+	publisher string // with subscribe: only the tracks of this publisher, "" for all
+	signaling bool   // websocket member, tracks added later are negotiated with a server offer
+
+	// guarded by sfuRouter.mutex
+	tracks     map[*webrtc.RTPReceiver]*sfuTrack // published by this peer, simulcast layers share the receiver
+	downTracks map[*sfuTrack]*downTrack
+	removed    bool
+
+	negotiation sync.Mutex                // serializes offer/answer on pc
+	pending     bool                      // a server offer is due once the current exchange completes
+	candidates  []webrtc.ICECandidateInit // received before the remote description
+}
+
+// sfuTrack is a published track with its layers and the down tracks of its subscribers.
+type sfuTrack struct {
+	id       string // of the local tracks, unique per publisher
+	owner    *sfuPeer
+	receiver *webrtc.RTPReceiver
+	kind     webrtc.RTPCodecType
+	codec    webrtc.RTPCodecCapability
+	feedback *trackFeedback
+	done     chan struct{} // closed once unpublished
+
+	mutex      sync.RWMutex
+	layers     map[string]*sfuLayer // rid -> layer, "" without simulcast
+	downTracks map[*sfuPeer]*downTrack
+	sinks      map[*downTrack]media.Writer // consumers outside the peer connections, e.g. recordings
+}
+
+func newSfuRouter(send func(string, string, []byte) bool,
+	newPeerConnection func() (*webrtc.PeerConnection, cc.BandwidthEstimator, <-chan struct{}, error)) *sfuRouter {
+	return &sfuRouter{
+		rooms:             make(map[string]map[string]*sfuPeer),
+		send:              send,
+		newPeerConnection: newPeerConnection,
+	}
+}
+
+// addPeer registers p in its room, the tracks it publishes are forwarded from now on.
+// It is removed with its tracks once its peer connection is done.
+func (r *sfuRouter) addPeer(p *sfuPeer) {
+	p.tracks = make(map[*webrtc.RTPReceiver]*sfuTrack)
+	p.downTracks = make(map[*sfuTrack]*downTrack)
+	r.mutex.Lock()
+	peers, exists := r.rooms[p.roomID]
+	if !exists {
+		peers = make(map[string]*sfuPeer)
+		r.rooms[p.roomID] = peers
+	}
+	old := peers[p.key]
+	peers[p.key] = p
+	r.mutex.Unlock()
+	if old != nil {
+		r.removePeer(old)
+	}
+
+	p.pc.OnTrack(func(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		r.publish(p, remote, receiver)
+	})
+	if p.signaling {
+		p.pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+			if candidate != nil {
+				r.signal(p, signalCandidate, candidate.ToJSON())
+			}
+		})
+	}
+	if p.subscribe && p.estimator != nil {
+		go r.allocate(p)
+	}
+	go func() {
+		<-p.done
+		r.removePeer(p)
+	}()
+}
+
+// removePeer unpublishes the tracks of p from every subscriber and closes its peer connection.
+// Subscribers are renegotiated before this returns, so a leaving publisher never leaves dead tracks behind.
+func (r *sfuRouter) removePeer(p *sfuPeer) {
+	r.mutex.Lock()
+	if p.removed {
+		r.mutex.Unlock()
+		return
+	}
+	p.removed = true
+	peers := r.rooms[p.roomID]
+	if peers[p.key] == p {
+		delete(peers, p.key)
+		if len(peers) == 0 {
+			delete(r.rooms, p.roomID)
+		}
+	}
+	tracks := make([]*sfuTrack, 0, len(p.tracks))
+	for _, track := range p.tracks {
+		tracks = append(tracks, track)
+	}
+	for track := range p.downTracks {
+		track.mutex.Lock()
+		delete(track.downTracks, p)
+		track.mutex.Unlock()
+	}
+	r.mutex.Unlock()
+
+	for _, track := range tracks {
+		r.unpublish(track)
+	}
+	if err := p.pc.Close(); err != nil {
+		log.Println("Failed to close peer connection:", err)
+	}
+	log.Printf("[%s] %s left the SFU\n", p.roomID, p.userID)
+}
+
+// removeMember removes the websocket peer of userID, e.g. when the member left the room.
+func (r *sfuRouter) removeMember(roomID, userID string) {
+	r.mutex.Lock()
+	p := r.rooms[roomID][userID]
+	r.mutex.Unlock()
+	if p != nil && p.signaling {
+		r.removePeer(p)
+	}
+}
+
+// closeRoom removes every peer of roomID.
+func (r *sfuRouter) closeRoom(roomID string) {
+	r.mutex.Lock()
+	peers := make([]*sfuPeer, 0, len(r.rooms[roomID]))
+	for _, p := range r.rooms[roomID] {
+		peers = append(peers, p)
+	}
+	r.mutex.Unlock()
+	for _, p := range peers {
+		r.removePeer(p)
+	}
+}
+
+// publish forwards remote to the subscribers of the room until the publisher stops sending.
+// It runs on the OnTrack goroutine of the publisher, once per layer of a simulcast track.
+func (r *sfuRouter) publish(owner *sfuPeer, remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	r.mutex.Lock()
+	if owner.removed {
+		r.mutex.Unlock()
+		return
+	}
+	track, exists := owner.tracks[receiver]
+	var subscribers []*sfuPeer
+	if !exists {
+		track = &sfuTrack{
+			id:         fmt.Sprintf("%s-%s", remote.Kind(), remote.ID()),
+			owner:      owner,
+			receiver:   receiver,
+			kind:       remote.Kind(),
+			codec:      remote.Codec().RTPCodecCapability,
+			feedback:   newTrackFeedback(),
+			done:       make(chan struct{}),
+			layers:     make(map[string]*sfuLayer),
+			downTracks: make(map[*sfuPeer]*downTrack),
+			sinks:      make(map[*downTrack]media.Writer),
+		}
+		owner.tracks[receiver] = track
+		subscribers = r.subscribersOf(track)
+	}
+	r.mutex.Unlock()
+	layer := track.addLayer(remote)
+
+	if !exists {
+		sfuTracksTotal.WithLabelValues("published", remote.Kind().String()).Inc()
+		log.Printf("[%s] %s published %s track %s to %d subscribers\n", owner.roomID, owner.userID, remote.Kind(), remote.ID(), len(subscribers))
+		for _, sub := range subscribers {
+			if r.attach(sub, track) {
+				go r.negotiate(sub)
+			}
+		}
+		go track.sendReports()
+		go track.measureLayers()
+		if r.onPublish != nil {
+			r.onPublish(track)
+		}
+	} else {
+		log.Printf("[%s] %s added layer %q to track %s\n", owner.roomID, owner.userID, layer.rid, remote.ID())
+	}
+
+	for {
+		packet, _, err := remote.ReadRTP()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Println("Error occurred", err)
+			}
+			break
+		}
+		track.forward(layer, packet)
+	}
+	if track.removeLayer(layer) == 0 {
+		r.unpublish(track)
+	}
+}
+
+// unpublish removes track from its subscribers and renegotiates them, its sinks are closed.
+func (r *sfuRouter) unpublish(track *sfuTrack) {
+	var detached []*downTrack
+	var sinks []media.Writer
+	r.mutex.Lock()
+	if track.owner.tracks[track.receiver] != track {
+		r.mutex.Unlock()
+		return
+	}
+	delete(track.owner.tracks, track.receiver)
+	close(track.done)
+	track.mutex.Lock()
+	for sub, dt := range track.downTracks {
+		delete(sub.downTracks, track)
+		detached = append(detached, dt)
+	}
+	track.downTracks = make(map[*sfuPeer]*downTrack)
+	for _, sink := range track.sinks {
+		sinks = append(sinks, sink)
+	}
+	track.sinks = make(map[*downTrack]media.Writer)
+	track.mutex.Unlock()
+	r.mutex.Unlock()
+
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil {
+			log.Println("Failed to close track sink:", err)
+		}
+	}
+
+	for _, dt := range detached {
+		if err := dt.sub.pc.RemoveTrack(dt.sender); err != nil {
+			log.Println("Failed to remove track:", err)
+			continue
+		}
+		if dt.sub.signaling {
+			go r.negotiate(dt.sub)
+		}
+	}
+}
+
+// subscribersOf returns the peers to renegotiate with track. Caller holds the lock.
+// WHEP and CallBroadcast subscribers cannot renegotiate, they keep the tracks of their answer.
+func (r *sfuRouter) subscribersOf(track *sfuTrack) []*sfuPeer {
+	var subscribers []*sfuPeer
+	for _, p := range r.rooms[track.owner.roomID] {
+		if p.signaling && p.wants(track) {
+			subscribers = append(subscribers, p)
+		}
+	}
+	return subscribers
+}
+
+// wants tells whether p subscribes to track. Caller holds the router lock.
+func (p *sfuPeer) wants(track *sfuTrack) bool {
+	if !p.subscribe || p.removed || track.owner.userID == p.userID {
+		return false
+	}
+	if _, attached := p.downTracks[track]; attached {
+		return false
+	}
+	return p.publisher == "" || p.publisher == track.owner.userID
+}
+
+// subscribeExisting attaches the tracks already published in the room to p and returns how many.
+func (r *sfuRouter) subscribeExisting(p *sfuPeer) int {
+	r.mutex.Lock()
+	var tracks []*sfuTrack
+	for _, owner := range r.rooms[p.roomID] {
+		for _, track := range owner.tracks {
+			if p.wants(track) {
+				tracks = append(tracks, track)
+			}
+		}
+	}
+	r.mutex.Unlock()
+	attached := 0
+	for _, track := range tracks {
+		if r.attach(p, track) {
+			attached++
+		}
+	}
+	return attached
+}
+
+// attach adds a down track of track to the peer connection of sub.
+func (r *sfuRouter) attach(sub *sfuPeer, track *sfuTrack) bool {
+	// stream ID is the publisher so a subscriber can group the audio and video of one user
+	local, err := webrtc.NewTrackLocalStaticRTP(track.codec, track.id, track.owner.userID)
+	if err != nil {
+		log.Println("Error occurred", err)
+		return false
+	}
+	sender, err := sub.pc.AddTrack(local)
+	if err != nil {
+		log.Println("Error adding track", err)
+		return false
+	}
+	dt := &downTrack{sub: sub, track: track, local: local, sender: sender}
+	r.mutex.Lock()
+	live := !sub.removed && track.owner.tracks[track.receiver] == track
+	if live {
+		sub.downTracks[track] = dt
+		track.mutex.Lock()
+		track.downTracks[sub] = dt
+		track.mutex.Unlock()
+	}
+	r.mutex.Unlock()
+	if !live {
+		// unpublished or unsubscribed meanwhile
+		_ = sub.pc.RemoveTrack(sender)
+		return false
+	}
+	go r.readRTCP(dt)
+	track.selectLayers() // picks the layer and asks it for a keyframe
+	sfuTracksTotal.WithLabelValues("subscribed", track.kind.String()).Inc()
+	return true
+}
+
+// hasTracks tells whether publisherID (any publisher when empty) has a track in roomID.
+func (r *sfuRouter) hasTracks(roomID, publisherID string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, p := range r.rooms[roomID] {
+		if len(p.tracks) > 0 && (publisherID == "" || p.userID == publisherID) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPeer tells whether userID has a peer connection in roomID.
+func (r *sfuRouter) hasPeer(roomID, userID string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, p := range r.rooms[roomID] {
+		if p.userID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// handleSignal applies a message a websocket member sent to the "sfu" member.
+// The first offer creates the member's SFU peer connection, which publishes its tracks and
+// subscribes to the tracks of the room.
+func (r *sfuRouter) handleSignal(roomID, userID, payload string) error {
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		data = []byte(payload)
+	}
+	var signal sfuSignal
+	if err := json.Unmarshal(data, &signal); err != nil {
+		return errors.Wrap(err, "invalid SFU signal")
+	}
+
+	if signal.Type == signalLayer {
+		return r.setLayer(roomID, userID, signal.Publisher, signal.Rid)
+	}
+	r.mutex.Lock()
+	p := r.rooms[roomID][userID]
+	r.mutex.Unlock()
+	created := false
+	if p == nil || !p.signaling {
+		if signal.Type != webrtc.SDPTypeOffer.String() {
+			return errors.New("no SFU session, send an offer first")
+		}
+		pc, estimator, done, err := r.newPeerConnection()
+		if err != nil {
+			return err
+		}
+		p = &sfuPeer{key: userID, roomID: roomID, userID: userID, pc: pc, estimator: estimator, done: done, subscribe: true, signaling: true}
+		r.addPeer(p)
+		created = true
+		sfuPeerConnectionsTotal.WithLabelValues("member", "ok").Inc()
+	}
+
+	switch signal.Type {
+	case webrtc.SDPTypeOffer.String():
+		var offer webrtc.SessionDescription
+		if err := json.Unmarshal(signal.Sdp, &offer); err != nil {
+			return errors.Wrap(err, "invalid offer")
+		}
+		if err := r.answer(p, offer); err != nil {
+			if created {
+				r.removePeer(p)
+			}
+			return err
+		}
+		if created && r.subscribeExisting(p) > 0 {
+			r.negotiate(p)
+		}
+	case webrtc.SDPTypeAnswer.String():
+		var answer webrtc.SessionDescription
+		if err := json.Unmarshal(signal.Sdp, &answer); err != nil {
+			return errors.Wrap(err, "invalid answer")
+		}
+		p.negotiation.Lock()
+		err := p.pc.SetRemoteDescription(answer)
+		p.flushCandidates()
+		pending := p.pending
+		p.pending = false
+		p.negotiation.Unlock()
+		if err != nil {
+			return err
+		}
+		if pending {
+			r.negotiate(p)
+		}
+	case signalCandidate:
+		var candidate webrtc.ICECandidateInit
+		if err := json.Unmarshal(signal.Sdp, &candidate); err != nil {
+			return errors.Wrap(err, "invalid candidate")
+		}
+		p.negotiation.Lock()
+		defer p.negotiation.Unlock()
+		if p.pc.RemoteDescription() == nil {
+			p.candidates = append(p.candidates, candidate)
+			return nil
+		}
+		return p.pc.AddICECandidate(candidate)
+	default:
+		return errors.Errorf("unknown SFU signal %q", signal.Type)
+	}
+	return nil
+}
+
+// setLayer pins the member to the simulcast layer rid of publisherID (of every publisher when empty),
+// an empty rid goes back to the best layer.
+func (r *sfuRouter) setLayer(roomID, userID, publisherID, rid string) error {
+	r.mutex.Lock()
+	p := r.rooms[roomID][userID]
+	var tracks []*sfuTrack
+	if p != nil && p.signaling {
+		for track := range p.downTracks {
+			if publisherID == "" || track.owner.userID == publisherID {
+				tracks = append(tracks, track)
+			}
+		}
+	}
+	r.mutex.Unlock()
+	if p == nil || !p.signaling {
+		return errors.New("no SFU session, send an offer first")
+	}
+	for _, track := range tracks {
+		track.setPreferredLayer(p, rid)
+	}
+	log.Printf("[%s] %s prefers layer %q of %d tracks\n", roomID, userID, rid, len(tracks))
+	return nil
+}
+
+// answer applies a member's offer. The server yields on glare: its own pending offer is rolled back
+// and sent again once the member's offer is answered.
+func (r *sfuRouter) answer(p *sfuPeer, offer webrtc.SessionDescription) error {
+	p.negotiation.Lock()
+	if p.pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		if err := p.pc.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}); err != nil {
+			p.negotiation.Unlock()
+			return err
+		}
+		p.pending = true
+	}
+	offer.SDP = config.AppConfig.Codecs.CompleteOffer(offer.SDP)
+	if err := p.pc.SetRemoteDescription(offer); err != nil {
+		p.negotiation.Unlock()
+		return errors.Wrap(ErrInvalidOffer, err.Error())
+	}
+	p.flushCandidates()
+	answer, err := p.pc.CreateAnswer(nil)
+	if err == nil {
+		err = p.pc.SetLocalDescription(answer)
+	}
+	pending := p.pending
+	p.pending = false
+	p.negotiation.Unlock()
+	if err != nil {
+		return err
+	}
+	r.signal(p, answer.Type.String(), p.pc.LocalDescription())
+	if pending {
+		r.negotiate(p)
+	}
+	return nil
+}
+
+// negotiate sends a server offer to a websocket member, e.g. after a track was added or removed.
+func (r *sfuRouter) negotiate(p *sfuPeer) {
+	p.negotiation.Lock()
+	if p.pc.SignalingState() != webrtc.SignalingStateStable {
+		p.pending = true // sent again once the member answers
+		p.negotiation.Unlock()
+		return
+	}
+	offer, err := p.pc.CreateOffer(nil)
+	if err == nil {
+		err = p.pc.SetLocalDescription(offer)
+	}
+	p.negotiation.Unlock()
+	if err != nil {
+		log.Printf("[%s] %s renegotiation failed: %v\n", p.roomID, p.userID, err)
+		return
+	}
+	r.signal(p, offer.Type.String(), p.pc.LocalDescription())
+}
+
+// flushCandidates applies the candidates received before the remote description. Caller holds p.negotiation.
+func (p *sfuPeer) flushCandidates() {
+	for _, candidate := range p.candidates {
+		if err := p.pc.AddICECandidate(candidate); err != nil {
+			log.Println("Failed to add ICE candidate:", err)
+		}
+	}
+	p.candidates = nil
+}
+
+// signal sends an SFU message to the member behind p, from the "sfu" member.
+func (r *sfuRouter) signal(p *sfuPeer, kind string, value interface{}) {
+	data, err := sfuMessage(p.roomID, p.userID, dto.ChannelWebrtc, kind, value)
+	if err != nil {
+		log.Println("JSON encoding error:", err)
+		return
+	}
+	if !r.send(p.roomID, p.userID, data) {
+		log.Printf("[%s] failed to send SFU %s to %s\n", p.roomID, kind, p.userID)
+	}
+}
+
+// sfuMessage is the websocket message carrying an SFU signal from the "sfu" member to userID.
+func sfuMessage(roomID, userID, channel, kind string, value interface{}) ([]byte, error) {
+	sdp, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(sfuSignal{Type: kind, Sdp: sdp})
+	if err != nil {
+		return nil, err
+	}
+	from, to := dto.SfuPeer, userID
+	return json.Marshal(dto.Message{
+		From:    &from,
+		To:      &to,
+		RoomID:  roomID,
+		Channel: &channel,
+		Msg:     base64.StdEncoding.EncodeToString(payload),
+	})
+}
@@ -0,0 +1,404 @@
+package service
+
+import (
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pkg/errors"
+)
+
+// layerWindow is how often the bitrate of the simulcast layers is measured and the layers re-selected
+const layerWindow = time.Second
+
+// sfuLayer is one encoding of a published track: the only one without simulcast (rid ""),
+// or one of the rid layers of a simulcast track.
+type sfuLayer struct {
+	rid    string
+	remote *webrtc.TrackRemote
+	bytes  atomic.Uint64 // received in the current window
+	rate   atomic.Uint64 // bits per second over the last window
+
+	highestSeq atomic.Uint32 // extended highest sequence number received, for the aggregated reports
+	maxSeq     uint16        // owned by the reader of the layer
+	cycles     uint32
+	receiving  bool
+
+	mutex        sync.Mutex
+	lastKeyframe time.Time
+}
+
+// bitrate returns the measured bitrate, or a first guess from what arrived before the first window ended.
+func (l *sfuLayer) bitrate() uint64 {
+	if rate := l.rate.Load(); rate > 0 {
+		return rate
+	}
+	return l.bytes.Load() * 8
+}
+
+// received advances the extended highest sequence number, reordered packets are ignored.
+func (l *sfuLayer) received(seq uint16) {
+	switch {
+	case !l.receiving:
+		l.receiving, l.maxSeq = true, seq
+	case seq-l.maxSeq != 0 && seq-l.maxSeq < 0x8000:
+		if seq < l.maxSeq {
+			l.cycles += 1 << 16
+		}
+		l.maxSeq = seq
+	}
+	l.highestSeq.Store(l.cycles | uint32(l.maxSeq))
+}
+
+// downTrack is what a subscriber receives of a published track: its own local track, fed from the
+// layer picked for this subscriber. Sequence numbers and timestamps are rewritten so a layer switch
+// looks like one continuous stream. Sinks get a down track too, without subscriber nor sender.
+type downTrack struct {
+	sub    *sfuPeer
+	track  *sfuTrack
+	local  rtpWriter
+	sender *webrtc.RTPSender
+
+	mutex     sync.Mutex
+	preferred string // requested rid, "" picks the best layer
+	budget    uint64 // bits per second allotted by the subscriber's estimate, 0 when unknown
+	target    string // layer to switch to on its next keyframe
+	current   string // layer being forwarded when active
+	active    bool
+	lastSeq   uint16
+	lastTS    uint32
+	seqOffset uint16
+	tsOffset  uint32
+	// temporal layers above the base are dropped while the layer exceeds the budget (VP8 only),
+	// dropTemporal is applied from the next base layer frame on
+	dropTemporal bool
+	dropping     bool
+}
+
+// rtpWriter is the output of a down track: the local track of a subscriber or a sink
+type rtpWriter interface {
+	WriteRTP(packet *rtp.Packet) error
+}
+
+// write forwards a packet of layer rid if it is the subscriber's layer. A switch, or the start of a
+// simulcast track, waits for a keyframe of the target layer so the decoder never gets a broken picture.
+func (dt *downTrack) write(rid string, packet *rtp.Packet, simulcast bool) {
+	dt.mutex.Lock()
+	defer dt.mutex.Unlock()
+	if !dt.active || rid != dt.current {
+		if rid != dt.target {
+			return
+		}
+		if (dt.active || simulcast) && !isKeyframe(dt.track.codec.MimeType, packet.Payload) {
+			return
+		}
+		if dt.active {
+			// continue right after the last forwarded packet, one frame later
+			dt.seqOffset = dt.lastSeq + 1 - packet.SequenceNumber
+			dt.tsOffset = dt.lastTS + dt.track.codec.ClockRate/30 - packet.Timestamp
+		}
+		dt.current, dt.active = rid, true
+		dt.dropping = dt.dropTemporal
+	}
+	if dt.dropTemporal || dt.dropping {
+		if tid, start, ok := vp8TemporalLayer(packet.Payload); ok {
+			if tid == 0 && start {
+				dt.dropping = dt.dropTemporal
+			}
+			if dt.dropping && tid > 0 {
+				dt.seqOffset-- // the subscriber must not see the dropped packets as lost
+				return
+			}
+		}
+	}
+	out := *packet
+	// the header extension IDs were negotiated with the publisher, not with this subscriber
+	out.Header.Extension = false
+	out.Header.Extensions = nil
+	out.SequenceNumber += dt.seqOffset
+	out.Timestamp += dt.tsOffset
+	dt.lastSeq, dt.lastTS = out.SequenceNumber, out.Timestamp
+	if err := dt.local.WriteRTP(&out); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		log.Println("Error occurred", err)
+	}
+}
+
+// feedbackLayer is the layer the subscriber's keyframe requests and reports are about.
+func (dt *downTrack) feedbackLayer() string {
+	dt.mutex.Lock()
+	defer dt.mutex.Unlock()
+	if dt.active {
+		return dt.current
+	}
+	return dt.target
+}
+
+// addLayer registers an encoding of the track and returns it.
+func (track *sfuTrack) addLayer(remote *webrtc.TrackRemote) *sfuLayer {
+	layer := &sfuLayer{rid: remote.RID(), remote: remote}
+	track.mutex.Lock()
+	track.layers[layer.rid] = layer
+	track.mutex.Unlock()
+	track.selectLayers()
+	return layer
+}
+
+// removeLayer drops a layer whose stream ended and returns how many are left.
+func (track *sfuTrack) removeLayer(layer *sfuLayer) int {
+	track.mutex.Lock()
+	if track.layers[layer.rid] == layer {
+		delete(track.layers, layer.rid)
+	}
+	left := len(track.layers)
+	for _, dt := range track.all() {
+		dt.mutex.Lock()
+		if dt.current == layer.rid {
+			dt.active = false
+		}
+		dt.mutex.Unlock()
+	}
+	track.mutex.Unlock()
+	if left > 0 {
+		track.selectLayers()
+	}
+	return left
+}
+
+// forward hands a packet of layer to every subscriber of the track.
+func (track *sfuTrack) forward(layer *sfuLayer, packet *rtp.Packet) {
+	layer.bytes.Add(uint64(packet.MarshalSize()))
+	layer.received(packet.SequenceNumber)
+	track.mutex.RLock()
+	defer track.mutex.RUnlock()
+	simulcast := len(track.layers) > 1
+	for _, dt := range track.downTracks {
+		dt.write(layer.rid, packet, simulcast)
+	}
+	for dt := range track.sinks {
+		dt.write(layer.rid, packet, simulcast)
+	}
+}
+
+// all returns the down tracks of the subscribers and of the sinks. Caller holds track.mutex.
+func (track *sfuTrack) all() []*downTrack {
+	all := make([]*downTrack, 0, len(track.downTracks)+len(track.sinks))
+	for _, dt := range track.downTracks {
+		all = append(all, dt)
+	}
+	for dt := range track.sinks {
+		all = append(all, dt)
+	}
+	return all
+}
+
+// bestLayer returns the preferred layer when it exists, else the layer with the highest bitrate
+// within budget (any when 0), else the lowest one. Caller holds track.mutex.
+func (track *sfuTrack) bestLayer(preferred string, budget uint64) string {
+	if _, exists := track.layers[preferred]; exists {
+		return preferred
+	}
+	best, bestRate, fits := "", uint64(0), false
+	lowest, lowestRate := "", uint64(0)
+	first := true
+	for rid, layer := range track.layers {
+		rate := layer.bitrate()
+		if first || rate < lowestRate || (rate == lowestRate && rid < lowest) {
+			lowest, lowestRate = rid, rate
+		}
+		first = false
+		if budget > 0 && rate > budget {
+			continue
+		}
+		if !fits || rate > bestRate || (rate == bestRate && rid < best) {
+			best, bestRate, fits = rid, rate, true
+		}
+	}
+	if !fits {
+		return lowest
+	}
+	return best
+}
+
+// selectLayers re-targets every subscriber and asks the new target layers for a keyframe.
+func (track *sfuTrack) selectLayers() {
+	var switching []*sfuLayer
+	track.mutex.RLock()
+	for _, dt := range track.all() {
+		if layer := track.retarget(dt); layer != nil {
+			switching = append(switching, layer)
+		}
+	}
+	track.mutex.RUnlock()
+	for _, layer := range switching {
+		track.requestKeyframe(layer, false)
+	}
+}
+
+// selectLayer re-targets one subscriber, e.g. after its budget changed.
+func (track *sfuTrack) selectLayer(dt *downTrack) {
+	track.mutex.RLock()
+	layer := track.retarget(dt)
+	track.mutex.RUnlock()
+	if layer != nil {
+		track.requestKeyframe(layer, false)
+	}
+}
+
+// retarget picks the layer of dt and whether its temporal layers are dropped. It returns the layer
+// to ask for a keyframe when dt switches to it. Caller holds track.mutex.
+func (track *sfuTrack) retarget(dt *downTrack) *sfuLayer {
+	dt.mutex.Lock()
+	defer dt.mutex.Unlock()
+	target := track.bestLayer(dt.preferred, dt.budget)
+	layer := track.layers[target]
+	dt.dropTemporal = layer != nil && dt.budget > 0 && layer.bitrate() > dt.budget &&
+		strings.EqualFold(track.codec.MimeType, webrtc.MimeTypeVP8)
+	if target == dt.target && dt.active {
+		return nil
+	}
+	dt.target = target
+	if layer != nil && (!dt.active || dt.current != target) {
+		return layer
+	}
+	return nil
+}
+
+// measureLayers updates the layer bitrates every layerWindow and re-selects the layers of the
+// subscribers, e.g. the best layer stops when the publisher drops it under congestion.
+func (track *sfuTrack) measureLayers() {
+	ticker := time.NewTicker(layerWindow)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-track.done:
+			return
+		}
+		track.mutex.RLock()
+		simulcast := len(track.layers) > 1
+		for _, layer := range track.layers {
+			layer.rate.Store(layer.bytes.Swap(0) * 8 * uint64(time.Second) / uint64(layerWindow))
+		}
+		track.mutex.RUnlock()
+		if simulcast {
+			track.selectLayers()
+		}
+	}
+}
+
+// setPreferredLayer pins the subscriber to rid, "" goes back to the best layer.
+func (track *sfuTrack) setPreferredLayer(sub *sfuPeer, rid string) {
+	track.mutex.RLock()
+	dt := track.downTracks[sub]
+	track.mutex.RUnlock()
+	if dt == nil {
+		return
+	}
+	dt.mutex.Lock()
+	dt.preferred = rid
+	dt.mutex.Unlock()
+	track.selectLayers()
+}
+
+// isKeyframe tells whether an RTP payload starts a keyframe. Codecs it cannot parse are always
+// switchable, the subscriber gets the new layer right away.
+func isKeyframe(mimeType string, payload []byte) bool {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return isVP8Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return isH264Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		// P bit clear and B bit set: start of a frame without inter-picture prediction
+		return len(payload) > 0 && payload[0]&0x40 == 0 && payload[0]&0x08 != 0
+	}
+	return true
+}
+
+// vp8TemporalLayer returns the temporal layer ID of a VP8 payload and whether the packet starts a frame,
+// ok is false when the publisher does not send temporal layers.
+func vp8TemporalLayer(payload []byte) (tid uint8, start bool, ok bool) {
+	if len(payload) < 2 || payload[0]&0x80 == 0 || payload[1]&0x20 == 0 { // X and T bits
+		return 0, false, false
+	}
+	ext, i := payload[1], 2
+	if ext&0x80 != 0 { // I: picture ID, 7 or 15 bits
+		if len(payload) <= i {
+			return 0, false, false
+		}
+		if payload[i]&0x80 != 0 {
+			i++
+		}
+		i++
+	}
+	if ext&0x40 != 0 { // L: TL0PICIDX
+		i++
+	}
+	if len(payload) <= i {
+		return 0, false, false
+	}
+	return payload[i] >> 6, payload[0]&0x10 != 0 && payload[0]&0x07 == 0, true
+}
+
+// isVP8Keyframe parses the VP8 payload descriptor (RFC 7741) and the P bit of the frame header.
+func isVP8Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	start, partition := payload[0]&0x10 != 0, payload[0]&0x07
+	if !start || partition != 0 {
+		return false
+	}
+	i := 1
+	if payload[0]&0x80 != 0 { // X: extended control bits
+		if len(payload) < 2 {
+			return false
+		}
+		ext := payload[1]
+		i++
+		if ext&0x80 != 0 { // I: picture ID, 7 or 15 bits
+			if len(payload) <= i {
+				return false
+			}
+			if payload[i]&0x80 != 0 {
+				i++
+			}
+			i++
+		}
+		if ext&0x40 != 0 { // L: TL0PICIDX
+			i++
+		}
+		if ext&0x30 != 0 { // T or K: TID/KEYIDX
+			i++
+		}
+	}
+	return len(payload) > i && payload[i]&0x01 == 0
+}
+
+// isH264Keyframe looks for an IDR slice or a sequence parameter set, alone, aggregated (STAP-A)
+// or at the start of a fragmented unit (FU-A).
+func isH264Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	switch nal := payload[0] & 0x1f; nal {
+	case 5, 7:
+		return true
+	case 24: // STAP-A
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			if t := payload[i+2] & 0x1f; t == 5 || t == 7 {
+				return true
+			}
+			i += 2 + size
+		}
+	case 28: // FU-A
+		return len(payload) > 1 && payload[1]&0x80 != 0 && (payload[1]&0x1f == 5 || payload[1]&0x1f == 7)
+	}
+	return false
+}
@@ -0,0 +1,230 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// vp8Payload builds a VP8 payload descriptor with a TID extension followed by a frame header byte.
+func vp8Payload(start bool, tid uint8, keyframe bool) []byte {
+	first := byte(0x80) // X
+	if start {
+		first |= 0x10 // S, partition 0
+	}
+	header := byte(0x01) // P bit set: interframe
+	if keyframe {
+		header = 0x00
+	}
+	return []byte{first, 0x20, tid << 6, header}
+}
+
+func TestIsKeyframe(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+		payload  []byte
+		want     bool
+	}{
+		{"vp8 keyframe", webrtc.MimeTypeVP8, []byte{0x10, 0x00}, true},
+		{"vp8 interframe", webrtc.MimeTypeVP8, []byte{0x10, 0x01}, false},
+		{"vp8 continuation", webrtc.MimeTypeVP8, []byte{0x00, 0x00}, false},
+		{"vp8 other partition", webrtc.MimeTypeVP8, []byte{0x11, 0x00}, false},
+		{"vp8 keyframe with 15 bit picture id", webrtc.MimeTypeVP8, []byte{0x90, 0x80, 0x81, 0x02, 0x00}, true},
+		{"vp8 keyframe with all extensions", webrtc.MimeTypeVP8, []byte{0x90, 0xf0, 0x05, 0x01, 0x40, 0x00}, true},
+		{"vp8 interframe with all extensions", webrtc.MimeTypeVP8, []byte{0x90, 0xf0, 0x05, 0x01, 0x40, 0x01}, false},
+		{"vp8 truncated descriptor", webrtc.MimeTypeVP8, []byte{0x90, 0x80}, false},
+		{"vp8 empty", webrtc.MimeTypeVP8, nil, false},
+		{"h264 idr", webrtc.MimeTypeH264, []byte{0x65, 0x88}, true},
+		{"h264 sps", webrtc.MimeTypeH264, []byte{0x67, 0x42}, true},
+		{"h264 non-idr slice", webrtc.MimeTypeH264, []byte{0x41, 0x9a}, false},
+		{"h264 stap-a with sps", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x02, 0x67, 0x42, 0x00, 0x02, 0x68, 0xce}, true},
+		{"h264 stap-a with idr second", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x01, 0x06, 0x00, 0x02, 0x65, 0x88}, true},
+		{"h264 stap-a without idr", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x01, 0x06, 0x00, 0x02, 0x41, 0x9a}, false},
+		{"h264 stap-a truncated", webrtc.MimeTypeH264, []byte{0x78, 0x00}, false},
+		{"h264 fu-a idr start", webrtc.MimeTypeH264, []byte{0x7c, 0x85, 0x88}, true},
+		{"h264 fu-a idr middle", webrtc.MimeTypeH264, []byte{0x7c, 0x05, 0x88}, false},
+		{"h264 fu-a non-idr start", webrtc.MimeTypeH264, []byte{0x7c, 0x81, 0x9a}, false},
+		{"h264 fu-a truncated", webrtc.MimeTypeH264, []byte{0x7c}, false},
+		{"h264 empty", webrtc.MimeTypeH264, nil, false},
+		{"mime type case", "video/h264", []byte{0x65}, true},
+		{"unknown codec", "video/AV1", []byte{0x00}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isKeyframe(tt.mimeType, tt.payload); got != tt.want {
+				t.Errorf("isKeyframe(%s, %x) = %v, want %v", tt.mimeType, tt.payload, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVP8TemporalLayer(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		tid     uint8
+		start   bool
+		ok      bool
+	}{
+		{"no extension", []byte{0x10, 0x00}, 0, false, false},
+		{"extension without T", []byte{0x90, 0x80, 0x05, 0x00}, 0, false, false},
+		{"tid 0 start", vp8Payload(true, 0, false), 0, true, true},
+		{"tid 2 continuation", vp8Payload(false, 2, false), 2, false, true},
+		{"7 bit picture id", []byte{0x90, 0xa0, 0x05, 0x40, 0x00}, 1, true, true},
+		{"15 bit picture id and tl0picidx", []byte{0x90, 0xe0, 0x81, 0x02, 0x07, 0x80, 0x00}, 2, true, true},
+		{"start of other partition", []byte{0x91, 0x20, 0x00, 0x00}, 0, false, true},
+		{"truncated", []byte{0x90, 0xe0, 0x81}, 0, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tid, start, ok := vp8TemporalLayer(tt.payload)
+			if tid != tt.tid || start != tt.start || ok != tt.ok {
+				t.Errorf("vp8TemporalLayer(%x) = %d, %v, %v, want %d, %v, %v", tt.payload, tid, start, ok, tt.tid, tt.start, tt.ok)
+			}
+		})
+	}
+}
+
+func testTrack(rates map[string]uint64) *sfuTrack {
+	track := &sfuTrack{
+		codec:  webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		layers: make(map[string]*sfuLayer),
+	}
+	for rid, rate := range rates {
+		layer := &sfuLayer{rid: rid}
+		layer.rate.Store(rate)
+		track.layers[rid] = layer
+	}
+	return track
+}
+
+func TestBestLayer(t *testing.T) {
+	rates := map[string]uint64{"q": 150_000, "h": 500_000, "f": 2_000_000}
+	tests := []struct {
+		name      string
+		rates     map[string]uint64
+		preferred string
+		budget    uint64
+		want      string
+	}{
+		{"highest without budget", rates, "", 0, "f"},
+		{"highest within budget", rates, "", 1_000_000, "h"},
+		{"lowest when nothing fits", rates, "", 100_000, "q"},
+		{"preferred layer", rates, "q", 0, "q"},
+		{"preferred layer ignores budget", rates, "f", 100_000, "f"},
+		{"missing preferred layer", rates, "x", 0, "f"},
+		{"stalled layer is skipped", map[string]uint64{"q": 150_000, "h": 500_000, "f": 0}, "", 0, "h"},
+		{"stalled layer is the lowest", map[string]uint64{"q": 0, "h": 500_000}, "", 100_000, "q"},
+		{"single layer", map[string]uint64{"": 800_000}, "", 100_000, ""},
+		{"equal rates pick the first rid", map[string]uint64{"a": 100, "b": 100}, "", 0, "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := testTrack(tt.rates).bestLayer(tt.preferred, tt.budget); got != tt.want {
+				t.Errorf("bestLayer(%q, %d) = %q, want %q", tt.preferred, tt.budget, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetargetAfterStall(t *testing.T) {
+	track := testTrack(map[string]uint64{"q": 150_000, "f": 2_000_000})
+	dt := &downTrack{track: track}
+	if layer := track.retarget(dt); layer == nil || layer.rid != "f" {
+		t.Fatalf("retarget picked %v, want f", layer)
+	}
+	dt.current, dt.active = "f", true
+	// the full layer stops arriving
+	track.layers["f"].rate.Store(0)
+	if layer := track.retarget(dt); layer == nil || layer.rid != "q" {
+		t.Fatalf("retarget after stall picked %v, want q", layer)
+	}
+	if dt.target != "q" {
+		t.Errorf("target = %q, want q", dt.target)
+	}
+}
+
+type recordingWriter struct {
+	packets []rtp.Packet
+}
+
+func (w *recordingWriter) WriteRTP(packet *rtp.Packet) error {
+	w.packets = append(w.packets, *packet)
+	return nil
+}
+
+func TestDownTrackDropsTemporalLayersContiguously(t *testing.T) {
+	out := &recordingWriter{}
+	dt := &downTrack{track: testTrack(map[string]uint64{"": 1}), local: out, dropTemporal: true}
+	frames := []struct {
+		tid   uint8
+		start bool
+	}{
+		{0, true}, {0, false}, {2, true}, {2, false}, {1, true}, {0, true}, {2, true}, {0, true}, {0, false},
+	}
+	for i, f := range frames {
+		dt.write("", &rtp.Packet{
+			Header:  rtp.Header{SequenceNumber: uint16(65530 + i), Timestamp: uint32(i * 3000)},
+			Payload: vp8Payload(f.start, f.tid, i == 0),
+		}, false)
+	}
+	if len(out.packets) != 5 {
+		t.Fatalf("forwarded %d packets, want the 5 of temporal layer 0", len(out.packets))
+	}
+	for i := 1; i < len(out.packets); i++ {
+		if out.packets[i].SequenceNumber != out.packets[i-1].SequenceNumber+1 {
+			t.Errorf("sequence number %d follows %d", out.packets[i].SequenceNumber, out.packets[i-1].SequenceNumber)
+		}
+	}
+	for _, p := range out.packets {
+		if tid, _, _ := vp8TemporalLayer(p.Payload); tid != 0 {
+			t.Errorf("forwarded temporal layer %d", tid)
+		}
+	}
+}
+
+func TestDownTrackLayerSwitch(t *testing.T) {
+	out := &recordingWriter{}
+	dt := &downTrack{track: testTrack(map[string]uint64{"q": 1, "f": 2}), local: out, target: "q"}
+	write := func(rid string, seq uint16, ts uint32, keyframe bool) {
+		packet := &rtp.Packet{
+			Header:  rtp.Header{SequenceNumber: seq, Timestamp: ts},
+			Payload: []byte{0x10, map[bool]byte{true: 0x00, false: 0x01}[keyframe]},
+		}
+		if err := packet.SetExtension(1, []byte(rid)); err != nil {
+			t.Fatal(err)
+		}
+		dt.write(rid, packet, true)
+	}
+	write("q", 100, 1000, false) // a simulcast start waits for a keyframe
+	write("q", 101, 4000, true)
+	write("q", 102, 7000, false)
+	dt.target = "f"
+	write("f", 5000, 90000, false) // not a keyframe of the target
+	write("q", 103, 10000, false)
+	write("f", 5001, 93000, true)
+	write("q", 104, 13000, false) // the old layer is no longer forwarded
+	write("f", 5002, 96000, false)
+
+	var seqs []uint16
+	var tss []uint32
+	for _, p := range out.packets {
+		seqs = append(seqs, p.SequenceNumber)
+		tss = append(tss, p.Timestamp)
+		if p.Extension || len(p.Extensions) > 0 {
+			t.Errorf("packet %d kept the publisher's header extensions", p.SequenceNumber)
+		}
+	}
+	wantSeqs := []uint16{101, 102, 103, 104, 105}
+	wantTss := []uint32{4000, 7000, 10000, 13000, 16000}
+	if len(seqs) != len(wantSeqs) {
+		t.Fatalf("forwarded sequence numbers %v, want %v", seqs, wantSeqs)
+	}
+	for i := range wantSeqs {
+		if seqs[i] != wantSeqs[i] || tss[i] != wantTss[i] {
+			t.Fatalf("forwarded %v / %v, want %v / %v", seqs, tss, wantSeqs, wantTss)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"log"
+
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// addSink feeds sink with track from its best layer until the track is unpublished or removeSink is
+// called, the sink is closed then. It returns false when the track is already unpublished.
+func (r *sfuRouter) addSink(track *sfuTrack, sink media.Writer) (*downTrack, bool) {
+	dt := &downTrack{track: track, local: sink}
+	r.mutex.Lock()
+	live := track.owner.tracks[track.receiver] == track
+	if live {
+		track.mutex.Lock()
+		track.sinks[dt] = sink
+		track.mutex.Unlock()
+	}
+	r.mutex.Unlock()
+	if !live {
+		return nil, false
+	}
+	track.selectLayers() // starts on a keyframe of the best layer
+	return dt, true
+}
+
+// removeSink detaches a sink added by addSink and closes it.
+func (r *sfuRouter) removeSink(dt *downTrack) {
+	track := dt.track
+	track.mutex.Lock()
+	sink, exists := track.sinks[dt]
+	delete(track.sinks, dt)
+	track.mutex.Unlock()
+	if !exists {
+		return // closed by unpublish
+	}
+	if err := sink.Close(); err != nil {
+		log.Println("Failed to close track sink:", err)
+	}
+}
+
+// requestKeyframe asks the publisher for a keyframe of the layer dt receives.
+func (dt *downTrack) requestKeyframe() {
+	if layer := dt.track.layer(dt.feedbackLayer()); layer != nil {
+		dt.track.requestKeyframe(layer, false)
+	}
+}
+
+// tracksOf returns the tracks publisherID publishes in roomID, of every publisher when empty.
+func (r *sfuRouter) tracksOf(roomID, publisherID string) []*sfuTrack {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var tracks []*sfuTrack
+	for _, p := range r.rooms[roomID] {
+		if publisherID != "" && p.userID != publisherID {
+			continue
+		}
+		for _, track := range p.tracks {
+			tracks = append(tracks, track)
+		}
+	}
+	return tracks
+}
@@ -0,0 +1,43 @@
+package service
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"go-rest-api/dto"
+)
+
+// Shutdown stops accepting joins, tells every member the server is going away and closes the sockets
+// with 1001 once that notice is flushed. SFU peer connections are closed too and the other instances
+// are told that the members of this one are gone. Sockets still flushing when ctx expires are cut.
+func (v *videoCallService) Shutdown(ctx context.Context) error {
+	clients := v.hub.drain()
+	log.Printf("shutting down, notifying %d members\n", len(clients))
+	for _, c := range clients {
+		c.respond(dto.WsResponse{
+			Status:  http.StatusServiceUnavailable,
+			Message: dto.ServerGoingAway,
+		})
+		c.closeAfterFlush(websocket.CloseGoingAway, "server shutting down")
+	}
+	v.peers.closeAll()
+	v.recorder.stopAll()
+	v.hls.stopAll()
+	v.forwarder.stopAll()
+	v.hub.leave()
+
+	for _, c := range clients {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			log.Println("shutdown deadline reached, closing remaining sockets")
+			for _, c := range clients {
+				c.close()
+			}
+			return ctx.Err()
+		}
+	}
+	return nil
+}
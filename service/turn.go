@@ -0,0 +1,123 @@
+package service
+
+import (
+	"log"
+	"net"
+
+	"github.com/pion/logging"
+	"github.com/pion/transport/v3/stdnet"
+	"github.com/pion/turn/v4"
+	"go-rest-api/config"
+)
+
+// TurnServer is the embedded TURN relay started next to the gin engine.
+type TurnServer interface {
+	// Allocations returns the number of active relay allocations.
+	Allocations() int
+	Close() error
+}
+
+type turnServer struct {
+	server *turn.Server
+}
+
+// defaultDeniedNetworks keeps relayed traffic away from the host's own networks and cloud metadata services
+var defaultDeniedNetworks = []string{
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+	"192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+}
+
+// parseNetworks parses CIDRs, the invalid ones are logged and skipped.
+func parseNetworks(cidrs []string, what string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Printf("Ignoring invalid %s network %q: %v\n", what, cidr, err)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func inNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// turnPermissions refuses the peers in the denied networks unless they are in the allowed ones.
+func turnPermissions(conf config.Turn) turn.PermissionHandler {
+	denied := conf.DeniedNetworks
+	if denied == nil {
+		denied = defaultDeniedNetworks
+	}
+	deny := parseNetworks(denied, "turn denied")
+	allow := parseNetworks(conf.AllowedNetworks, "turn allowed")
+	return func(clientAddr net.Addr, peerIP net.IP) bool {
+		if inNetworks(peerIP, deny) && !inNetworks(peerIP, allow) {
+			log.Printf("turn: %s may not relay to %s\n", clientAddr, peerIP)
+			return false
+		}
+		return true
+	}
+}
+
+func (t *turnServer) Allocations() int {
+	return t.server.AllocationCount()
+}
+
+func (t *turnServer) Close() error {
+	return t.server.Close()
+}
+
+// NewTurnServer listens on `turn.listen-address` (UDP and TCP) and relays through the configured port range.
+// Credentials are checked against the TURN REST scheme of `ice:`, the ones /ice-servers issues after
+// authenticating the caller like a room join. Peers in `turn.denied-networks` cannot be relayed to.
+// A broken TURN config stops the server like other config errors.
+func NewTurnServer(conf config.Turn, ice config.Ice) TurnServer {
+	vnet, err := stdnet.NewNet()
+	if err != nil {
+		log.Fatal(err)
+	}
+	relay := func() turn.RelayAddressGenerator {
+		return &turn.RelayAddressGeneratorPortRange{
+			RelayAddress: net.ParseIP(conf.RelayIP),
+			Address:      "0.0.0.0",
+			MinPort:      conf.MinPort,
+			MaxPort:      conf.MaxPort,
+			Net:          vnet,
+		}
+	}
+	udpConn, err := net.ListenPacket("udp4", conf.ListenAddress)
+	if err != nil {
+		log.Fatalf("turn: listen udp %s: %v", conf.ListenAddress, err)
+	}
+	tcpListener, err := net.Listen("tcp4", conf.ListenAddress)
+	if err != nil {
+		log.Fatalf("turn: listen tcp %s: %v", conf.ListenAddress, err)
+	}
+	loggers := logging.NewDefaultLoggerFactory()
+	permissions := turnPermissions(conf)
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:         conf.Realm,
+		AuthHandler:   turn.LongTermTURNRESTAuthHandler(ice.TurnSecret, loggers.NewLogger("turn")),
+		LoggerFactory: loggers,
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{PacketConn: udpConn, RelayAddressGenerator: relay(), PermissionHandler: permissions},
+		},
+		ListenerConfigs: []turn.ListenerConfig{
+			{Listener: tcpListener, RelayAddressGenerator: relay(), PermissionHandler: permissions},
+		},
+	})
+	if err != nil {
+		log.Fatalf("turn: %v", err)
+	}
+	log.Printf("TURN relay listening on %s (udp/tcp), relay %s:%d-%d\n", conf.ListenAddress, conf.RelayIP, conf.MinPort, conf.MaxPort)
+	return &turnServer{server: server}
+}
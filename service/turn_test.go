@@ -0,0 +1,41 @@
+package service
+
+import (
+	"net"
+	"testing"
+
+	"go-rest-api/config"
+)
+
+func TestTurnPermissions(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}
+	tests := []struct {
+		name string
+		conf config.Turn
+		peer string
+		want bool
+	}{
+		{"public IPv4", config.Turn{}, "8.8.8.8", true},
+		{"public IPv6", config.Turn{}, "2001:4860:4860::8888", true},
+		{"loopback", config.Turn{}, "127.0.0.1", false},
+		{"IPv6 loopback", config.Turn{}, "::1", false},
+		{"private", config.Turn{}, "192.168.1.10", false},
+		{"cloud metadata", config.Turn{}, "169.254.169.254", false},
+		{"CGNAT", config.Turn{}, "100.64.0.1", false},
+		{"IPv6 unique local", config.Turn{}, "fd00::1", false},
+		{"IPv4-mapped loopback", config.Turn{}, "::ffff:127.0.0.1", false},
+		{"allowed LAN", config.Turn{AllowedNetworks: []string{"192.168.1.0/24"}}, "192.168.1.10", true},
+		{"outside the allowed LAN", config.Turn{AllowedNetworks: []string{"192.168.1.0/24"}}, "192.168.2.10", false},
+		{"configured denied networks replace the defaults", config.Turn{DeniedNetworks: []string{"8.8.8.0/24"}}, "10.0.0.1", true},
+		{"configured denied network", config.Turn{DeniedNetworks: []string{"8.8.8.0/24"}}, "8.8.8.8", false},
+		{"empty denied networks allow everything", config.Turn{DeniedNetworks: []string{}}, "127.0.0.1", true},
+		{"invalid networks are skipped", config.Turn{DeniedNetworks: []string{"nope", "8.8.8.0/24"}}, "8.8.8.8", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := turnPermissions(tt.conf)(client, net.ParseIP(tt.peer)); got != tt.want {
+				t.Errorf("relay to %s = %v, want %v", tt.peer, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -8,35 +9,66 @@ import (
 	"go-rest-api/config"
 	"go-rest-api/dto"
 	"go-rest-api/utils"
-	"io"
 	"log"
 	"net/http"
-	"sync"
+	"net/url"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
-	"github.com/pion/rtcp"
+	"github.com/pion/interceptor/pkg/cc"
 	"github.com/pion/webrtc/v4"
 	"github.com/pkg/errors"
 )
 
-const (
-	rtcpPLIInterval = time.Second * 3
-)
-
 type VideoCallService interface {
 	CallBroadcast(*gin.Context, dto.PeerInfo) (config.Sdp, error)
 	JoinRoom(*gin.Context, dto.JoinRequest) error
+	// room management, backed by the same hub as JoinRoom
+	CreateRoom(dto.CreateRoomRequest)
+	ListRooms() []dto.RoomSummary
+	ListPeers(string) ([]dto.PeerSummary, error)
+	ListBandwidth(string) ([]dto.SubscriberBandwidth, error)
+	// recording of the published tracks to disk
+	StartRecording(string, dto.StartRecordingRequest) (dto.Recording, error)
+	StopRecording(string, string) (dto.Recording, error)
+	ListRecordings(string) []dto.Recording
+	// HLS output of a publisher for players without WebRTC: playlist, init segment, segments and parts
+	HlsFile(context.Context, string, string, string, url.Values) (string, []byte, error)
+	// RTP/UDP forwarding of the published tracks, with an SDP per target
+	StartForward(string, dto.StartForwardRequest) (dto.Forward, error)
+	StopForward(string, string) (dto.Forward, error)
+	ListForwards(string) []dto.Forward
+	GetForward(string, string) (dto.Forward, error)
+	KickPeer(string, string) error
+	CloseRoom(string) error
+	// WHIP ingest (RFC 9725): the publisher's tracks are forwarded to the subscribers of the room
+	Publish(dto.JoinRequest, string) (string, string, error)
+	Trickle(dto.JoinRequest, string, string) error
+	Unpublish(dto.JoinRequest, string) error
+	// WHEP egress: a viewer subscribes to the tracks of a publisher (or of the room when none is named)
+	Subscribe(dto.JoinRequest, string, string) (string, string, error)
+	TrickleSubscriber(dto.JoinRequest, string, string) error
+	Unsubscribe(dto.JoinRequest, string) error
+	// Shutdown drains the rooms and the SFU peer connections, it returns when done or when ctx expires.
+	Shutdown(context.Context) error
 }
 
 type videoCallService struct {
+	hub   *hub
+	peers *peerRegistry
+	whip  *resourceSessions
+	whep  *resourceSessions
+
+	router    *sfuRouter
+	data      *dataHub
+	recorder  *recorder
+	hls       *hlsPackager
+	forwarder *forwarder
 }
 
 func (v *videoCallService) JoinRoom(ctx *gin.Context, req dto.JoinRequest) error {
 	ws := config.AppConfig.WebSock.Upgrade
-	mutex := config.AppConfig.WebSock.Mutex
-	rooms := config.AppConfig.WebSock.RoomLst
 
 	// Upgrade the HTTP connection to a WebSocket connection
 	conn, err := ws.Upgrade(ctx.Writer, ctx.Request, nil)
@@ -44,65 +76,64 @@ func (v *videoCallService) JoinRoom(ctx *gin.Context, req dto.JoinRequest) error
 		log.Println("Failed to upgrade connection to WebSocket:", err)
 		return errors.Wrap(err, "Failed to upgrade connection to WebSocket")
 	}
-	defer func() {
-		// Handle the error from conn.Close()
-		if err := conn.Close(); err != nil {
-			log.Println("Failed to close WebSocket connection:", err)
+	// Thêm user vào room
+	cl := newClient(v.hub, conn, req, ctx.GetString("ClientIP"))
+	joined, err := v.hub.join(cl, req.ResumeToken)
+	if err != nil {
+		log.Printf("[%s] %s rejected: %v\n", req.RoomID, req.UserID, err)
+		go cl.writePump()
+		if errors.Is(err, ErrShuttingDown) {
+			cl.respond(dto.WsResponse{
+				Status:  http.StatusServiceUnavailable,
+				Message: dto.ServerGoingAway,
+			})
+			cl.closeAfterFlush(websocket.CloseGoingAway, "server shutting down")
+			return nil
 		}
-	}()
-	// Thêm user vào room - locking resource
-	mutex.Lock()
-	if _, exists := rooms[req.RoomID]; !exists {
-		// create new room!
-		rooms[req.RoomID] = make(map[string]*websocket.Conn)
-	} else {
-		// validate user joined in this roomID
-		if _, exists := rooms[req.RoomID][req.UserID]; exists {
-			// TODO: enable re-join to room
-			// return errors.New(fmt.Sprintf("User %s already joined", req.UserID))
-			log.Println("Warning Re-join room:", req.RoomID, req.UserID)
+		status, code, reason := http.StatusInternalServerError, websocket.CloseInternalServerErr, "join failed"
+		switch {
+		case errors.Is(err, ErrRoomFull):
+			status, code, reason = http.StatusConflict, dto.CloseRoomFull, "room is full"
+		case errors.Is(err, ErrRoleFull):
+			status, code, reason = http.StatusConflict, dto.CloseRoleFull, "no seat left for the role"
 		}
+		cl.respond(dto.WsResponse{
+			Status:  status,
+			Message: err.Error(),
+		})
+		cl.closeAfterFlush(code, reason)
+		return nil
 	}
-	// mapping UserID to new Room
-	rooms[req.RoomID][req.UserID] = conn
+	cl.prepareRead()
+	go cl.writePump()
 
-	// Get the map of users in the specified room
-	var otherUserIDs []string
-	userMap, exists := rooms[req.RoomID]
-	if exists {
-		// Room doesn't exist, return empty slice
-		// Iterate over the user IDs in the room
-		for userID := range userMap {
-			// Exclude the current user ID
-			if userID != req.UserID {
-				otherUserIDs = append(otherUserIDs, userID)
-			}
+	switch joined.kind {
+	case joinResumed:
+		if joined.old != nil {
+			joined.old.closeWith(dto.CloseSessionReplaced, "session resumed on another connection")
+		}
+		log.Printf("[%s] %s resumed session in room %s (%d buffered)\n", req.RoomID, req.UserID, req.RoomID, joined.buffered)
+	case joinReplaced:
+		if joined.old != nil {
+			joined.old.closeWith(dto.CloseSessionReplaced, "session taken over by a new login")
 		}
+		v.router.removeMember(req.RoomID, req.UserID) // the new login negotiates its own SFU session
+		v.data.removeMember(req.RoomID, req.UserID)
+		v.hub.notifyPresence(req.RoomID, dto.Peer{UserID: req.UserID, Role: req.Role}, dto.PeerReconnected)
+		log.Printf("[%s] %s re-joined room %s as %s\n", req.RoomID, req.UserID, req.RoomID, req.Role)
+	default:
+		v.hub.notifyPresence(req.RoomID, dto.Peer{UserID: req.UserID, Role: req.Role}, dto.PeerJoined)
+		log.Printf("[%s] %s joined room %s as %s\n", req.RoomID, req.UserID, req.RoomID, req.Role)
 	}
-
-	// echo connected event to user in the first time
-	wsResponse(nil, conn, dto.WsResponse{
-		Status:  http.StatusOK,
-		Message: "onConnected-" + fmt.Sprint(len(rooms[req.RoomID])),
-		Peers:   &otherUserIDs,
-	})
-	mutex.Unlock() // unlock resource
-	log.Printf("[%s] %s joined room %s\n", req.RoomID, req.UserID, req.RoomID)
 	defer func() {
-		// Xóa user khi mất kết nối
-		mutex.Lock()
-		delete(rooms[req.RoomID], req.UserID)
-		if len(rooms[req.RoomID]) == 0 {
-			delete(rooms, req.RoomID) // Xóa phòng nếu không còn user
-		}
-		mutex.Unlock()
-
-		err := conn.Close()
-		if err != nil {
-			log.Println("Failed to close WebSocket connection:", err)
-			return
-		}
-		log.Printf("[%s] %s left room %s\n", req.RoomID, req.UserID, req.RoomID)
+		// Xóa user khi mất kết nối, the session waits for a resume during the grace period
+		v.hub.detach(cl, func() {
+			v.router.removeMember(req.RoomID, req.UserID)
+			v.data.removeMember(req.RoomID, req.UserID)
+			v.hub.notifyPresence(req.RoomID, dto.Peer{UserID: req.UserID, Role: req.Role}, dto.PeerLeft)
+			log.Printf("[%s] %s left room %s\n", req.RoomID, req.UserID, req.RoomID)
+		})
+		cl.close()
 	}()
 	// Lắng nghe tin nhắn
 	for {
@@ -111,6 +142,8 @@ func (v *videoCallService) JoinRoom(ctx *gin.Context, req dto.JoinRequest) error
 			log.Println("Read error:", err)
 			break
 		}
+		received := time.Now()
+		cl.extendReadDeadline()
 
 		// Giải mã JSON
 		var msg dto.Message
@@ -128,8 +161,20 @@ func (v *videoCallService) JoinRoom(ctx *gin.Context, req dto.JoinRequest) error
 			}
 
 		}
+		if err := stampSender(&msg, cl); err != nil {
+			log.Printf("[%s] %s rejected message: %v\n", cl.roomID, cl.userID, err)
+			cl.respond(dto.WsResponse{
+				Status:  http.StatusForbidden,
+				Message: err.Error(),
+				ID:      msg.ID,
+				Ack:     dto.AckRejected,
+			})
+			countMessage(routeOf(msg), dto.AckRejected)
+			continue
+		}
 		// Send message to other
-		err = sendMsg(msg, conn, msg.To == nil)
+		err = v.sendMsg(msg, cl, msg.To == nil)
+		observeForward(routeOf(msg), received)
 		if err != nil {
 			log.Println("Send msg error:", err)
 		}
@@ -150,27 +195,42 @@ func (v *videoCallService) CallBroadcast(c *gin.Context, callInfo dto.PeerInfo)
 
 	// Create a new RTCPeerConnection
 	// this is the gist of webrtc, generates and process SDP
-	println("peerConnection - new")
-	peerConnection, err := config.AppConfig.Api.NewPeerConnection(*config.AppConfig.IceConfig)
-
+	peerConnection, estimator, done, err := v.newPeerConnection()
 	if err != nil {
-		log.Println("NewPeerConnection error occurred", err)
+		return config.Sdp{}, err
+	}
+	role := "subscriber"
+	if callInfo.IsSender {
+		role = "publisher"
+	}
+	// the sender publishes into the meeting room, the receiver gets the tracks of PeerId already published there
+	peer := &sfuPeer{
+		key:       newID(),
+		roomID:    callInfo.MeetingID,
+		userID:    callInfo.UserId,
+		pc:        peerConnection,
+		estimator: estimator,
+		done:      done,
 	}
-
 	if !callInfo.IsSender {
-		err = receiveTrack(peerConnection, config.AppConfig.PeerConnectionMap, callInfo.PeerId)
-	} else {
-		err = createTrack(peerConnection, config.AppConfig.PeerConnectionMap, callInfo.UserId)
+		peer.subscribe = true
+		peer.publisher = callInfo.PeerId
 	}
-	if err != nil {
-		log.Println("onTrack error", err)
-		return config.Sdp{}, err
+	v.router.addPeer(peer)
+	if !callInfo.IsSender && v.router.subscribeExisting(peer) == 0 {
+		log.Printf("[%s] %s has no track to receive\n", callInfo.MeetingID, callInfo.PeerId)
+		sfuPeerConnectionsTotal.WithLabelValues(role, "error").Inc()
+		_ = peerConnection.Close()
+		return config.Sdp{}, ErrPublisherNotFound
 	}
 
 	// Set the SessionDescription of remote callInfo
+	offer.SDP = config.AppConfig.Codecs.CompleteOffer(offer.SDP)
 	err = peerConnection.SetRemoteDescription(offer)
 	if err != nil {
 		log.Println("error occurred", err)
+		sfuPeerConnectionsTotal.WithLabelValues(role, "error").Inc()
+		_ = peerConnection.Close()
 		return config.Sdp{}, err
 	}
 
@@ -184,123 +244,75 @@ func (v *videoCallService) CallBroadcast(c *gin.Context, callInfo dto.PeerInfo)
 	err = peerConnection.SetLocalDescription(answer)
 	if err != nil {
 		log.Println("error occurred", err)
+		sfuPeerConnectionsTotal.WithLabelValues(role, "error").Inc()
+		_ = peerConnection.Close()
 		return config.Sdp{}, err
 	}
+	sfuPeerConnectionsTotal.WithLabelValues(role, "ok").Inc()
 	return config.Sdp{Sdp: utils.Encode(answer)}, nil
 }
 
-func NewVideoCallService() VideoCallService {
-	return &videoCallService{}
+func NewVideoCallService(broker Broker) VideoCallService {
+	v := &videoCallService{
+		hub:   newHub(config.AppConfig.App, config.AppConfig.Rooms, config.AppConfig.Broker, broker),
+		peers: newPeerRegistry(),
+		whip:  newResourceSessions(),
+		whep:  newResourceSessions(),
+	}
+	v.router = newSfuRouter(v.sendToMember, v.newPeerConnection)
+	v.data = newDataHub(v.sendToMember, v.newPeerConnection)
+	v.recorder = newRecorder(v.router, config.AppConfig.Recording)
+	v.hls = newHlsPackager(v.router, config.AppConfig.Hls)
+	v.forwarder = newForwarder(v.router, config.AppConfig.Forwarding)
+	v.router.onPublish = v.trackPublished
+	v.hub.onKick = func(roomID, userID string) { v.kick(roomID, userID) }
+	v.hub.onCloseRoom = func(roomID string) { v.closeRoom(roomID) }
+	return v
 }
 
-// user is the caller of the method
-// if user connects before peer: create channel and keep listening till track is added
-// if peer connects before user: channel would have been created by peer and track can be added by getting the channel from cache
-func receiveTrack(peerConnection *webrtc.PeerConnection,
-	peerConnectionMap map[string]chan *webrtc.TrackLocalStaticRTP,
-	peerID string) error {
-	if _, ok := peerConnectionMap[peerID]; !ok {
-		peerConnectionMap[peerID] = make(chan *webrtc.TrackLocalStaticRTP, 1)
-	}
-	localTrack := <-peerConnectionMap[peerID]
-	_, err := peerConnection.AddTrack(localTrack)
+// newPeerConnection creates an SFU peer connection with its bandwidth estimator, closed on shutdown with the others.
+func (v *videoCallService) newPeerConnection() (*webrtc.PeerConnection, cc.BandwidthEstimator, <-chan struct{}, error) {
+	pc, estimator, err := config.AppConfig.NewPeerConnection()
 	if err != nil {
-		log.Println("Error adding track", err)
-		return err
+		log.Println("NewPeerConnection error occurred", err)
+		return nil, nil, nil, err
 	}
-	return nil
+	done, ok := v.peers.add(pc)
+	if !ok {
+		return nil, nil, nil, ErrShuttingDown
+	}
+	return pc, estimator, done, nil
 }
 
-// user is the caller of the method
-// if user connects before peer: since user is first, user will create the channel and track and will pass the track to the channel
-// if peer connects before user: since peer came already, he created the channel and is listning and waiting for me to create and pass track
-func createTrack(peerConnection *webrtc.PeerConnection, pcMapLocal map[string]chan *webrtc.TrackLocalStaticRTP, currentUserID string) error {
+// sendToMember delivers a server generated message to userID over its room websocket.
+func (v *videoCallService) sendToMember(roomID, userID string, data []byte) bool {
+	s := v.hub.session(roomID, userID)
+	return s != nil && v.hub.deliver(s, data) != deliveryFailed
+}
 
-	if _, err := peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
-		log.Println("Error occurred", err)
-		return err
+// stampSender makes the socket's identity authoritative: From is always the joined user, a message
+// claiming another sender or another room is rejected instead of forwarded.
+func stampSender(msg *dto.Message, sender *client) error {
+	if msg.From != nil && *msg.From != "" && *msg.From != sender.userID {
+		return errors.New(fmt.Sprintf("Spoofed sender %s, this socket is %s", *msg.From, sender.userID))
 	}
-	var ticker *time.Ticker
-	// Set a handler for when a new remote track starts, this just distributes all our packets
-	// to connected peers
-	peerConnection.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
-		// This can be less wasteful by processing incoming RTCP events, then we would emit a NACK/PLI when a viewer requests it
-		//Trong đoạn code có gợi ý rằng việc gửi PLI định kỳ có thể "lãng phí tài nguyên".
-		//  Một cách tối ưu hơn là lắng nghe các sự kiện RTCP từ người xem (viewers),
-		//  chỉ gửi PLI khi cần thiết (ví dụ, khi nhận được yêu cầu NACK hoặc PLI từ phía người xem).
-		//  Điều này giúp tiết kiệm băng thông và tài nguyên xử lý.
-		go func() {
-			ticker = time.NewTicker(rtcpPLIInterval)
-			for range ticker.C {
-				if rtcpSendErr := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(remoteTrack.SSRC())}}); rtcpSendErr != nil {
-					fmt.Println(rtcpSendErr)
-				}
-			}
-		}()
-
-		// Create a local track, all our SFU clients will be fed via this track
-		// main track of the broadcaster
-		localTrack, newTrackErr := webrtc.NewTrackLocalStaticRTP(
-			remoteTrack.Codec().RTPCodecCapability, // Use the codec from the remote track
-			"video",                                // Track ID
-			"pion",                                 // Stream ID
-		)
-		if newTrackErr != nil {
-			log.Println("Error occurred", newTrackErr)
-			return
-		}
-
-		// the channel that will have the local track that is used by the sender
-		// the localTrack needs to be fed to the receiver
-		localTrackChan := make(chan *webrtc.TrackLocalStaticRTP, 1)
-		localTrackChan <- localTrack
-		if existingChan, ok := pcMapLocal[currentUserID]; ok {
-			// feed the existing track from user with this track
-			existingChan <- localTrack
-		} else {
-			pcMapLocal[currentUserID] = localTrackChan
-		}
-
-		rtpBuf := make([]byte, 1400)
-		for { // for publisher only
-			i, _, readErr := remoteTrack.Read(rtpBuf)
-			if readErr != nil {
-				log.Println("Error occurred", readErr)
-				return // TODO maybe break instead of return?
-			}
-
-			// ErrClosedPipe means we don't have any subscribers, this is ok if no peers have connected yet
-			if _, err := localTrack.Write(rtpBuf[:i]); err != nil && !errors.Is(err, io.ErrClosedPipe) {
-				log.Println("Error occurred", err)
-				return // TODO maybe break instead of return?
-			}
-		}
-	})
-	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-		// TODO: improve stop ticker khi tất cả user out?
-		log.Println("Connection state changed:", state)
-		if state == webrtc.PeerConnectionStateClosed ||
-			state == webrtc.PeerConnectionStateDisconnected ||
-			state == webrtc.PeerConnectionStateFailed {
-			log.Println("Stopping RTCP PLI sender due to disconnection")
-			if ticker != nil {
-				ticker.Stop() // Stop the PLI sender
-			}
-		}
-	})
+	if msg.RoomID != "" && msg.RoomID != sender.roomID {
+		return errors.New(fmt.Sprintf("Room %s does not match joined room %s", msg.RoomID, sender.roomID))
+	}
+	msg.From = &sender.userID
+	msg.RoomID = sender.roomID
 	return nil
 }
 
 // Gửi tin nhắn đến tất cả user trong phòng
-func sendMsg(msg dto.Message, senderConn *websocket.Conn, broadcast bool) error {
-	var conf = *config.AppConfig.WebSock
-	conf.Mutex.Lock()
-	connections, exists := conf.RoomLst[msg.RoomID]
-	conf.Mutex.Unlock()
-
-	if !exists {
+func (v *videoCallService) sendMsg(msg dto.Message, sender *client, broadcast bool) error {
+	if !broadcast && *msg.To == dto.SfuPeer {
+		return v.sendToSfu(msg, sender)
+	}
+	connections := v.hub.members(msg.RoomID)
+	if connections == nil {
 		log.Printf("Room %s not found\n", msg.RoomID)
+		countMessage(routeOf(msg), dto.AckFailed)
 		return errors.New(fmt.Sprintf("Room %s not found", msg.RoomID))
 	}
 
@@ -311,9 +323,9 @@ func sendMsg(msg dto.Message, senderConn *websocket.Conn, broadcast bool) error
 		return errors.New(fmt.Sprintf("JSON encoding error: %s", err))
 	}
 	if broadcast {
-		sendBroadcast(msg, senderConn, connections, conf, data)
+		v.sendBroadcast(msg, sender, connections, data)
 	} else {
-		err2 := sendTo(msg, senderConn, connections, conf, data)
+		err2 := v.sendTo(msg, sender, connections, data)
 		if err2 != nil {
 			return err2
 		}
@@ -322,74 +334,109 @@ func sendMsg(msg dto.Message, senderConn *websocket.Conn, broadcast bool) error
 	return nil
 }
 
-func sendTo(msg dto.Message, senderConn *websocket.Conn,
-	connections map[string]*websocket.Conn, conf config.WebSocketConf, data []byte) error {
-	sent := false
+// sendToSfu hands a signaling message addressed to the "sfu" member to the SFU router, or to the
+// data channel hub on the data channel.
+func (v *videoCallService) sendToSfu(msg dto.Message, sender *client) error {
+	handleSignal := v.router.handleSignal
+	if msg.Channel != nil && *msg.Channel == dto.ChannelDataRtc {
+		handleSignal = v.data.handleSignal
+	}
+	if err := handleSignal(msg.RoomID, sender.userID, msg.Msg); err != nil {
+		sender.respond(dto.WsResponse{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+			ID:      msg.ID,
+			Ack:     dto.AckFailed,
+		})
+		countMessage(routeDirect, dto.AckFailed)
+		return err
+	}
+	sender.respond(dto.WsResponse{
+		Status:  http.StatusOK,
+		Message: fmt.Sprintf("Sent to %s", dto.SfuPeer),
+		ID:      msg.ID,
+		Ack:     dto.AckDelivered,
+	})
+	countMessage(routeDirect, dto.AckDelivered)
+	return nil
+}
+
+func (v *videoCallService) sendTo(msg dto.Message, sender *client, connections []*session, data []byte) error {
+	var recipient *session
 	// send to exactly userID
-	for user, conn := range connections {
-		if msg.From != nil && user == *msg.To {
-			conf.Mutex.Lock()
-			err := conn.WriteMessage(websocket.TextMessage, data)
-			conf.Mutex.Unlock()
-			if err != nil {
-				log.Printf("Failed to send message to %s: %v\n", user, err)
-			} else {
-				sent = true
-			}
+	for _, s := range connections {
+		if s.userID == *msg.To {
+			recipient = s
 			break
 		}
 	}
-	if !sent {
+	if recipient == nil {
+		if node, remote := v.hub.remoteNode(msg.RoomID, *msg.To); remote {
+			v.hub.publish(envelope{Kind: envelopeDirect, RoomID: msg.RoomID, From: sender.userID, To: *msg.To, Data: data})
+			sender.respond(dto.WsResponse{
+				Status:  http.StatusAccepted,
+				Message: fmt.Sprintf("Forwarded to %s via %s", *msg.To, node),
+				ID:      msg.ID,
+				Ack:     dto.AckForwarded,
+			})
+			countMessage(routeDirect, dto.AckForwarded)
+			return nil
+		}
+		log.Printf("Failed to send message to %s: not in room\n", *msg.To)
+		sender.respond(dto.WsResponse{
+			Status:  http.StatusNotFound,
+			Message: fmt.Sprintf("%s is not in room %s", *msg.To, msg.RoomID),
+			ID:      msg.ID,
+			Ack:     dto.AckNotInRoom,
+		})
+		countMessage(routeDirect, dto.AckNotInRoom)
+		return errors.New(fmt.Sprintf("%s is not in room %s", *msg.To, msg.RoomID))
+	}
+	switch v.hub.deliver(recipient, data) {
+	case deliverySent:
+		sender.respond(dto.WsResponse{
+			Status:  http.StatusOK,
+			Message: fmt.Sprintf("Sent to %s", *msg.To),
+			ID:      msg.ID,
+			Ack:     dto.AckDelivered,
+		})
+		countMessage(routeDirect, dto.AckDelivered)
+	case deliveryQueued:
+		sender.respond(dto.WsResponse{
+			Status:  http.StatusAccepted,
+			Message: fmt.Sprintf("Queued for %s", *msg.To),
+			ID:      msg.ID,
+			Ack:     dto.AckQueued,
+		})
+		countMessage(routeDirect, dto.AckQueued)
+	default:
 		log.Printf("Failed to send message to %s\n", *msg.To)
-		wsResponse(nil, senderConn, dto.WsResponse{
+		sender.respond(dto.WsResponse{
 			Status:  http.StatusInternalServerError,
 			Message: fmt.Sprintf("Failed to send message to %s", *msg.To),
+			ID:      msg.ID,
+			Ack:     dto.AckFailed,
 		})
+		countMessage(routeDirect, dto.AckFailed)
 		return errors.New(fmt.Sprintf("Failed to send message to %s", *msg.To))
 	}
-	wsResponse(conf.Mutex, senderConn, dto.WsResponse{
-		Status:  http.StatusOK,
-		Message: fmt.Sprintf("Sent to %s", *msg.To),
-	})
 	return nil
 }
 
-func sendBroadcast(msg dto.Message, senderConn *websocket.Conn,
-	connections map[string]*websocket.Conn, conf config.WebSocketConf, data []byte) {
-	log.Println("Send broadcast from ", *msg.From)
+func (v *videoCallService) sendBroadcast(msg dto.Message, sender *client, connections []*session, data []byte) {
+	log.Println("Send broadcast from ", sender.userID)
 	// Gửi tin nhắn đến tất cả user trong phòng (trừ chính người gửi)
-	for user, conn := range connections {
-		if msg.From != nil && user != *msg.From {
-			conf.Mutex.Lock()
-			err := conn.WriteMessage(websocket.TextMessage, data)
-			conf.Mutex.Unlock()
-			if err != nil {
-				log.Printf("Failed to send message to %s: %v\n", user, err)
-			}
+	for _, s := range connections {
+		if s.userID != sender.userID {
+			v.hub.deliver(s, data)
 		}
 	}
-	wsResponse(nil, senderConn, dto.WsResponse{
+	v.hub.publish(envelope{Kind: envelopeBroadcast, RoomID: msg.RoomID, From: sender.userID, Data: data})
+	sender.respond(dto.WsResponse{
 		Status:  http.StatusOK,
 		Message: "Send broadcast msg successfully",
+		ID:      msg.ID,
+		Ack:     dto.AckDelivered,
 	})
-}
-
-func wsResponse(mutex *sync.Mutex, conn *websocket.Conn, resp dto.WsResponse) {
-	resp.Time = time.Now().Unix()
-	data, err := json.Marshal(resp)
-	if err != nil {
-		log.Println("Failed to encode response:", err)
-		return
-	}
-
-	if conn != nil {
-		if mutex != nil {
-			mutex.Lock()
-			defer mutex.Unlock()
-		}
-		err := conn.WriteMessage(websocket.TextMessage, data)
-		if err != nil {
-			log.Println("Failed to send response:", err)
-		}
-	}
+	countMessage(routeBroadcast, dto.AckDelivered)
 }
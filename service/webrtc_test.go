@@ -0,0 +1,113 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+
+	"go-rest-api/dto"
+)
+
+func TestStampSender(t *testing.T) {
+	tests := []struct {
+		name    string
+		from    *string
+		roomID  string
+		wantErr bool
+	}{
+		{"no sender or room", nil, "", false},
+		{"empty sender", strPtr(""), "", false},
+		{"own identity", strPtr("u1"), "r", false},
+		{"spoofed sender", strPtr("u2"), "r", true},
+		{"other room", strPtr("u1"), "r2", true},
+		{"other room without a sender", nil, "r2", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := dto.Message{From: tt.from, RoomID: tt.roomID, Msg: "m"}
+			err := stampSender(&msg, &client{roomID: "r", userID: "u1"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("stampSender() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && (msg.From == nil || *msg.From != "u1" || msg.RoomID != "r") {
+				t.Errorf("stampSender() stamped %v in %q, want u1 in r", msg.From, msg.RoomID)
+			}
+		})
+	}
+}
+
+func TestSendMsgAcks(t *testing.T) {
+	tests := []struct {
+		name string
+		to   *string
+		// prepare puts the recipient in the state under test
+		prepare func(t *testing.T, h *hub)
+		want    string
+	}{
+		{"delivered", strPtr("u2"), func(t *testing.T, h *hub) {
+			joinTest(t, h, "u2")
+		}, dto.AckDelivered},
+		{"queued while resuming", strPtr("u2"), func(t *testing.T, h *hub) {
+			s := joinTest(t, h, "u2").session
+			h.mutex.Lock()
+			s.client = nil
+			h.mutex.Unlock()
+		}, dto.AckQueued},
+		{"failed on a closed socket", strPtr("u2"), func(t *testing.T, h *hub) {
+			close(joinTest(t, h, "u2").done)
+		}, dto.AckFailed},
+		{"forwarded to another instance", strPtr("u2"), func(t *testing.T, h *hub) {
+			h.handleEnvelope(envelope{Node: "other", Kind: envelopePresence, RoomID: "r", From: "u2", Event: dto.PeerJoined})
+		}, dto.AckForwarded},
+		{"not in room", strPtr("u2"), func(t *testing.T, h *hub) {}, dto.AckNotInRoom},
+		{"broadcast", nil, func(t *testing.T, h *hub) {
+			joinTest(t, h, "u2")
+		}, dto.AckDelivered},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := testHub(t)
+			v := &videoCallService{hub: h}
+			sender := joinTest(t, h, "u1")
+			tt.prepare(t, h)
+			msg := dto.Message{To: tt.to, Msg: "m", ID: strPtr("id1")}
+			if err := stampSender(&msg, sender); err != nil {
+				t.Fatal(err)
+			}
+			_ = v.sendMsg(msg, sender, msg.To == nil)
+
+			var resp dto.WsResponse
+			if err := json.Unmarshal(lastSent(sender), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Ack != tt.want || resp.ID == nil || *resp.ID != "id1" {
+				t.Errorf("ack = %q for %v, want %q for id1", resp.Ack, resp.ID, tt.want)
+			}
+		})
+	}
+}
+
+func strPtr(s string) *string { return &s }
+
+// joinTest joins userID to room r, with its welcome and the presence events drained.
+func joinTest(t *testing.T, h *hub, userID string) *client {
+	t.Helper()
+	c := testClient(h, "r", userID)
+	if _, err := h.join(c, ""); err != nil {
+		t.Fatal(err)
+	}
+	lastSent(c)
+	return c
+}
+
+// lastSent drains what was queued for c and returns the last message.
+func lastSent(c *client) []byte {
+	var last []byte
+	for {
+		select {
+		case data := <-c.send:
+			last = data
+		default:
+			return last
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+	"go-rest-api/dto"
+)
+
+var (
+	ErrPublisherNotFound     = errors.New("publisher not found in this room")
+	ErrPublisherNotStreaming = errors.New("publisher is connected but has not published a track yet")
+)
+
+// Subscribe answers a WHEP offer with the tracks of publisherID, or of the room's device when it is empty.
+// The viewer is admitted like a websocket join. It fails fast when there is nothing to watch:
+// ErrPublisherNotFound when the publisher is not in the room, ErrPublisherNotStreaming when it is
+// but its tracks are not up yet.
+func (v *videoCallService) Subscribe(req dto.JoinRequest, publisherID, offer string) (string, string, error) {
+	resourceID := newID()
+	if err := v.hub.admitPeer(req, resourceID); err != nil {
+		return "", "", err
+	}
+	if publisherID == "" {
+		publisherID = v.roomDevice(req.RoomID)
+	}
+	if publisherID == "" {
+		v.hub.releasePeer(req.RoomID, resourceID)
+		return "", "", ErrPublisherNotFound
+	}
+	if err := v.publisherStreaming(req.RoomID, publisherID); err != nil {
+		v.hub.releasePeer(req.RoomID, resourceID)
+		return "", "", err
+	}
+	pc, estimator, done, err := v.newPeerConnection()
+	if err != nil {
+		v.hub.releasePeer(req.RoomID, resourceID)
+		return "", "", err
+	}
+	v.releaseWhenDone(req.RoomID, resourceID, done)
+	fail := func(err error) (string, string, error) {
+		sfuPeerConnectionsTotal.WithLabelValues("subscriber", "error").Inc()
+		_ = pc.Close()
+		return "", "", err
+	}
+	peer := &sfuPeer{key: resourceID, roomID: req.RoomID, userID: req.UserID, pc: pc, estimator: estimator, done: done, subscribe: true, publisher: publisherID}
+	v.router.addPeer(peer)
+	// WHEP has no renegotiation: the answer carries the tracks published by now
+	if v.router.subscribeExisting(peer) == 0 {
+		return fail(ErrPublisherNotStreaming)
+	}
+	answer, err := answerOffer(pc, offer)
+	if err != nil {
+		return fail(err)
+	}
+	sfuPeerConnectionsTotal.WithLabelValues("subscriber", "ok").Inc()
+
+	v.whep.add(resourceID, req, pc, done)
+	log.Printf("[%s] %s watching %s over WHEP, resource %s\n", req.RoomID, req.UserID, publisherID, resourceID)
+	return resourceID, answer, nil
+}
+
+// TrickleSubscriber adds the candidates of a trickle-ice-sdpfrag body to a WHEP session.
+func (v *videoCallService) TrickleSubscriber(req dto.JoinRequest, resourceID, fragment string) error {
+	s, err := v.whep.get(req, resourceID)
+	if err != nil {
+		return err
+	}
+	return trickle(s.pc, fragment)
+}
+
+// Unsubscribe ends the WHEP session.
+func (v *videoCallService) Unsubscribe(req dto.JoinRequest, resourceID string) error {
+	s, err := v.whep.get(req, resourceID)
+	if err != nil {
+		return err
+	}
+	log.Printf("[%s] %s stopped watching, resource %s\n", req.RoomID, req.UserID, resourceID)
+	return s.pc.Close()
+}
+
+// roomDevice returns the device of roomID, a member or a WHIP publisher, preferring one that streams.
+// It returns "" when the room has no device.
+func (v *videoCallService) roomDevice(roomID string) string {
+	var devices []string
+	for _, peer := range v.hub.peers(roomID) {
+		if peer.Role == dto.RoleDevice {
+			devices = append(devices, peer.UserID)
+		}
+	}
+	devices = append(devices, v.whip.users(roomID, dto.RoleDevice)...)
+	for _, device := range devices {
+		if v.router.hasTracks(roomID, device) {
+			return device
+		}
+	}
+	if len(devices) > 0 {
+		return devices[0]
+	}
+	return ""
+}
+
+// publisherStreaming fails with ErrPublisherNotStreaming when publisherID (or any publisher when empty)
+// has no track in roomID but is present, with ErrPublisherNotFound when it is not.
+func (v *videoCallService) publisherStreaming(roomID, publisherID string) error {
+	if v.router.hasTracks(roomID, publisherID) {
+		return nil
+	}
+	if v.publisherPresent(roomID, publisherID) {
+		return ErrPublisherNotStreaming
+	}
+	return ErrPublisherNotFound
+}
+
+// publisherPresent tells whether publisherID (or the room's device when empty) is in the room,
+// over the websocket or an SFU peer connection, even though it has no track yet.
+func (v *videoCallService) publisherPresent(roomID, publisherID string) bool {
+	for _, peer := range v.hub.peers(roomID) {
+		if peer.UserID == publisherID || (publisherID == "" && peer.Role == dto.RoleDevice) {
+			return true
+		}
+	}
+	return publisherID != "" && v.router.hasPeer(roomID, publisherID)
+}
@@ -0,0 +1,197 @@
+package service
+
+import (
+	"bufio"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pkg/errors"
+	"go-rest-api/config"
+	"go-rest-api/dto"
+)
+
+// gatherTimeout bounds the wait for the server's ICE candidates, WHIP answers are sent complete
+const gatherTimeout = 5 * time.Second
+
+var (
+	ErrResourceNotFound = errors.New("session resource not found")
+	ErrInvalidOffer     = errors.New("invalid offer")
+	ErrIceRestart       = errors.New("ICE restart is not supported, start a new session")
+	ErrInvalidSdpFrag   = errors.New("invalid trickle-ice-sdpfrag body")
+	ErrNotPublisher     = errors.New("this role may not publish in the room")
+)
+
+// resourceSession is a peer connection created through WHIP or WHEP, addressed by its resource ID
+type resourceSession struct {
+	roomID string
+	userID string
+	role   string
+	pc     *webrtc.PeerConnection
+}
+
+// resourceSessions keeps the WHIP/WHEP resources until DELETE or until their peer connection is gone
+type resourceSessions struct {
+	mutex    sync.Mutex
+	sessions map[string]*resourceSession // resource ID -> session
+}
+
+func newResourceSessions() *resourceSessions {
+	return &resourceSessions{sessions: make(map[string]*resourceSession)}
+}
+
+// add registers pc under resourceID, it is dropped once done is closed.
+func (r *resourceSessions) add(resourceID string, req dto.JoinRequest, pc *webrtc.PeerConnection, done <-chan struct{}) {
+	r.mutex.Lock()
+	r.sessions[resourceID] = &resourceSession{roomID: req.RoomID, userID: req.UserID, role: req.Role, pc: pc}
+	r.mutex.Unlock()
+	go func() {
+		<-done
+		r.mutex.Lock()
+		delete(r.sessions, resourceID)
+		r.mutex.Unlock()
+		log.Printf("[%s] %s session %s ended\n", req.RoomID, req.UserID, resourceID)
+	}()
+}
+
+// users returns the users of roomID holding role.
+func (r *resourceSessions) users(roomID, role string) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var users []string
+	for _, s := range r.sessions {
+		if s.roomID == roomID && s.role == role {
+			users = append(users, s.userID)
+		}
+	}
+	return users
+}
+
+// get returns the resource if it belongs to the caller, others get ErrResourceNotFound too.
+func (r *resourceSessions) get(req dto.JoinRequest, resourceID string) (*resourceSession, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	s, exists := r.sessions[resourceID]
+	if !exists || s.roomID != req.RoomID || s.userID != req.UserID {
+		return nil, ErrResourceNotFound
+	}
+	return s, nil
+}
+
+// Publish answers a WHIP offer, the published tracks are forwarded to the subscribers of the room.
+// The publisher is admitted like a websocket join and must hold a publishing role.
+// It returns the resource ID and the answer with the server candidates.
+func (v *videoCallService) Publish(req dto.JoinRequest, offer string) (string, string, error) {
+	if !canPublish(req.Role) {
+		return "", "", errors.Wrap(ErrNotPublisher, req.Role)
+	}
+	resourceID := newID()
+	if err := v.hub.admitPeer(req, resourceID); err != nil {
+		return "", "", err
+	}
+	pc, estimator, done, err := v.newPeerConnection()
+	if err != nil {
+		v.hub.releasePeer(req.RoomID, resourceID)
+		return "", "", err
+	}
+	v.releaseWhenDone(req.RoomID, resourceID, done)
+	v.router.addPeer(&sfuPeer{key: resourceID, roomID: req.RoomID, userID: req.UserID, pc: pc, estimator: estimator, done: done})
+	answer, err := answerOffer(pc, offer)
+	if err != nil {
+		sfuPeerConnectionsTotal.WithLabelValues("publisher", "error").Inc()
+		_ = pc.Close()
+		return "", "", err
+	}
+	sfuPeerConnectionsTotal.WithLabelValues("publisher", "ok").Inc()
+
+	v.whip.add(resourceID, req, pc, done)
+	log.Printf("[%s] %s publishing over WHIP, resource %s\n", req.RoomID, req.UserID, resourceID)
+	return resourceID, answer, nil
+}
+
+// releaseWhenDone keeps the WHIP/WHEP client of resourceID counted in its room until its peer connection is done.
+func (v *videoCallService) releaseWhenDone(roomID, resourceID string, done <-chan struct{}) {
+	go func() {
+		<-done
+		v.hub.releasePeer(roomID, resourceID)
+	}()
+}
+
+// canPublish tells whether role may send media to the SFU, viewers only watch.
+func canPublish(role string) bool {
+	return role == dto.RoleDevice || role == dto.RoleOperator
+}
+
+// answerOffer applies a WHIP/WHEP offer and returns the answer once the server candidates are
+// gathered, the HTTP answer is the only way they reach the client.
+func answerOffer(pc *webrtc.PeerConnection, offer string) (string, error) {
+	offer = config.AppConfig.Codecs.CompleteOffer(offer)
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return "", errors.Wrap(ErrInvalidOffer, err.Error())
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	select {
+	case <-gathered:
+	case <-time.After(gatherTimeout):
+		log.Println("answer sent before ICE gathering completed")
+	}
+	return pc.LocalDescription().SDP, nil
+}
+
+// Trickle adds the candidates of a trickle-ice-sdpfrag (RFC 8840) body to the session.
+func (v *videoCallService) Trickle(req dto.JoinRequest, resourceID, fragment string) error {
+	s, err := v.whip.get(req, resourceID)
+	if err != nil {
+		return err
+	}
+	return trickle(s.pc, fragment)
+}
+
+// Unpublish ends the WHIP session, its subscribers lose the track.
+func (v *videoCallService) Unpublish(req dto.JoinRequest, resourceID string) error {
+	s, err := v.whip.get(req, resourceID)
+	if err != nil {
+		return err
+	}
+	log.Printf("[%s] %s stopped publishing, resource %s\n", req.RoomID, req.UserID, resourceID)
+	return s.pc.Close()
+}
+
+// trickle parses an SDP fragment and adds its candidates to pc under the media section they follow.
+func trickle(pc *webrtc.PeerConnection, fragment string) error {
+	remote := pc.RemoteDescription()
+	if remote == nil {
+		return ErrInvalidSdpFrag
+	}
+	var mid string
+	scanner := bufio.NewScanner(strings.NewReader(fragment))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			if !strings.Contains(remote.SDP, line) {
+				return ErrIceRestart
+			}
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidate := webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a=")}
+			if mid != "" {
+				candidate.SDPMid = &mid
+			}
+			if err := pc.AddICECandidate(candidate); err != nil {
+				return errors.Wrap(ErrInvalidSdpFrag, err.Error())
+			}
+		}
+	}
+	return scanner.Err()
+}
@@ -42,6 +42,7 @@ func (s *socketService) InitWebSocketKeepConnection(ctx context.Context, usernam
 		return nil, err
 	}
 	ws := webrtc.NewWebsocketClient(conf.Url)
+	ws.SetRole(webrtc.RoleDevice)
 	err = ws.Connect(conf.Room, username)
 	if err != nil {
 		log.Println("InitWebSocketKeepConnection:", err)
@@ -0,0 +1,119 @@
+package webrtc
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/interceptor/pkg/twcc"
+	pionwebrtc "github.com/pion/webrtc/v4"
+)
+
+// codecsResponse is the body of the server's GET /codecs, the codec registry in priority order
+type codecsResponse struct {
+	Video []codecResponse `json:"video"`
+	Audio []codecResponse `json:"audio"`
+}
+
+type codecResponse struct {
+	MimeType     string `json:"mimeType"`
+	ClockRate    uint32 `json:"clockRate"`
+	Channels     uint16 `json:"channels,omitempty"`
+	PayloadType  uint8  `json:"payloadType"`
+	SdpFmtpLine  string `json:"sdpFmtpLine,omitempty"`
+	RtcpFeedback []struct {
+		Type      string `json:"type"`
+		Parameter string `json:"parameter,omitempty"`
+	} `json:"rtcpFeedback,omitempty"`
+}
+
+// Codecs fetches the codec registry of the signaling server, a MediaEngine built from it negotiates
+// the same codecs, payload types and RTCP feedback as the SFU.
+func (w *WebsocketClient) Codecs() (video, audio []pionwebrtc.RTPCodecParameters, err error) {
+	var body codecsResponse
+	if err := w.getJSON("/codecs", nil, &body); err != nil {
+		return nil, nil, err
+	}
+	return codecParameters(body.Video), codecParameters(body.Audio), nil
+}
+
+func codecParameters(codecs []codecResponse) []pionwebrtc.RTPCodecParameters {
+	params := make([]pionwebrtc.RTPCodecParameters, 0, len(codecs))
+	for _, c := range codecs {
+		p := pionwebrtc.RTPCodecParameters{
+			RTPCodecCapability: pionwebrtc.RTPCodecCapability{
+				MimeType:    c.MimeType,
+				ClockRate:   c.ClockRate,
+				Channels:    c.Channels,
+				SDPFmtpLine: c.SdpFmtpLine,
+			},
+			PayloadType: pionwebrtc.PayloadType(c.PayloadType),
+		}
+		for _, f := range c.RtcpFeedback {
+			p.RTCPFeedback = append(p.RTCPFeedback, pionwebrtc.RTCPFeedback{Type: f.Type, Parameter: f.Parameter})
+		}
+		params = append(params, p)
+	}
+	return params
+}
+
+// apiOf builds the peer connection API from the codec registry of the signaling server, falling back
+// to the pion defaults. As on the SFU, the interceptors add no RTCP feedback of their own: NACK and
+// TWCC are only negotiated for the codecs whose registry entry lists them.
+func apiOf(ws *WebsocketClient) *pionwebrtc.API {
+	video, audio, err := ws.Codecs()
+	if err == nil && len(video)+len(audio) == 0 {
+		err = fmt.Errorf("empty codec registry")
+	}
+	if err == nil {
+		api, apiErr := registryAPI(video, audio)
+		if apiErr == nil {
+			return api
+		}
+		err = apiErr
+	}
+	log.Printf("using default codecs: %v", err)
+	return pionwebrtc.NewAPI()
+}
+
+func registryAPI(video, audio []pionwebrtc.RTPCodecParameters) (*pionwebrtc.API, error) {
+	media := &pionwebrtc.MediaEngine{}
+	for _, codec := range video {
+		if err := media.RegisterCodec(codec, pionwebrtc.RTPCodecTypeVideo); err != nil {
+			return nil, fmt.Errorf("codec %s: %w", codec.MimeType, err)
+		}
+	}
+	for _, codec := range audio {
+		if err := media.RegisterCodec(codec, pionwebrtc.RTPCodecTypeAudio); err != nil {
+			return nil, fmt.Errorf("codec %s: %w", codec.MimeType, err)
+		}
+	}
+
+	registry := &interceptor.Registry{}
+	responder, err := nack.NewResponderInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	generator, err := nack.NewGeneratorInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	registry.Add(responder)
+	registry.Add(generator)
+	if err := pionwebrtc.ConfigureRTCPReports(registry); err != nil {
+		return nil, err
+	}
+	feedback, err := twcc.NewSenderInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	registry.Add(feedback)
+	if err := pionwebrtc.ConfigureTWCCHeaderExtensionSender(media, registry); err != nil {
+		return nil, err
+	}
+	if err := pionwebrtc.ConfigureSimulcastExtensionHeaders(media); err != nil {
+		return nil, err
+	}
+	return pionwebrtc.NewAPI(pionwebrtc.WithMediaEngine(media), pionwebrtc.WithInterceptorRegistry(registry)), nil
+}
@@ -12,3 +12,10 @@ const (
   MaximumTransmissionUnit = 1500
   PictureLossIndication   = time.Second * 3
 )
+
+// Roles of a room member on the signaling server, the UAV joins as the device (master) of its room
+const (
+  RoleDevice   = "device"
+  RoleOperator = "operator"
+  RoleViewer   = "viewer"
+)
@@ -4,6 +4,7 @@ import (
   "encoding/base64"
   "encoding/json"
   "errors"
+  "fmt"
   "log"
   "sync"
 
@@ -19,12 +20,17 @@ type DataChannelClient struct {
   ws *WebsocketClient
 
   config pionwebrtc.Configuration
+  setup  sync.Once // fetches the ICE servers with the first peer connection, see peerConfig
 
-  mu                 sync.Mutex
-  peers              map[string]*pionwebrtc.PeerConnection
-  dataChannels       map[string]*pionwebrtc.DataChannel
-  pendingCandidates  map[string][]pionwebrtc.ICECandidateInit
-  onMessageListeners []func(string)
+  mu                     sync.Mutex
+  peers                  map[string]*pionwebrtc.PeerConnection
+  dataChannels           map[string]*pionwebrtc.DataChannel // by peer id, by relayed member through the SFU
+  pendingCandidates      map[string][]pionwebrtc.ICECandidateInit
+  onMessageListeners     []func(string)
+  onMessageFromListeners []func(from, message string)
+
+  sfu       bool   // messages are relayed by the server instead of one peer connection per member
+  publisher string // with sfu: the only member messages are exchanged with, "" for all
 }
 
 // NewDataChannelClient creates and connects the signaling websocket and prepares handlers.
@@ -55,15 +61,20 @@ func NewDataChannelClientWithWS(userID, roomID string, isMaster bool, ws *Websoc
   return c, nil
 }
 
+// peerConfig fetches the ICE servers once, late enough for the websocket's auth token to be set.
+func (c *DataChannelClient) peerConfig() pionwebrtc.Configuration {
+  c.setup.Do(func() {
+    c.config.ICEServers = iceServersOf(c.ws, c.userID)
+  })
+  return c.config
+}
+
 // newDataChannelClientBase creates the common DataChannelClient struct fields.
 func newDataChannelClientBase(userID, roomID string, isMaster bool) *DataChannelClient {
   return &DataChannelClient{
     userID:   userID,
     roomID:   roomID,
     isMaster: isMaster,
-    config: pionwebrtc.Configuration{
-      ICEServers: []pionwebrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}},
-    },
     peers:             make(map[string]*pionwebrtc.PeerConnection),
     dataChannels:      make(map[string]*pionwebrtc.DataChannel),
     pendingCandidates: make(map[string][]pionwebrtc.ICECandidateInit),
@@ -93,6 +104,9 @@ func (c *DataChannelClient) listenSignaling() {
 
     // Handle base64 payloads similar to TS implementation
     if msg.Channel != nil && *msg.Channel == ChannelDataRtc {
+      if msg.Msg == RequestJoinDataChannel && c.viaSfu() {
+        continue // the members reach us through the SFU
+      }
       if msg.Msg == RequestJoinDataChannel {
         if c.isMaster {
           // TODO: in UAV, ignore this prompt dialog for allow other clients to join
@@ -111,6 +125,9 @@ func (c *DataChannelClient) listenSignaling() {
 }
 
 func (c *DataChannelClient) initDataChannel() {
+  if c.viaSfu() {
+    return
+  }
   if !c.isMaster {
     // send request join
     m := SignalMsg{Channel: getValue(ChannelDataRtc), Msg: RequestJoinDataChannel, From: c.userID, RoomId: c.roomID}
@@ -218,7 +235,7 @@ func (c *DataChannelClient) getAndClearPendingCandidates(sid string) {
 
 func (c *DataChannelClient) createDataChannelConnection(sid string, isCaller bool) error {
   log.Printf("setup data channel for %s", sid)
-  pc, err := pionwebrtc.NewPeerConnection(c.config)
+  pc, err := pionwebrtc.NewPeerConnection(c.peerConfig())
   if err != nil {
     return err
   }
@@ -234,13 +251,27 @@ func (c *DataChannelClient) createDataChannelConnection(sid string, isCaller boo
   })
 
   pc.OnDataChannel(func(d *pionwebrtc.DataChannel) {
+    // the SFU opens one channel per member it relays, labelled with the member's id
+    from := sid
+    if sid == SfuPeer {
+      from = d.Label()
+    }
     d.OnMessage(func(msg pionwebrtc.DataChannelMessage) {
       text := string(msg.Data)
-      log.Printf("Received message from %s: %s", sid, text)
-      c.dispatchOnMessage(text)
+      log.Printf("Received message from %s: %s", from, text)
+      c.dispatchOnMessage(from, text)
+    })
+    d.OnOpen(func() { log.Printf("DataChannel Open for %s", from) })
+    d.OnClose(func() {
+      c.mu.Lock()
+      if c.dataChannels[from] == d {
+        delete(c.dataChannels, from)
+      }
+      c.mu.Unlock()
     })
-    d.OnOpen(func() { log.Printf("DataChannel Open for %s", sid) })
-    c.dataChannels[sid] = d
+    c.mu.Lock()
+    c.dataChannels[from] = d
+    c.mu.Unlock()
   })
 
   if isCaller {
@@ -249,14 +280,19 @@ func (c *DataChannelClient) createDataChannelConnection(sid string, isCaller boo
       dc.OnMessage(func(msg pionwebrtc.DataChannelMessage) {
         text := string(msg.Data)
         log.Printf("Received message from %s: %s", sid, text)
-        c.dispatchOnMessage(text)
+        c.dispatchOnMessage(sid, text)
       })
+      c.mu.Lock()
       c.dataChannels[sid] = dc
+      c.mu.Unlock()
     }
     offer, err := pc.CreateOffer(nil)
     if err == nil {
       _ = pc.SetLocalDescription(offer)
       obj := map[string]interface{}{"type": offer.Type.String(), "sdp": pc.LocalDescription()}
+      if sid == SfuPeer && c.publisher != "" {
+        obj["publisher"] = c.publisher
+      }
       enc, _ := json.Marshal(obj)
       m := SignalMsg{Channel: getValue(ChannelDataRtc), Msg: base64.StdEncoding.EncodeToString(enc), From: c.userID, To: sid, RoomId: c.roomID}
       _ = c.ws.Send(m)
@@ -285,12 +321,28 @@ func (c *DataChannelClient) AddOnMessageEventListener(cb func(message string)) {
   c.mu.Unlock()
   log.Printf("Added OnMessage listener. Total listeners: %d", count)
 }
-func (c *DataChannelClient) dispatchOnMessage(message string) {
+
+// AddOnMessageFromEventListener registers a callback invoked with the sender and the text of each
+// datachannel message, the sender is kept when the SFU relays the message.
+func (c *DataChannelClient) AddOnMessageFromEventListener(cb func(from, message string)) {
+  if cb == nil {
+    return
+  }
+  c.mu.Lock()
+  c.onMessageFromListeners = append(c.onMessageFromListeners, cb)
+  c.mu.Unlock()
+}
+
+func (c *DataChannelClient) dispatchOnMessage(from, message string) {
   c.mu.Lock()
   listeners := append([]func(string){}, c.onMessageListeners...)
+  fromListeners := append([]func(string, string){}, c.onMessageFromListeners...)
   c.mu.Unlock()
+  for _, cb := range fromListeners {
+    go cb(from, message)
+  }
   log.Printf("Dispatching message '%s' to %d listeners", message, len(listeners))
-  if len(listeners) == 0 {
+  if len(listeners)+len(fromListeners) == 0 {
     log.Printf("WARNING: No listeners registered for message: %s", message)
   }
   for _, cb := range listeners {
@@ -299,9 +351,18 @@ func (c *DataChannelClient) dispatchOnMessage(message string) {
   }
 }
 
-// SendMsg broadcasts text message to all open data channels
+// SendMsg broadcasts text message to all open data channels, through the SFU it is sent once and
+// relayed by the server to the members following us.
 func (c *DataChannelClient) SendMsg(message string) {
+  c.mu.Lock()
+  channels := make(map[string]*pionwebrtc.DataChannel, len(c.dataChannels))
   for sid, ch := range c.dataChannels {
+    if !c.sfu || sid == SfuPeer {
+      channels[sid] = ch
+    }
+  }
+  c.mu.Unlock()
+  for sid, ch := range channels {
     if ch != nil {
       if err := ch.SendText(message); err != nil {
         log.Printf("send to %s error: %v", sid, err)
@@ -310,6 +371,38 @@ func (c *DataChannelClient) SendMsg(message string) {
   }
 }
 
+// SendMsgTo sends text message to the member userID only, through the SFU on the channel it relays.
+func (c *DataChannelClient) SendMsgTo(userID, message string) error {
+  c.mu.Lock()
+  ch := c.dataChannels[userID]
+  c.mu.Unlock()
+  if ch == nil {
+    return fmt.Errorf("no data channel to %s", userID)
+  }
+  return ch.SendText(message)
+}
+
+// JoinSfu opens a single data channel to the server's SFU instead of one peer connection per member:
+// the server relays our messages to the members following us and theirs to us, each member arriving
+// on its own channel. With a publisher, messages are only exchanged with that member, e.g. a viewer
+// following its UAV.
+func (c *DataChannelClient) JoinSfu(publisher string) error {
+  c.mu.Lock()
+  if c.sfu {
+    c.mu.Unlock()
+    return nil
+  }
+  c.sfu, c.publisher = true, publisher
+  c.mu.Unlock()
+  return c.createDataChannelConnection(SfuPeer, true)
+}
+
+func (c *DataChannelClient) viaSfu() bool {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.sfu
+}
+
 // Close cleans up api
 func (c *DataChannelClient) Close() {
   c.ws.Close()
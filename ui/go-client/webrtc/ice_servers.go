@@ -0,0 +1,95 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	pionwebrtc "github.com/pion/webrtc/v4"
+)
+
+// fallbackIceServers is used when the signaling server can't be asked for its ICE servers
+var fallbackIceServers = []pionwebrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}}
+
+// iceServersResponse is the body of the server's GET /ice-servers
+type iceServersResponse struct {
+	IceServers []struct {
+		URLs       []string `json:"urls"`
+		Username   string   `json:"username,omitempty"`
+		Credential string   `json:"credential,omitempty"`
+	} `json:"iceServers"`
+}
+
+// IceServers fetches the STUN/TURN servers of the signaling server, TURN credentials are issued
+// for the auth token (or userId when the server runs without auth).
+func (w *WebsocketClient) IceServers(userId string) ([]pionwebrtc.ICEServer, error) {
+	var body iceServersResponse
+	if err := w.getJSON("/ice-servers", url.Values{"userId": []string{userId}}, &body); err != nil {
+		return nil, err
+	}
+	servers := make([]pionwebrtc.ICEServer, 0, len(body.IceServers))
+	for _, s := range body.IceServers {
+		server := pionwebrtc.ICEServer{URLs: s.URLs, Username: s.Username}
+		if s.Credential != "" {
+			server.Credential = s.Credential
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// getJSON decodes the answer to a GET of path on the signaling server, next to its /ws endpoint and
+// with the same auth token.
+func (w *WebsocketClient) getJSON(path string, query url.Values, out any) error {
+	w.mu.Lock()
+	base, token := w.url, w.token
+	w.mu.Unlock()
+
+	u, err := url.Parse(base)
+	if err != nil {
+		return fmt.Errorf("invalid websocket url %q: %w", base, err)
+	}
+	switch u.Scheme {
+	case "wss":
+		u.Scheme = "https"
+	default:
+		u.Scheme = "http"
+	}
+	u.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/ws") + path
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u.Path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// iceServersOf asks the signaling server for its ICE servers, falling back to public STUN.
+func iceServersOf(ws *WebsocketClient, userId string) []pionwebrtc.ICEServer {
+	servers, err := ws.IceServers(userId)
+	if err == nil && len(servers) == 0 {
+		err = fmt.Errorf("server listed no ICE servers")
+	}
+	if err != nil {
+		log.Printf("using fallback ICE servers: %v", err)
+		return fallbackIceServers
+	}
+	return servers
+}
@@ -11,6 +11,10 @@ const (
 	ChannelWebrtc  Channel = "md"
 )
 
+// SfuPeer is the server's SFU as a room member: webrtc signals sent To it negotiate one peer connection
+// that publishes the local tracks and receives the tracks of the other publishers of the room
+const SfuPeer = "sfu"
+
 type SignalType string
 
 const (
@@ -26,8 +30,20 @@ type SignalMsg struct {
 	Msg     interface{} `json:"msg"`
 	RoomId  string      `json:"roomId,omitempty"`
 	Status  int         `json:"status,omitempty"`
+	ID      string      `json:"id,omitempty"`  // message id, echoed by the server in the response acknowledging it
+	Ack     string      `json:"ack,omitempty"` // set on server responses only, see AckDelivered...
 }
 
+// Delivery outcomes the server reports in SignalMsg.Ack
+const (
+	AckDelivered = "delivered"
+	AckQueued    = "queued"
+	AckForwarded = "forwarded" // recipient is on another signaling instance
+	AckNotInRoom = "not-in-room"
+	AckRejected  = "rejected"
+	AckFailed    = "failed"
+)
+
 // UnmarshalJSON decodes a JSON string into *Channel.
 func (c *Channel) UnmarshalJSON(b []byte) error {
   // handle explicit null
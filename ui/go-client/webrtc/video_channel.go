@@ -23,6 +23,8 @@ type VideoChannelClient struct {
 	isMaster bool
 
 	config pionwebrtc.Configuration
+	api    *pionwebrtc.API // MediaEngine from the server's codec registry
+	setup  sync.Once       // fetches the ICE servers and codecs with the first peer connection, see peerSetup
 
 	mu    sync.Mutex
 	peers map[string]*pionwebrtc.PeerConnection
@@ -42,24 +44,17 @@ type VideoChannelClient struct {
 
 // NewVideoChannelClient constructs the client and connects to signaling websocket.
 func NewVideoChannelClient(userID, roomName string, isMaster bool, socketURL string, signalServers ...pionwebrtc.ICEServer) (*VideoChannelClient, error) {
-	cfg := pionwebrtc.Configuration{}
-	if len(signalServers) > 0 {
-		cfg.ICEServers = signalServers
-	} else {
-		cfg.ICEServers = []pionwebrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}}
-	}
-
+	ws := NewWebsocketClient(socketURL)
 	c := &VideoChannelClient{
 		userID:            userID,
 		roomID:            roomName,
 		isMaster:          isMaster,
-		config:            cfg,
+		config:            pionwebrtc.Configuration{ICEServers: signalServers},
 		peers:             make(map[string]*pionwebrtc.PeerConnection),
 		streams:           make(map[string][]*pionwebrtc.TrackRemote),
 		pendingCandidates: make(map[string][]pionwebrtc.ICECandidateInit),
 	}
 
-	ws := NewWebsocketClient(socketURL)
 	if err := ws.Connect(roomName, &userID); err != nil {
 		return nil, err
 	}
@@ -69,19 +64,13 @@ func NewVideoChannelClient(userID, roomName string, isMaster bool, socketURL str
 }
 
 // NewVideoChannelClientWithWs constructs the client using an existing websocket client.
+// The ICE servers and codecs are fetched with the first peer connection, with the auth token of ws.
 func NewVideoChannelClientWithWs(userID, roomName string, isMaster bool, ws *WebsocketClient, signalServers ...pionwebrtc.ICEServer) (*VideoChannelClient, error) {
-	cfg := pionwebrtc.Configuration{}
-	if len(signalServers) > 0 {
-		cfg.ICEServers = signalServers
-	} else {
-		cfg.ICEServers = []pionwebrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}}
-	}
-
 	c := &VideoChannelClient{
 		userID:            userID,
 		roomID:            roomName,
 		isMaster:          isMaster,
-		config:            cfg,
+		config:            pionwebrtc.Configuration{ICEServers: signalServers},
 		peers:             make(map[string]*pionwebrtc.PeerConnection),
 		streams:           make(map[string][]*pionwebrtc.TrackRemote),
 		pendingCandidates: make(map[string][]pionwebrtc.ICECandidateInit),
@@ -159,7 +148,8 @@ func (c *VideoChannelClient) sendSignal(msg SignalMsg) error {
 	dc := c.dataChannel
 	c.mu.Unlock()
 
-	if dc != nil {
+	// the SFU is reachable over the websocket only
+	if dc != nil && msg.To != SfuPeer {
 		bytes, err := json.Marshal(msg)
 		if err == nil {
 			// DataChannelClient.SendMsg broadcasts to all peers.
@@ -212,14 +202,14 @@ func (c *VideoChannelClient) handleSignalingData(message *SignalMsg) {
 	}
 	switch t {
 	case "offer":
-		if _, ok := c.peers[sid]; !ok {
+		if c.peer(sid) == nil {
 			_ = c.createVideoPeerConnection(sid, false)
 		}
 		if sdpMap, ok := dataMap["sdp"].(map[string]interface{}); ok {
 			sdpBytes, _ := json.Marshal(sdpMap)
 			var desc pionwebrtc.SessionDescription
 			_ = json.Unmarshal(sdpBytes, &desc)
-			if peer := c.peers[sid]; peer != nil {
+			if peer := c.peer(sid); peer != nil {
 				_ = peer.SetRemoteDescription(desc)
 				answer, err := peer.CreateAnswer(nil)
 				if err == nil {
@@ -237,7 +227,7 @@ func (c *VideoChannelClient) handleSignalingData(message *SignalMsg) {
 			sdpBytes, _ := json.Marshal(sdpMap)
 			var desc pionwebrtc.SessionDescription
 			_ = json.Unmarshal(sdpBytes, &desc)
-			if peer := c.peers[sid]; peer != nil {
+			if peer := c.peer(sid); peer != nil {
 				_ = peer.SetRemoteDescription(desc)
 				c.getAndClearPendingCandidates(sid)
 			}
@@ -247,7 +237,7 @@ func (c *VideoChannelClient) handleSignalingData(message *SignalMsg) {
 			candBytes, _ := json.Marshal(cand)
 			var ci pionwebrtc.ICECandidateInit
 			_ = json.Unmarshal(candBytes, &ci)
-			if peer, ok := c.peers[sid]; ok && peer.RemoteDescription() != nil {
+			if peer := c.peer(sid); peer != nil && peer.RemoteDescription() != nil {
 				_ = peer.AddICECandidate(ci)
 			} else {
 				c.addPendingCandidates(sid, ci)
@@ -256,6 +246,13 @@ func (c *VideoChannelClient) handleSignalingData(message *SignalMsg) {
 	}
 }
 
+// peer returns the peer connection of sid, nil when there is none.
+func (c *VideoChannelClient) peer(sid string) *pionwebrtc.PeerConnection {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peers[sid]
+}
+
 func (c *VideoChannelClient) addPendingCandidates(sid string, candidate pionwebrtc.ICECandidateInit) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -274,15 +271,34 @@ func (c *VideoChannelClient) getAndClearPendingCandidates(sid string) {
 	c.pendingCandidates[sid] = nil
 }
 
+// peerSetup fetches the ICE servers (unless given to the constructor) and the codec registry once,
+// late enough for the websocket's auth token to be set.
+func (c *VideoChannelClient) peerSetup() (*pionwebrtc.API, pionwebrtc.Configuration) {
+	c.setup.Do(func() {
+		if len(c.config.ICEServers) == 0 {
+			c.config.ICEServers = iceServersOf(c.websocket, c.userID)
+		}
+		c.api = apiOf(c.websocket)
+	})
+	return c.api, c.config
+}
+
 func (c *VideoChannelClient) createVideoPeerConnection(sid string, isCaller bool) error {
-	pc, err := pionwebrtc.NewPeerConnection(c.config)
+	api, config := c.peerSetup()
+	pc, err := api.NewPeerConnection(config)
 	if err != nil {
 		return err
 	}
+	c.mu.Lock()
+	if _, exists := c.peers[sid]; exists {
+		// created meanwhile by the signaling goroutine or another JoinSfu
+		c.mu.Unlock()
+		_ = pc.Close()
+		return nil
+	}
 	c.peers[sid] = pc
 
 	// Add local tracks to peer
-	c.mu.Lock()
 	for _, t := range c.localTracks {
 		sender, err := pc.AddTrack(t)
 		if err != nil {
@@ -301,6 +317,14 @@ func (c *VideoChannelClient) createVideoPeerConnection(sid string, isCaller bool
 			}
 		}(sender)
 	}
+	if sid == SfuPeer {
+		// receive the room's audio and video even without local tracks, an offer needs a media section
+		for _, kind := range []pionwebrtc.RTPCodecType{pionwebrtc.RTPCodecTypeAudio, pionwebrtc.RTPCodecTypeVideo} {
+			if !hasTrackOfKind(c.localTracks, kind) {
+				_, _ = pc.AddTransceiverFromKind(kind, pionwebrtc.RTPTransceiverInit{Direction: pionwebrtc.RTPTransceiverDirectionRecvonly})
+			}
+		}
+	}
 	c.mu.Unlock()
 
 	pc.OnICECandidate(func(ci *pionwebrtc.ICECandidate) {
@@ -313,8 +337,13 @@ func (c *VideoChannelClient) createVideoPeerConnection(sid string, isCaller bool
 	})
 
 	pc.OnTrack(func(track *pionwebrtc.TrackRemote, receiver *pionwebrtc.RTPReceiver) {
+		// tracks forwarded by the SFU carry their publisher as stream id
+		owner := sid
+		if sid == SfuPeer {
+			owner = track.StreamID()
+		}
 		c.mu.Lock()
-		c.streams[sid] = append(c.streams[sid], track)
+		c.streams[owner] = append(c.streams[owner], track)
 		c.mu.Unlock()
 
 		cancel := setupTrackHandlers(pc, track)
@@ -322,7 +351,7 @@ func (c *VideoChannelClient) createVideoPeerConnection(sid string, isCaller bool
 
 		// notify listeners
 		for _, l := range c.remoteListeners {
-			l(c.streams[sid], sid)
+			l(c.streams[owner], owner)
 		}
 	})
 
@@ -352,6 +381,15 @@ func (c *VideoChannelClient) createVideoPeerConnection(sid string, isCaller bool
 	return nil
 }
 
+func hasTrackOfKind(tracks []pionwebrtc.TrackLocal, kind pionwebrtc.RTPCodecType) bool {
+	for _, t := range tracks {
+		if t.Kind() == kind {
+			return true
+		}
+	}
+	return false
+}
+
 // checkAndStopCamera iterates through peers and stops camera if no active connections remain
 func (c *VideoChannelClient) checkAndStopCamera() {
 	c.mu.Lock()
@@ -379,7 +417,13 @@ func (c *VideoChannelClient) Close() {
 		c.videoCancel()
 	}
 	c.websocket.Close()
+	c.mu.Lock()
+	peers := make([]*pionwebrtc.PeerConnection, 0, len(c.peers))
 	for _, pc := range c.peers {
+		peers = append(peers, pc)
+	}
+	c.mu.Unlock()
+	for _, pc := range peers {
 		_ = pc.Close()
 	}
 }
@@ -395,6 +439,24 @@ func (c *VideoChannelClient) SetLocalTrack(t pionwebrtc.TrackLocal) {
 	}
 }
 
+// JoinSfu negotiates a peer connection with the server's SFU instead of one per room member:
+// the local tracks are published to the room and the tracks of the other publishers arrive through
+// the server's renegotiation offers, keyed by publisher in GetRemoteStreams.
+func (c *VideoChannelClient) JoinSfu() error {
+	if c.peer(SfuPeer) != nil {
+		return nil
+	}
+	return c.createVideoPeerConnection(SfuPeer, true)
+}
+
+// RequestSfuLayer asks the SFU for the simulcast layer rid of publisher (of every publisher when empty),
+// an empty rid lets the server pick the best layer again.
+func (c *VideoChannelClient) RequestSfuLayer(publisher, rid string) error {
+	enc, _ := json.Marshal(map[string]interface{}{"type": "layer", "publisher": publisher, "rid": rid})
+	m := SignalMsg{Channel: getValue(ChannelWebrtc), Msg: base64.StdEncoding.EncodeToString(enc), From: c.userID, To: SfuPeer, RoomId: c.roomID}
+	return c.sendSignal(m)
+}
+
 // GetRemoteStreams returns the map of remote tracks per peer id
 func (c *VideoChannelClient) GetRemoteStreams() map[string][]*pionwebrtc.TrackRemote {
 	return c.streams
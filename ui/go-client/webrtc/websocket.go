@@ -4,10 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
 	"net/url"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
@@ -15,8 +17,11 @@ import (
 // Updated to support multiple subscribers (Broadcast).
 type WebsocketClient struct {
 	url         string
+	token       string // optional bearer token sent when joining a room on a server with auth enabled
+	role        string // optional role hint, only honored by servers without a room access list
 	conn        *websocket.Conn
 	subscribers []chan []byte
+	acks        map[string]chan SignalMsg // message id -> waiter of SendWithAck
 	mu          sync.Mutex
 }
 
@@ -24,9 +29,24 @@ func NewWebsocketClient(url string) *WebsocketClient {
 	return &WebsocketClient{
 		url:         url,
 		subscribers: make([]chan []byte, 0),
+		acks:        make(map[string]chan SignalMsg),
 	}
 }
 
+// SetAuthToken sets the bearer token used by the next Connect.
+func (w *WebsocketClient) SetAuthToken(token string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.token = token
+}
+
+// SetRole sets the role (e.g. RoleDevice) requested by the next Connect.
+func (w *WebsocketClient) SetRole(role string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.role = role
+}
+
 func (w *WebsocketClient) Connect(roomId string, userId *string) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
@@ -34,6 +54,9 @@ func (w *WebsocketClient) Connect(roomId string, userId *string) error {
 		return nil
 	}
 	joinUrl := fmt.Sprintf("%s/join/%s/c/%s", w.url, roomId, *userId)
+	if w.role != "" {
+		joinUrl += "?role=" + url.QueryEscape(w.role)
+	}
 	log.Printf("connecting to: %s", joinUrl)
 
 	// verify URL is valid
@@ -44,7 +67,11 @@ func (w *WebsocketClient) Connect(roomId string, userId *string) error {
 	dialer := websocket.DefaultDialer
 	dialer.HandshakeTimeout = 5 * time.Second
 
-	conn, resp, err := dialer.Dial(joinUrl, nil)
+	var header http.Header
+	if w.token != "" {
+		header = http.Header{"Authorization": []string{"Bearer " + w.token}}
+	}
+	conn, resp, err := dialer.Dial(joinUrl, header)
 	if err != nil {
 		if resp != nil {
 			return fmt.Errorf("websocket dial error: %v (status: %s)", err, resp.Status)
@@ -63,6 +90,10 @@ func (w *WebsocketClient) readLoop() {
 			close(ch)
 		}
 		w.subscribers = nil // clear subscribers
+		for id, ch := range w.acks {
+			close(ch) // pending SendWithAck fail fast instead of waiting for the timeout
+			delete(w.acks, id)
+		}
 		w.conn = nil
 		w.mu.Unlock()
 	}()
@@ -78,6 +109,7 @@ func (w *WebsocketClient) readLoop() {
 		}
 		// Broadcast message to all subscribers
 		w.mu.Lock()
+		w.resolveAck(msg)
 		for _, ch := range w.subscribers {
 			// Non-blocking send to avoid one slow subscriber blocking others
 			select {
@@ -103,6 +135,57 @@ func (w *WebsocketClient) Send(message SignalMsg) error {
 	return w.conn.WriteMessage(websocket.TextMessage, payload)
 }
 
+// SendWithAck sends message and waits for the server response acknowledging it.
+// An empty message ID is filled with a random UUID. The response is returned for every outcome,
+// the error is set when the ack is not delivered, queued or forwarded, or nothing arrives within timeout.
+func (w *WebsocketClient) SendWithAck(message SignalMsg, timeout time.Duration) (SignalMsg, error) {
+	if message.ID == "" {
+		message.ID = uuid.NewString()
+	}
+	ch := make(chan SignalMsg, 1)
+	w.mu.Lock()
+	w.acks[message.ID] = ch
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		delete(w.acks, message.ID)
+		w.mu.Unlock()
+	}()
+
+	if err := w.Send(message); err != nil {
+		return SignalMsg{}, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return SignalMsg{}, fmt.Errorf("connection closed before ack of message %s", message.ID)
+		}
+		if resp.Ack != AckDelivered && resp.Ack != AckQueued && resp.Ack != AckForwarded {
+			return resp, fmt.Errorf("message %s %s: %v", message.ID, resp.Ack, resp.Msg)
+		}
+		return resp, nil
+	case <-timer.C:
+		return SignalMsg{}, fmt.Errorf("no ack for message %s within %s", message.ID, timeout)
+	}
+}
+
+// resolveAck hands a server response to the SendWithAck waiting for its id. Caller holds w.mu.
+func (w *WebsocketClient) resolveAck(raw []byte) {
+	if len(w.acks) == 0 {
+		return
+	}
+	var resp SignalMsg
+	if err := json.Unmarshal(raw, &resp); err != nil || resp.Ack == "" || resp.ID == "" {
+		return
+	}
+	if ch, ok := w.acks[resp.ID]; ok {
+		ch <- resp
+		delete(w.acks, resp.ID)
+	}
+}
+
 // GetMessages returns a new channel that receives all incoming messages.
 func (w *WebsocketClient) GetMessages() <-chan []byte {
 	w.mu.Lock()